@@ -0,0 +1,32 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Snapshot returns a consistent tar.gz archive of every document, which can
+// be loaded again with nanodb restore
+func Snapshot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Info("taking snapshot")
+
+	// archive in memory so writes aren't held up by a slow client
+	var buf bytes.Buffer
+	count, err := index.I.Snapshot(&buf)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, "", "err taking snapshot: %s", err.Error())
+		return
+	}
+	log.Info("snapshot of %d documents taken", count)
+
+	name := fmt.Sprintf("nanodb-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	_, _ = buf.WriteTo(w)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+func TestSnapshot(t *testing.T) {
+	router := httprouter.New()
+	router.POST("/_admin/snapshot", Snapshot)
+
+	t.Run("snapshot can be restored", func(t *testing.T) {
+		// leave the shared index untouched for other tests
+		shared := index.I
+		defer func() { index.I = shared }()
+
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("a", map[string]interface{}{"n": float64(1)})
+		index.I.Regenerate()
+
+		req, _ := http.NewRequest("POST", "/_admin/snapshot", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		if rr.Header().Get("Content-Type") != "application/gzip" {
+			t.Errorf("got content type %s, want application/gzip", rr.Header().Get("Content-Type"))
+		}
+
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		count, err := index.I.Restore(rr.Body)
+		if err != nil || count != 1 {
+			t.Fatalf("got %d documents and err %v restoring snapshot", count, err)
+		}
+		assertJSONFileContents(t, index.I, "a", map[string]interface{}{"n": float64(1)})
+	})
+}
@@ -3,10 +3,14 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/jackyzha0/nanoDB/index"
 	"github.com/jackyzha0/nanoDB/log"
@@ -34,6 +38,13 @@ func GetIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 // GetKey returns the file with that key if found, otherwise return 404
 func GetKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
+
+	// serve a previous version instead if asked for
+	if r.URL.Query().Get("version") != "" {
+		getKeyVersion(w, r, key)
+		return
+	}
+
 	log.Info("get key '%s'", key)
 
 	file, ok := index.I.Lookup(key)
@@ -43,17 +54,21 @@ func GetKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		w.Header().Set("Content-Type", "application/json")
 
 		// unpack bytes into map
-		jsonMap, err := file.ToMap()
+		bytes, jsonMap, err := readDocument(file)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			log.WWarn(w, "err key '%s' cannot be parsed into json: %s", key, err.Error())
+			writeErr(w, http.StatusBadRequest, CodeInvalidJSON, key, "key '%s' cannot be parsed into json: %s", key, err.Error())
 			return
 		}
+		if o := ownerOf(r); o != nil && !o.owns(jsonMap) {
+			writeNotOwner(w, key)
+			return
+		}
+		w.Header().Set("ETag", index.ETag(bytes))
 
 		// successful field get
 		w.Header().Set("Content-Type", "application/json")
 		maxDepth := getMaxDepthParam(r)
-		resolvedJsonMap := index.ResolveReferences(jsonMap, maxDepth)
+		resolvedJsonMap := index.ResolveReferencesFor(jsonMap, maxDepth, readable(r))
 
 		jsonData, _ := json.Marshal(resolvedJsonMap)
 		fmt.Fprintf(w, "%+v", string(jsonData))
@@ -61,14 +76,25 @@ func GetKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 
 	// otherwise write 404
-	w.WriteHeader(http.StatusNotFound)
-	log.WWarn(w, "key '%s' not found", key)
+	writeErr(w, http.StatusNotFound, CodeNotFound, key, "key '%s' not found", key)
 }
 
-// GetKeyField returns key's field, 404 if not found
+// GetKeyField returns key's field, 400 if not found. field can be a dotted
+// path or an escaped json pointer to a nested field
 func GetKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
 	field := ps.ByName("field")
+
+	// reserved fields that are handled as endpoints of their own
+	if field == "_history" {
+		GetKeyHistory(w, r, ps)
+		return
+	}
+	if field == "_watch" {
+		WatchKey(w, r, ps)
+		return
+	}
+
 	log.Info("get field '%s' in key '%s'", field, key)
 
 	file, ok := index.I.Lookup(key)
@@ -76,25 +102,24 @@ func GetKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// if file fetch is successful
 	if ok {
 		// unpack bytes into map
-		jsonMap, err := file.ToMap()
+		bytes, jsonMap, err := readDocument(file)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			log.WWarn(w, "err key '%s' cannot be parsed into json: %s", key, err.Error())
+			writeErr(w, http.StatusBadRequest, CodeInvalidJSON, key, "key '%s' cannot be parsed into json: %s", key, err.Error())
 			return
 		}
+		w.Header().Set("ETag", index.ETag(bytes))
 
-		// lookup value
-		val, ok := jsonMap[field]
+		// lookup value, following nested objects and arrays
+		val, ok := index.GetPath(jsonMap, index.ParseFieldPath(field))
 		if !ok {
-			w.WriteHeader(http.StatusBadRequest)
-			log.WWarn(w, "err key '%s' does not have field '%s'", key, field)
+			writeErr(w, http.StatusBadRequest, CodeInvalidRequest, key, "key '%s' does not have field '%s'", key, field)
 			return
 		}
 
 		// successful field get
 		w.Header().Set("Content-Type", "application/json")
 		maxDepth := getMaxDepthParam(r)
-		resolvedValue := index.ResolveReferences(val, maxDepth)
+		resolvedValue := index.ResolveReferencesFor(val, maxDepth, readable(r))
 
 		jsonData, _ := json.Marshal(resolvedValue)
 		fmt.Fprintf(w, "%+v", string(jsonData))
@@ -102,8 +127,97 @@ func GetKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 
 	// otherwise write 404
-	w.WriteHeader(http.StatusNotFound)
-	log.WWarn(w, "key '%s' not found", key)
+	writeErr(w, http.StatusNotFound, CodeNotFound, key, "key '%s' not found", key)
+}
+
+// GetKeyHistory returns a JSON of all saved versions of a key
+func GetKeyHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	log.Info("get history of key '%s'", key)
+
+	versions, err := index.I.History(key)
+	if errors.Is(err, index.ErrInvalidKey) {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, key, "%s", err.Error())
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, key, "err reading history of key '%s': %s", key, err.Error())
+		return
+	}
+
+	// create temporary struct with history data
+	data := struct {
+		Key      string          `json:"key"`
+		Versions []index.Version `json:"versions"`
+	}{
+		Key:      key,
+		Versions: versions,
+	}
+
+	// create json representation and return
+	w.Header().Set("Content-Type", "application/json")
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(w, "%+v", string(jsonData))
+}
+
+// getKeyVersion writes a previous version of key, 404 if not found
+func getKeyVersion(w http.ResponseWriter, r *http.Request, key string) {
+	versionStr := r.URL.Query().Get("version")
+	log.Info("get version %s of key '%s'", versionStr, key)
+
+	version, err := strconv.Atoi(versionStr)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, key, "version '%s' is not a number", versionStr)
+		return
+	}
+
+	bytes, err := index.I.GetVersion(key, version)
+	if err != nil {
+		writeErr(w, http.StatusNotFound, CodeNotFound, key, "version %d of key '%s' not found", version, key)
+		return
+	}
+
+	// unpack bytes into map
+	var jsonMap map[string]interface{}
+	err = json.Unmarshal(bytes, &jsonMap)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidJSON, key, "version %d of key '%s' cannot be parsed into json: %s", version, key, err.Error())
+		return
+	}
+	if o := ownerOf(r); o != nil && !o.owns(jsonMap) {
+		writeNotOwner(w, key)
+		return
+	}
+
+	// successful version get
+	w.Header().Set("Content-Type", "application/json")
+	maxDepth := getMaxDepthParam(r)
+	resolvedJSONMap := index.ResolveReferencesFor(jsonMap, maxDepth, readable(r))
+
+	jsonData, _ := json.Marshal(resolvedJSONMap)
+	fmt.Fprintf(w, "%+v", string(jsonData))
+}
+
+// readDocument returns both the raw bytes of file and the parsed json
+// so an ETag can be computed from the exact contents that were parsed
+func readDocument(file *index.File) ([]byte, map[string]interface{}, error) {
+	bytes, err := file.GetByteArray()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var jsonMap map[string]interface{}
+	err = json.Unmarshal(bytes, &jsonMap)
+	return bytes, jsonMap, err
+}
+
+// writeWriteErr writes the response for a failed write to key
+func writeWriteErr(w http.ResponseWriter, key string, err error) {
+	status, e := errorFor(key, err)
+	if status == http.StatusInternalServerError {
+		e.Message = fmt.Sprintf("err updating key '%s': %s", key, err.Error())
+	}
+	writeAPIError(w, status, e)
 }
 
 // try to find recursive depth param or else return a default
@@ -119,7 +233,27 @@ func getMaxDepthParam(r *http.Request) int {
 	return maxDepth
 }
 
-// PatchKeyField modifies the field of a key
+// try to find a ttl in seconds from the ttl param or X-TTL header,
+// returns 0 if there is none
+func getTTLParam(r *http.Request) (time.Duration, error) {
+	ttlStr := r.URL.Query().Get("ttl")
+	if ttlStr == "" {
+		ttlStr = r.Header.Get("X-TTL")
+	}
+	if ttlStr == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.Atoi(ttlStr)
+	if err != nil || seconds < 1 {
+		return 0, fmt.Errorf("ttl '%s' is not a positive number of seconds", ttlStr)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// PatchKeyField modifies the field of a key, creating any missing objects
+// along the path to it
 func PatchKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
 	field := ps.ByName("field")
@@ -128,8 +262,7 @@ func PatchKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	// get bytes from request body
 	bodyBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.WWarn(w, "err reading body with key '%s': %s", key, err.Error())
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, key, "err reading body with key '%s': %s", key, err.Error())
 		return
 	}
 
@@ -137,43 +270,80 @@ func PatchKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	file, ok := index.I.Lookup(key)
 	// if file fetch is successful
 	if ok {
-		// unpack bytes into map
-		jsonMap, err := file.ToMap()
+		// make sure existing document is valid json
+		_, err := file.ToMap()
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			log.WWarn(w, "err key '%s' cannot be parsed into json: %s", key, err.Error())
+			writeErr(w, http.StatusBadRequest, CodeInvalidJSON, key, "key '%s' cannot be parsed into json: %s", key, err.Error())
 			return
 		}
 
 		// set field value to parsed json
-		var parsedJSON map[string]interface{}
-		err = json.Unmarshal(bodyBytes, &parsedJSON)
+		value, err := parseFieldValue(r, bodyBytes)
 		if err != nil {
-			// not JSON, set field to string val instead
-			jsonMap[field] = string(bodyBytes)
-		} else {
-			jsonMap[field] = parsedJSON
+			writeErr(w, http.StatusBadRequest, CodeInvalidJSON, key, "value of field '%s' cannot be parsed into json: %s", field, err.Error())
+			return
 		}
 
-		// remarshal to json
-		jsonData, _ := json.Marshal(jsonMap)
+		// callers can't give away documents they own
+		if o := ownerOf(r); o != nil && !o.keeps(field, value) {
+			writeNotOwner(w, key)
+			return
+		}
 
-		// write to file
-		err = file.ReplaceContent(string(jsonData))
+		// read-modify-write the document
+		etag, err := index.I.PatchField(file, field, value, getPreconditions(r)...)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WWarn(w, "err setting content of key '%s': %s", key, err.Error())
+			writeWriteErr(w, key, err)
 			return
 		}
 
+		w.Header().Set("ETag", etag)
 		w.WriteHeader(http.StatusOK)
 		log.WInfo(w, "patch field '%s' of key '%s' successful", field, key)
 		return
 	}
 
 	// otherwise write 404
-	w.WriteHeader(http.StatusNotFound)
-	log.WWarn(w, "key '%s' not found", key)
+	writeErr(w, http.StatusNotFound, CodeNotFound, key, "key '%s' not found", key)
+}
+
+// parseFieldValue returns the value in the body of a field patch. Bodies sent
+// as text/plain are stored as a raw string, anything else must be json
+func parseFieldValue(r *http.Request, body []byte) (interface{}, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/plain" {
+		return string(body), nil
+	}
+
+	var value interface{}
+	err := json.Unmarshal(body, &value)
+	return value, err
+}
+
+// DeleteKeyField removes the field of a key, 404 if the key or field doesn't exist
+func DeleteKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	field := ps.ByName("field")
+	log.Info("delete field '%s' in key '%s'", field, key)
+
+	file, ok := index.I.Lookup(key)
+	if !ok {
+		writeErr(w, http.StatusNotFound, CodeNotFound, key, "key '%s' not found", key)
+		return
+	}
+
+	etag, err := index.I.DeleteField(file, field, getPreconditions(r)...)
+	if errors.Is(err, index.ErrFieldNotFound) {
+		writeErr(w, http.StatusNotFound, CodeNotFound, key, "key '%s' does not have field '%s'", key, field)
+		return
+	}
+	if err != nil {
+		writeWriteErr(w, key, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	log.WInfo(w, "delete field '%s' of key '%s' successful", field, key)
 }
 
 // UpdateKey creates or updates the file with that key with the request body
@@ -185,19 +355,41 @@ func UpdateKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// get bytes from request body
 	bodyBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.WWarn(w, "err reading body when key '%s': %s", key, err.Error())
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, key, "err reading body when key '%s': %s", key, err.Error())
+		return
+	}
+
+	// only json objects can be stored as documents
+	err = index.ParseDocument(bodyBytes)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidJSON, key, "body of key '%s' must be a json object: %s", key, err.Error())
 		return
 	}
 
-	// update index
-	err = index.I.Put(file, bodyBytes)
+	// callers can only write documents they will still own
+	if o := ownerOf(r); o != nil {
+		var doc interface{}
+		_ = json.Unmarshal(bodyBytes, &doc)
+		if !o.owns(doc) {
+			writeNotOwner(w, key)
+			return
+		}
+	}
+
+	ttl, err := getTTLParam(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.WWarn(w, "err updating key '%s': %s", key, err.Error())
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, key, "invalid ttl for key '%s': %s", key, err.Error())
 		return
 	}
 
+	// update index, along with the expiry if asked for
+	err = index.I.PutWithTTL(file, bodyBytes, ttl, getPreconditions(r)...)
+	if err != nil {
+		writeWriteErr(w, key, err)
+		return
+	}
+	w.Header().Set("ETag", index.ETag(bodyBytes))
+
 	// file is updated
 	if ok {
 		log.WInfo(w, "update '%s' successful", key)
@@ -220,10 +412,18 @@ func DeleteKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	// if file found delete it
 	if ok {
-		err := index.I.Delete(file)
+		err := index.I.Delete(file, getPreconditions(r)...)
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted by another request in the meantime
+			writeErr(w, http.StatusNotFound, CodeNotFound, key, "key '%s' does not exist", key)
+			return
+		}
+		if errors.Is(err, index.ErrPreconditionFailed) || errors.Is(err, errNotOwner) {
+			writeWriteErr(w, key, err)
+			return
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WWarn(w, "err unable to delete key '%s': '%s'", key, err.Error())
+			writeErr(w, http.StatusInternalServerError, CodeInternal, key, "err unable to delete key '%s': '%s'", key, err.Error())
 			return
 		}
 
@@ -232,6 +432,5 @@ func DeleteKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 
 	// else state not found
-	w.WriteHeader(http.StatusNotFound)
-	log.WWarn(w, "key '%s' does not exist", key)
+	writeErr(w, http.StatusNotFound, CodeNotFound, key, "key '%s' does not exist", key)
 }
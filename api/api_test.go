@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/jackyzha0/nanoDB/index"
@@ -35,6 +36,21 @@ func assertHTTPContains(t *testing.T, rr *httptest.ResponseRecorder, expected []
 	}
 }
 
+func assertHTTPErr(t *testing.T, rr *httptest.ResponseRecorder, code string, key string) {
+	t.Helper()
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Errorf("response is not an error envelope: %s", rr.Body.String())
+		return
+	}
+	if body.Error.Code != code || body.Error.Key != key || body.Error.Message == "" {
+		t.Errorf("wrong error returned: got %+v, wanted code %s and key '%s'", body.Error, code, key)
+	}
+}
+
 func assertSliceContains(t *testing.T, list []string, s string) {
 	found := false
 	for _, v := range list {
@@ -167,6 +183,7 @@ func TestGetKey(t *testing.T) {
 
 		router.ServeHTTP(rr, req)
 		assertHTTPStatus(t, rr, http.StatusNotFound)
+		assertHTTPErr(t, rr, CodeNotFound, "nothinghere")
 	})
 
 	t.Run("get file", func(t *testing.T) {
@@ -272,6 +289,40 @@ func TestGetKeyField(t *testing.T) {
 		assertHTTPStatus(t, rr, http.StatusOK)
 		assertHTTPBody(t, rr, nested)
 	})
+
+	t.Run("get nested field by path", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", map[string]interface{}{
+			"user": map[string]interface{}{
+				"address": map[string]interface{}{"city": "Vancouver"},
+				"tags":    []interface{}{"a", "b"},
+			},
+		})
+		index.I.Regenerate()
+
+		paths := map[string]string{
+			"/test/user.address.city":     `"Vancouver"`,
+			"/test/~1user~1address~1city": `"Vancouver"`,
+			"/test/user.tags.1":           `"b"`,
+		}
+		for path, want := range paths {
+			req, _ := http.NewRequest("GET", path, nil)
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, http.StatusOK)
+			if rr.Body.String() != want {
+				t.Errorf("wrong value for %s: got %s, wanted %s", path, rr.Body.String(), want)
+			}
+		}
+
+		req, _ := http.NewRequest("GET", "/test/user.address.zip", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+	})
 }
 
 func TestDeleteKey(t *testing.T) {
@@ -301,6 +352,21 @@ func TestDeleteKey(t *testing.T) {
 		assertHTTPStatus(t, rr, http.StatusOK)
 		assertEmptySlice(t, index.I.List())
 	})
+
+	t.Run("delete key removed in the meantime", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		file := makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+		_ = index.I.FileSystem.Remove(file.ResolvePath())
+
+		req, _ := http.NewRequest("DELETE", "/test", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusNotFound)
+		assertHTTPErr(t, rr, CodeNotFound, "test")
+	})
 }
 
 func TestUpdateKey(t *testing.T) {
@@ -343,6 +409,7 @@ func TestUpdateKey(t *testing.T) {
 
 	t.Run("update key with non-json bytes", func(t *testing.T) {
 		index.I.SetFileSystem(af.NewMemMapFs())
+		index.I.Regenerate()
 
 		jsonBytes := []byte("non-json bytes")
 		byteReader := bytes.NewReader(jsonBytes)
@@ -350,9 +417,23 @@ func TestUpdateKey(t *testing.T) {
 		rr := httptest.NewRecorder()
 
 		router.ServeHTTP(rr, req)
-		assertHTTPStatus(t, rr, http.StatusOK)
-		assertSliceContains(t, index.I.List(), "something")
-		assertRawFileContents(t, index.I, "something", jsonBytes)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+		assertEmptySlice(t, index.I.List())
+		assertHTTPErr(t, rr, CodeInvalidJSON, "something")
+	})
+
+	t.Run("update key with json that isn't an object", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+		index.I.Regenerate()
+
+		byteReader := bytes.NewReader([]byte(`["a", "b"]`))
+		req, _ := http.NewRequest("PUT", "/something", byteReader)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+		assertEmptySlice(t, index.I.List())
+		assertHTTPErr(t, rr, CodeInvalidJSON, "something")
 	})
 }
 
@@ -402,6 +483,24 @@ func TestPatchKeyField(t *testing.T) {
 		req, _ := http.NewRequest("PATCH", "/test/field", byteReader)
 		rr := httptest.NewRecorder()
 
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+		assertHTTPErr(t, rr, CodeInvalidJSON, "test")
+		assertJSONFileContents(t, index.I, "test", exampleJSON)
+	})
+
+	t.Run("patch field of existing key with plain text", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+
+		jsonBytes := []byte("non-json bytes")
+		byteReader := bytes.NewReader(jsonBytes)
+		req, _ := http.NewRequest("PATCH", "/test/field", byteReader)
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		rr := httptest.NewRecorder()
+
 		expected := map[string]interface{}{
 			"field": "non-json bytes",
 		}
@@ -410,4 +509,401 @@ func TestPatchKeyField(t *testing.T) {
 		assertHTTPStatus(t, rr, http.StatusOK)
 		assertJSONFileContents(t, index.I, "test", expected)
 	})
+
+	t.Run("patch nested field creates missing objects", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+
+		for _, path := range []string{"/test/user.address.city", "/test/~1user~1tags"} {
+			req, _ := http.NewRequest("PATCH", path, bytes.NewReader([]byte(`"x"`)))
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, http.StatusOK)
+		}
+
+		assertJSONFileContents(t, index.I, "test", map[string]interface{}{
+			"field": "value",
+			"user": map[string]interface{}{
+				"address": map[string]interface{}{"city": "x"},
+				"tags":    "x",
+			},
+		})
+	})
+
+	t.Run("patch through a value that isn't an object", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+
+		req, _ := http.NewRequest("PATCH", "/test/field.inner", bytes.NewReader([]byte(`1`)))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+		assertHTTPErr(t, rr, CodeInvalidRequest, "test")
+		assertJSONFileContents(t, index.I, "test", exampleJSON)
+	})
+
+	t.Run("patch fields with json values that aren't objects", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+
+		values := map[string]string{
+			"count": "42",
+			"ok":    "true",
+			"gone":  "null",
+			"list":  "[1, 2]",
+			"name":  `"42"`,
+		}
+		for field, value := range values {
+			req, _ := http.NewRequest("PATCH", "/test/"+field, bytes.NewReader([]byte(value)))
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, http.StatusOK)
+		}
+
+		assertJSONFileContents(t, index.I, "test", map[string]interface{}{
+			"field": "value",
+			"count": float64(42),
+			"ok":    true,
+			"gone":  nil,
+			"list":  []interface{}{float64(1), float64(2)},
+			"name":  "42",
+		})
+	})
+}
+
+func TestDeleteKeyField(t *testing.T) {
+	router := httprouter.New()
+	router.DELETE("/:key/:field", DeleteKeyField)
+
+	t.Run("delete field of non-existent key", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+		index.I.Regenerate()
+
+		req, _ := http.NewRequest("DELETE", "/nofile/field", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusNotFound)
+		assertHTTPErr(t, rr, CodeNotFound, "nofile")
+	})
+
+	t.Run("delete nested field", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", map[string]interface{}{
+			"field": "value",
+			"user":  map[string]interface{}{"name": "alice", "age": float64(30)},
+		})
+		index.I.Regenerate()
+
+		req, _ := http.NewRequest("DELETE", "/test/user.age", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertJSONFileContents(t, index.I, "test", map[string]interface{}{
+			"field": "value",
+			"user":  map[string]interface{}{"name": "alice"},
+		})
+	})
+
+	t.Run("delete non-existent field", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+
+		req, _ := http.NewRequest("DELETE", "/test/nofield", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusNotFound)
+		assertHTTPErr(t, rr, CodeNotFound, "test")
+		assertJSONFileContents(t, index.I, "test", exampleJSON)
+	})
+}
+
+func TestGetKeyHistory(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/:key", GetKey)
+	router.GET("/:key/:field", GetKeyField)
+
+	index.I.SetHistoryLimit(5)
+	defer index.I.SetHistoryLimit(0)
+
+	t.Run("history of key without versions", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		req, _ := http.NewRequest("GET", "/test/_history", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{
+			"key":      "test",
+			"versions": []interface{}{},
+		})
+	})
+
+	t.Run("history and versions of updated key", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		file, _ := index.I.Lookup("test")
+		_ = index.I.Put(file, []byte(`{"field":"old"}`))
+		_ = index.I.Put(file, []byte(`{"field":"new"}`))
+
+		req, _ := http.NewRequest("GET", "/test/_history", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPContains(t, rr, []string{`"version":1`})
+
+		req, _ = http.NewRequest("GET", "/test?version=1", nil)
+		rr = httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{
+			"field": "old",
+		})
+	})
+
+	t.Run("get non-existent version", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		req, _ := http.NewRequest("GET", "/test?version=3", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusNotFound)
+	})
+
+	t.Run("get invalid version", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		req, _ := http.NewRequest("GET", "/test?version=latest", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+	})
+}
+
+func TestPreconditions(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/:key", GetKey)
+	router.PUT("/:key", UpdateKey)
+	router.DELETE("/:key", DeleteKey)
+	router.PATCH("/:key", PatchKey)
+	router.PATCH("/:key/:field", PatchKeyField)
+	router.DELETE("/:key/:field", DeleteKeyField)
+
+	getETag := func(t *testing.T) string {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		return rr.Header().Get("ETag")
+	}
+
+	t.Run("get returns etag of document", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+
+		jsonData, _ := json.Marshal(exampleJSON)
+		if got := getETag(t); got != index.ETag(jsonData) {
+			t.Errorf("got etag %s, want %s", got, index.ETag(jsonData))
+		}
+	})
+
+	t.Run("put with matching if-match", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+
+		req, _ := http.NewRequest("PUT", "/test", mapToIOReader(map[string]interface{}{"new": "value"}))
+		req.Header.Set("If-Match", getETag(t))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertJSONFileContents(t, index.I, "test", map[string]interface{}{"new": "value"})
+	})
+
+	t.Run("put, patch and delete with stale if-match", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+
+		for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+			path := "/test"
+			if method == "PATCH" {
+				path = "/test/field"
+			}
+
+			req, _ := http.NewRequest(method, path, mapToIOReader(exampleJSON))
+			req.Header.Set("If-Match", `"stale", W/"also-stale"`)
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, http.StatusPreconditionFailed)
+			assertHTTPErr(t, rr, CodePreconditionFailed, "test")
+		}
+		assertJSONFileContents(t, index.I, "test", exampleJSON)
+	})
+
+	t.Run("patch and field delete return the new etag", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("test", exampleJSON)
+		index.I.Regenerate()
+
+		requests := []struct {
+			method      string
+			path        string
+			contentType string
+			body        string
+		}{
+			{"PATCH", "/test/field", "", `"new"`},
+			{"PATCH", "/test", ContentTypeMergePatch, `{"other": 1}`},
+			{"PATCH", "/test", ContentTypeJSONPatch, `[{"op": "replace", "path": "/other", "value": 2}]`},
+			{"DELETE", "/test/other", "", ""},
+		}
+		for _, tc := range requests {
+			req, _ := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, http.StatusOK)
+			if got, want := rr.Header().Get("ETag"), getETag(t); got != want {
+				t.Errorf("%s %s: got etag %q, want %q", tc.method, tc.path, got, want)
+			}
+		}
+	})
+
+	t.Run("put with if-none-match any only creates", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		for _, status := range []int{http.StatusOK, http.StatusPreconditionFailed} {
+			req, _ := http.NewRequest("PUT", "/test", mapToIOReader(exampleJSON))
+			req.Header.Set("If-None-Match", "*")
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, status)
+		}
+	})
+}
+
+func TestSchemaValidation(t *testing.T) {
+	router := httprouter.New()
+	router.PUT("/:key", UpdateKey)
+	router.PATCH("/:key/:field", PatchKeyField)
+
+	setupSchema := func() {
+		index.I.SetFileSystem(af.NewMemMapFs())
+		index.I.Regenerate()
+
+		schema := []byte(`{"pattern": "user.*", "schema": {"properties": {"age": {"type": "integer"}}}}`)
+		_ = index.I.Put(&index.File{FileName: index.SchemaPrefix + "user"}, schema)
+		_ = index.I.Put(&index.File{FileName: "user.alice"}, []byte(`{"age": 30}`))
+	}
+
+	t.Run("put non-conforming document", func(t *testing.T) {
+		setupSchema()
+
+		req, _ := http.NewRequest("PUT", "/user.bob", strings.NewReader(`{"age": "old"}`))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusUnprocessableEntity)
+		assertHTTPContains(t, rr, []string{"/age: must be of type integer, got string"})
+		assertHTTPErr(t, rr, CodeValidationFailed, "user.bob")
+	})
+
+	t.Run("patch into non-conforming document", func(t *testing.T) {
+		setupSchema()
+
+		req, _ := http.NewRequest("PATCH", "/user.alice/age", strings.NewReader(`"old"`))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusUnprocessableEntity)
+		assertJSONFileContents(t, index.I, "user.alice", map[string]interface{}{"age": float64(30)})
+	})
+
+	t.Run("put invalid schema document", func(t *testing.T) {
+		setupSchema()
+
+		req, _ := http.NewRequest("PUT", "/"+index.SchemaPrefix+"order", strings.NewReader(`{"schema": {}}`))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusUnprocessableEntity)
+	})
+}
+
+func TestUpdateKeyTTL(t *testing.T) {
+	router := httprouter.New()
+	router.PUT("/:key", UpdateKey)
+
+	t.Run("put with ttl param", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		req, _ := http.NewRequest("PUT", "/something?ttl=60", mapToIOReader(exampleJSON))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+
+		ttl, ok := index.I.TTL("something")
+		if !ok || ttl > time.Minute {
+			t.Errorf("got ttl %s, wanted at most a minute", ttl)
+		}
+	})
+
+	t.Run("put with ttl header", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		req, _ := http.NewRequest("PUT", "/something", mapToIOReader(exampleJSON))
+		req.Header.Set("X-TTL", "60")
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+
+		_, ok := index.I.TTL("something")
+		if !ok {
+			t.Errorf("key should have a ttl")
+		}
+	})
+
+	t.Run("put with invalid ttl", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+		index.I.Regenerate()
+
+		req, _ := http.NewRequest("PUT", "/something?ttl=soon", mapToIOReader(exampleJSON))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+		assertEmptySlice(t, index.I.List())
+	})
 }
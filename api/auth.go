@@ -0,0 +1,272 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// permissions an api key can be granted on the keys matching a pattern
+const (
+	PermRead   = "read"
+	PermWrite  = "write"
+	PermDelete = "delete"
+	PermAdmin  = "admin"
+)
+
+// Keys holds the api keys requests must authenticate with. Every request
+// is let through while it is nil
+var Keys *KeyStore
+
+// KeyStore holds every api key and what they are allowed to do, e.g.
+//
+//	{"keys": [{"name": "frontend", "key": "k_3f9a...", "grants": [
+//	  {"pattern": "post.*", "permissions": ["read"]},
+//	  {"pattern": "draft.*", "permissions": ["read", "write", "delete"]}
+//	]}]}
+type KeyStore struct {
+	Keys []*APIKey `json:"keys"`
+}
+
+// APIKey is a secret sent as a bearer token and the permissions it grants
+type APIKey struct {
+	Name   string  `json:"name"`
+	Key    string  `json:"key"`
+	Grants []Grant `json:"grants"`
+}
+
+// Grant gives permissions on every key matching a glob pattern
+type Grant struct {
+	Pattern     string   `json:"pattern"`
+	Permissions []string `json:"permissions"`
+}
+
+// caller is who made a request, either an api key or the claims of a token
+type caller struct {
+	key    *APIKey
+	claims map[string]interface{}
+}
+
+// callerContextKey is the request context key of the authenticated caller
+type callerContextKey struct{}
+
+// LoadKeys reads the api keys file at path
+func LoadKeys(path string) (*KeyStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeys(data)
+}
+
+// ParseKeys parses and checks an api keys file
+func ParseKeys(data []byte) (*KeyStore, error) {
+	var store KeyStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("keys file cannot be parsed into json: %s", err.Error())
+	}
+
+	seen := map[string]bool{}
+	for n, k := range store.Keys {
+		if k == nil || k.Key == "" {
+			return nil, fmt.Errorf("key %d has no secret", n)
+		}
+		if seen[k.Key] {
+			return nil, fmt.Errorf("key %d ('%s') reuses the secret of another key", n, k.Name)
+		}
+		seen[k.Key] = true
+
+		for _, g := range k.Grants {
+			if _, err := path.Match(g.Pattern, ""); err != nil || g.Pattern == "" {
+				return nil, fmt.Errorf("key '%s' has invalid pattern '%s'", k.Name, g.Pattern)
+			}
+			for _, perm := range g.Permissions {
+				if perm != PermRead && perm != PermWrite && perm != PermDelete && perm != PermAdmin {
+					return nil, fmt.Errorf("key '%s' has unknown permission '%s', must be read, write, delete or admin", k.Name, perm)
+				}
+			}
+		}
+	}
+	return &store, nil
+}
+
+// lookup returns the api key with the given secret
+func (s *KeyStore) lookup(secret string) (*APIKey, bool) {
+	var found *APIKey
+	for _, k := range s.Keys {
+		// compare every key in constant time so timing doesn't leak secrets
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(secret)) == 1 {
+			found = k
+		}
+	}
+	return found, found != nil
+}
+
+// can returns whether k has perm on key, or on every key if key is empty
+func (k *APIKey) can(perm string, key string) bool {
+	for _, g := range k.Grants {
+		matched := g.Pattern == "*"
+		if key != "" && !matched {
+			matched, _ = path.Match(g.Pattern, key)
+		}
+		if !matched {
+			continue
+		}
+
+		for _, p := range g.Permissions {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authState is the authentication settings a request is checked against,
+// captured once when it comes in so they can't change while it is handled
+type authState struct {
+	keys  *KeyStore
+	jwt   *JWTVerifier
+	rules []OwnerRule
+}
+
+// authContextKey is the request context key of the settings a request was
+// authenticated with
+type authContextKey struct{}
+
+// currentAuth returns the authentication settings in use
+func currentAuth() *authState {
+	return &authState{keys: Keys, jwt: JWT, rules: Rules}
+}
+
+// authOf returns the settings r was authenticated with, or the ones in use
+// if it didn't go through Authenticate
+func authOf(r *http.Request) *authState {
+	if a, ok := r.Context().Value(authContextKey{}).(*authState); ok {
+		return a
+	}
+	return currentAuth()
+}
+
+// enabled returns whether requests have to authenticate
+func (a *authState) enabled() bool {
+	return a.keys != nil || a.jwt != nil
+}
+
+// Authenticate rejects requests without a known api key or a valid token in
+// their Authorization header while Keys or JWT is set, and passes the caller
+// on to handlers
+func Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := currentAuth()
+		r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, a))
+		if !a.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c, err := a.authenticate(bearerToken(r))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nanodb"`)
+			writeErr(w, http.StatusUnauthorized, CodeUnauthorized, "", "%s", err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerContextKey{}, c)))
+	})
+}
+
+// authenticate returns the caller token belongs to
+func (a *authState) authenticate(token string) (*caller, error) {
+	if a.keys != nil {
+		if k, ok := a.keys.lookup(token); ok {
+			log.Info("authenticated as '%s'", k.Name)
+			return &caller{key: k}, nil
+		}
+	}
+
+	if a.jwt != nil && isJWT(token) {
+		claims, err := a.jwt.Verify(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token: %s", err.Error())
+		}
+		log.Info("authenticated with token of '%v'", claims["sub"])
+		return &caller{claims: claims}, nil
+	}
+
+	if a.jwt == nil {
+		return nil, fmt.Errorf("missing or unknown api key")
+	}
+	return nil, fmt.Errorf("missing or unknown api key or token")
+}
+
+// callerOf returns who made r, nil if it wasn't authenticated
+func callerOf(r *http.Request) *caller {
+	c, _ := r.Context().Value(callerContextKey{}).(*caller)
+	return c
+}
+
+// bearerToken returns the token in the Authorization header of r, if any
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// Require wraps handle so it only runs if the request may perm the key in
+// its path, or every key if the route isn't about a single document
+func Require(perm string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		key := ps.ByName("key")
+		if !allowed(r, perm, key) {
+			writeForbidden(w, perm, key)
+			return
+		}
+		handle(w, r, ps)
+	}
+}
+
+// allowed returns whether the api key of r has perm on key, or on every key
+// if key is empty. Tokens only get access through owner rules, see RequireOwner
+func allowed(r *http.Request, perm string, key string) bool {
+	if !authOf(r).enabled() {
+		return true
+	}
+
+	c := callerOf(r)
+	return c != nil && c.key != nil && c.key.can(requiredPerm(perm, key), key)
+}
+
+// requiredPerm returns the permission needed on key for a route needing perm.
+// Config documents decide what every caller gets to see and hold the webhook
+// secrets, so any use of them needs admin
+func requiredPerm(perm string, key string) string {
+	if index.IsReservedKey(key) {
+		return PermAdmin
+	}
+	return perm
+}
+
+// forbidden returns the error for a request missing perm on key
+func forbidden(perm string, key string) *apiError {
+	perm = requiredPerm(perm, key)
+	if key == "" {
+		return newAPIError(CodeForbidden, "", "caller lacks %s permission on every key", perm)
+	}
+	return newAPIError(CodeForbidden, key, "caller lacks %s permission on key '%s'", perm, key)
+}
+
+// writeForbidden writes a 403 for a request missing perm on key
+func writeForbidden(w http.ResponseWriter, perm string, key string) {
+	writeAPIError(w, http.StatusForbidden, forbidden(perm, key))
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+const testKeys = `{"keys": [
+	{"name": "reader", "key": "k_read", "grants": [{"pattern": "post.*", "permissions": ["read"]}]},
+	{"name": "editor", "key": "k_edit", "grants": [{"pattern": "post.*", "permissions": ["read", "write", "delete"]}]},
+	{"name": "ops", "key": "k_ops", "grants": [{"pattern": "*", "permissions": ["read", "admin"]}]},
+	{"name": "ingest", "key": "k_ingest", "grants": [{"pattern": "*", "permissions": ["read", "write"]}]}
+]}`
+
+// useKeys turns on authentication with testKeys until the returned function is called
+func useKeys(t *testing.T) func() {
+	t.Helper()
+
+	keys, err := ParseKeys([]byte(testKeys))
+	if err != nil {
+		t.Fatalf("err parsing keys: %s", err.Error())
+	}
+	Keys = keys
+	return func() { Keys = nil }
+}
+
+func TestParseKeys(t *testing.T) {
+	tt := []struct {
+		name string
+		keys string
+		err  string
+	}{
+		{"not json", `keys`, "keys file cannot be parsed into json"},
+		{"no secret", `{"keys": [{"name": "a"}]}`, "key 0 has no secret"},
+		{"reused secret", `{"keys": [{"key": "k"}, {"name": "b", "key": "k"}]}`, "key 1 ('b') reuses the secret of another key"},
+		{"invalid pattern", `{"keys": [{"name": "a", "key": "k", "grants": [{"pattern": "[", "permissions": ["read"]}]}]}`, "key 'a' has invalid pattern '['"},
+		{"unknown permission", `{"keys": [{"name": "a", "key": "k", "grants": [{"pattern": "*", "permissions": ["own"]}]}]}`, "key 'a' has unknown permission 'own'"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseKeys([]byte(tc.keys))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got err %v, wanted %s", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer useKeys(t)()
+
+	router := httprouter.New()
+	router.GET("/", Require(PermRead, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {}))
+	router.POST("/", Require(PermAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {}))
+	router.GET("/:key", Require(PermRead, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {}))
+	router.PUT("/:key", Require(PermWrite, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {}))
+	handler := Authenticate(router)
+
+	tt := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		status int
+	}{
+		{"no key", "GET", "/post.1", "", http.StatusUnauthorized},
+		{"unknown key", "GET", "/post.1", "Bearer k_nope", http.StatusUnauthorized},
+		{"not a bearer token", "GET", "/post.1", "Basic k_read", http.StatusUnauthorized},
+		{"read granted", "GET", "/post.1", "Bearer k_read", http.StatusOK},
+		{"read outside pattern", "GET", "/user.1", "Bearer k_read", http.StatusForbidden},
+		{"write not granted", "PUT", "/post.1", "Bearer k_read", http.StatusForbidden},
+		{"write granted", "PUT", "/post.1", "bearer k_edit", http.StatusOK},
+		{"every key needs a * grant", "GET", "/", "Bearer k_edit", http.StatusForbidden},
+		{"* grant reads every key", "GET", "/", "Bearer k_ops", http.StatusOK},
+		{"admin granted", "POST", "/", "Bearer k_ops", http.StatusOK},
+		{"admin not granted", "POST", "/", "Bearer k_edit", http.StatusForbidden},
+		{"config documents can't be read without admin", "GET", "/_webhooks", "Bearer k_ingest", http.StatusForbidden},
+		{"config documents can't be written without admin", "PUT", "/_redactions", "Bearer k_ingest", http.StatusForbidden},
+		{"schemas can't be written without admin", "PUT", "/_schema.post", "Bearer k_ingest", http.StatusForbidden},
+		{"admin reads config documents", "GET", "/_webhooks", "Bearer k_ops", http.StatusOK},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, tc.path, nil)
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, tc.status)
+			switch tc.status {
+			case http.StatusUnauthorized:
+				assertHTTPErr(t, rr, CodeUnauthorized, "")
+			case http.StatusForbidden:
+				assertHTTPErr(t, rr, CodeForbidden, strings.TrimPrefix(tc.path, "/"))
+			}
+		})
+	}
+}
+
+func TestAuthenticate_perKey(t *testing.T) {
+	shared := index.I
+	defer func() { index.I = shared }()
+	defer useKeys(t)()
+
+	index.I = index.NewFileIndex(".")
+	index.I.SetFileSystem(af.NewMemMapFs())
+	index.I.Regenerate()
+	_ = index.I.Put(&index.File{FileName: "user.1"}, []byte(`{"n":1}`))
+
+	router := httprouter.New()
+	router.POST("/_bulk/put", BulkPut)
+	router.POST("/_txn", Transact)
+	router.POST("/_query", Require(PermRead, Query))
+	handler := Authenticate(router)
+
+	t.Run("bulk items are checked one by one", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/_bulk/put", strings.NewReader(`{"items": [
+			{"key": "post.1", "value": {"n": 1}},
+			{"key": "user.1", "value": {"n": 2}}
+		]}`))
+		req.Header.Set("Authorization", "Bearer k_edit")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPContains(t, rr, []string{
+			`{"key":"post.1","status":200}`,
+			`{"key":"user.1","status":403,"error":{"code":"forbidden","message":"caller lacks write permission on key 'user.1'","key":"user.1"}}`,
+		})
+		assertJSONFileContents(t, index.I, "user.1", map[string]interface{}{"n": float64(1)})
+	})
+
+	t.Run("transactions need every permission up front", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/_txn", strings.NewReader(`{"ops": [
+			{"op": "put", "key": "post.2", "value": {"n": 1}},
+			{"op": "exists", "key": "user.1"}
+		]}`))
+		req.Header.Set("Authorization", "Bearer k_edit")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusForbidden)
+		assertHTTPErr(t, rr, CodeForbidden, "user.1")
+		if _, ok := index.I.Lookup("post.2"); ok {
+			t.Errorf("forbidden transaction should not have written post.2")
+		}
+	})
+
+	t.Run("config documents need admin everywhere", func(t *testing.T) {
+		_ = index.I.Put(&index.File{FileName: index.WebhooksKey}, []byte(`{"targets": [{"url": "http://localhost", "secret": "s3cret"}]}`))
+		_ = index.I.Put(&index.File{FileName: "post.1"}, []byte(`{"hooks": "REF::_webhooks"}`))
+
+		requests := []struct {
+			path string
+			body string
+			want string
+		}{
+			{"/_bulk/put", `{"items": [{"key": "_webhooks", "value": {"targets": []}}]}`, "caller lacks admin permission on key '_webhooks'"},
+			{"/_txn", `{"ops": [{"op": "delete", "key": "_webhooks"}]}`, "caller lacks admin permission on key '_webhooks'"},
+			{"/_query", `{"filter": {}, "depth": 1}`, `{"count":2,"results":[{"key":"post.1","document":{"hooks":"REF::_webhooks"}}`},
+		}
+		for _, tc := range requests {
+			req, _ := http.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer k_ingest")
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+			assertHTTPContains(t, rr, []string{tc.want})
+			if strings.Contains(rr.Body.String(), "s3cret") {
+				t.Errorf("%s: got the webhook secret: %s", tc.path, rr.Body.String())
+			}
+		}
+		assertJSONFileContents(t, index.I, index.WebhooksKey, map[string]interface{}{
+			"targets": []interface{}{map[string]interface{}{"url": "http://localhost", "secret": "s3cret"}},
+		})
+	})
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// bulkItem is a single key in a bulk request. Depth is only used by get
+// and Value only by put
+type bulkItem struct {
+	Key   string          `json:"key"`
+	Depth *int            `json:"depth,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// bulkResult is the outcome of a single item of a bulk request
+type bulkResult struct {
+	Key      string      `json:"key"`
+	Status   int         `json:"status"`
+	Document interface{} `json:"document,omitempty"`
+	Error    *apiError   `json:"error,omitempty"`
+}
+
+// BulkGet returns a JSON of the documents of all keys in the request body.
+// Each item can set its own depth, which defaults to the depth param
+func BulkGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	items, ok := readBulkItems(w, r)
+	if !ok {
+		return
+	}
+	log.Info("bulk get %d keys", len(items))
+
+	maxDepth := getMaxDepthParam(r)
+	canRead := readable(r)
+	results := make([]bulkResult, len(items))
+	for n, item := range items {
+		if !allowed(r, PermRead, item.Key) {
+			results[n] = bulkResult{Key: item.Key, Status: http.StatusForbidden, Error: forbidden(PermRead, item.Key)}
+			continue
+		}
+		results[n] = bulkGetItem(item, maxDepth, canRead)
+	}
+	writeBulkResults(w, results)
+}
+
+func bulkGetItem(item bulkItem, maxDepth int, canRead index.ReadFilter) bulkResult {
+	res := bulkResult{Key: item.Key}
+
+	file, ok := index.I.Lookup(item.Key)
+	if !ok {
+		res.Status = http.StatusNotFound
+		res.Error = newAPIError(CodeNotFound, item.Key, "key '%s' not found", item.Key)
+		return res
+	}
+
+	jsonMap, err := file.ToMap()
+	if err != nil {
+		res.Status = http.StatusBadRequest
+		res.Error = newAPIError(CodeInvalidJSON, item.Key, "key '%s' cannot be parsed into json: %s", item.Key, err.Error())
+		return res
+	}
+
+	if item.Depth != nil {
+		maxDepth = *item.Depth
+	}
+	res.Status = http.StatusOK
+	res.Document = index.ResolveReferencesFor(jsonMap, maxDepth, canRead)
+	return res
+}
+
+// BulkPut creates or replaces the document of every key in the request body
+// with its value
+func BulkPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	items, ok := readBulkItems(w, r)
+	if !ok {
+		return
+	}
+	log.Info("bulk put %d keys", len(items))
+
+	results := make([]bulkResult, len(items))
+	for n, item := range items {
+		if !allowed(r, PermWrite, item.Key) {
+			results[n] = bulkResult{Key: item.Key, Status: http.StatusForbidden, Error: forbidden(PermWrite, item.Key)}
+			continue
+		}
+		results[n] = bulkPutItem(item)
+	}
+	writeBulkResults(w, results)
+}
+
+func bulkPutItem(item bulkItem) bulkResult {
+	res := bulkResult{Key: item.Key}
+	if err := index.ValidateKey(item.Key); err != nil {
+		res.Status, res.Error = errorFor(item.Key, err)
+		return res
+	}
+
+	// drop the formatting of the surrounding request
+	var value bytes.Buffer
+	if json.Compact(&value, item.Value) != nil || index.ParseDocument(item.Value) != nil {
+		res.Status = http.StatusBadRequest
+		res.Error = newAPIError(CodeInvalidJSON, item.Key, "item needs a key and a json object value")
+		return res
+	}
+
+	file, _ := index.I.Lookup(item.Key)
+	err := index.I.Put(file, value.Bytes())
+
+	if err != nil {
+		res.Status, res.Error = errorFor(item.Key, err)
+		return res
+	}
+
+	res.Status = http.StatusOK
+	return res
+}
+
+// BulkDelete deletes the documents of all keys in the request body
+func BulkDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	items, ok := readBulkItems(w, r)
+	if !ok {
+		return
+	}
+	log.Info("bulk delete %d keys", len(items))
+
+	results := make([]bulkResult, len(items))
+	for n, item := range items {
+		if !allowed(r, PermDelete, item.Key) {
+			results[n] = bulkResult{Key: item.Key, Status: http.StatusForbidden, Error: forbidden(PermDelete, item.Key)}
+			continue
+		}
+		results[n] = bulkDeleteItem(item)
+	}
+	writeBulkResults(w, results)
+}
+
+func bulkDeleteItem(item bulkItem) bulkResult {
+	res := bulkResult{Key: item.Key}
+	if err := index.ValidateKey(item.Key); err != nil {
+		res.Status, res.Error = errorFor(item.Key, err)
+		return res
+	}
+
+	file, ok := index.I.Lookup(item.Key)
+	if !ok {
+		res.Status = http.StatusNotFound
+		res.Error = newAPIError(CodeNotFound, item.Key, "key '%s' does not exist", item.Key)
+		return res
+	}
+
+	err := index.I.Delete(file)
+	if errors.Is(err, os.ErrNotExist) {
+		res.Status = http.StatusNotFound
+		res.Error = newAPIError(CodeNotFound, item.Key, "key '%s' does not exist", item.Key)
+		return res
+	}
+	if err != nil {
+		res.Status = http.StatusInternalServerError
+		res.Error = newAPIError(CodeInternal, item.Key, "err deleting key '%s': %s", item.Key, err.Error())
+		return res
+	}
+
+	res.Status = http.StatusOK
+	return res
+}
+
+// readBulkItems parses the items of a bulk request, writing a 400 if the body is invalid
+func readBulkItems(w http.ResponseWriter, r *http.Request) ([]bulkItem, bool) {
+	var body struct {
+		Items []bulkItem `json:"items"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidJSON, "", "bulk request cannot be parsed into json: %s", err.Error())
+		return nil, false
+	}
+	return body.Items, true
+}
+
+// writeBulkResults returns the per item results of a bulk request
+func writeBulkResults(w http.ResponseWriter, results []bulkResult) {
+	// create temporary struct with results
+	data := struct {
+		Results []bulkResult `json:"results"`
+	}{
+		Results: results,
+	}
+
+	// create json representation and return
+	w.Header().Set("Content-Type", "application/json")
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(w, "%+v", string(jsonData))
+}
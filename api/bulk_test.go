@@ -0,0 +1,137 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+func TestBulk(t *testing.T) {
+	router := httprouter.New()
+	router.POST("/_bulk/get", BulkGet)
+	router.POST("/_bulk/put", BulkPut)
+	router.POST("/_bulk/delete", BulkDelete)
+
+	setupDocs := func() {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("a", map[string]interface{}{"ref": "REF::b"})
+		_ = makeNewJSON("b", map[string]interface{}{"n": 1})
+		index.I.Regenerate()
+	}
+
+	t.Run("invalid json", func(t *testing.T) {
+		setupDocs()
+
+		for _, path := range []string{"/_bulk/get", "/_bulk/put", "/_bulk/delete"} {
+			req, _ := http.NewRequest("POST", path, strings.NewReader(`{"items": `))
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("bulk get with per key depth", func(t *testing.T) {
+		setupDocs()
+
+		body := strings.NewReader(`{"items": [{"key": "a"}, {"key": "a", "depth": 0}, {"key": "c"}]}`)
+		req, _ := http.NewRequest("POST", "/_bulk/get", body)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{
+			"results": []interface{}{
+				map[string]interface{}{
+					"key":      "a",
+					"status":   float64(200),
+					"document": map[string]interface{}{"ref": map[string]interface{}{"n": float64(1)}},
+				},
+				map[string]interface{}{
+					"key":      "a",
+					"status":   float64(200),
+					"document": map[string]interface{}{"ref": "REF::b"},
+				},
+				map[string]interface{}{
+					"key":    "c",
+					"status": float64(404),
+					"error":  map[string]interface{}{"code": "not_found", "key": "c", "message": "key 'c' not found"},
+				},
+			},
+		})
+	})
+
+	t.Run("bulk put", func(t *testing.T) {
+		setupDocs()
+
+		body := strings.NewReader(`{"items": [{"key": "b", "value": {"n": 2}}, {"key": "c", "value": {"n": 3}}, {"key": "d"}]}`)
+		req, _ := http.NewRequest("POST", "/_bulk/put", body)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{
+			"results": []interface{}{
+				map[string]interface{}{"key": "b", "status": float64(200)},
+				map[string]interface{}{"key": "c", "status": float64(200)},
+				map[string]interface{}{"key": "d", "status": float64(400), "error": map[string]interface{}{"code": "invalid_json", "key": "d", "message": "item needs a key and a json object value"}},
+			},
+		})
+		assertRawFileContents(t, index.I, "b", []byte(`{"n":2}`))
+		assertJSONFileContents(t, index.I, "c", map[string]interface{}{"n": float64(3)})
+		if _, ok := index.I.Lookup("d"); ok {
+			t.Errorf("found key d in index when shouldn't have")
+		}
+	})
+
+	t.Run("bulk delete", func(t *testing.T) {
+		setupDocs()
+
+		body := strings.NewReader(`{"items": [{"key": "a"}, {"key": "c"}]}`)
+		req, _ := http.NewRequest("POST", "/_bulk/delete", body)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{
+			"results": []interface{}{
+				map[string]interface{}{"key": "a", "status": float64(200)},
+				map[string]interface{}{"key": "c", "status": float64(404), "error": map[string]interface{}{"code": "not_found", "key": "c", "message": "key 'c' does not exist"}},
+			},
+		})
+		if _, ok := index.I.Lookup("a"); ok {
+			t.Errorf("found key a in index when shouldn't have")
+		}
+	})
+
+	t.Run("keys outside the data directory are rejected", func(t *testing.T) {
+		setupDocs()
+		_ = af.WriteFile(index.I.FileSystem, "../outside.json", []byte(`{}`), 0644)
+
+		for _, path := range []string{"/_bulk/put", "/_bulk/delete"} {
+			body := strings.NewReader(`{"items": [{"key": "../escaped", "value": {"a": 1}}, {"key": "../outside"}, {"key": ".history", "value": {}}, {"key": ""}]}`)
+			req, _ := http.NewRequest("POST", path, body)
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, http.StatusOK)
+			if n := strings.Count(rr.Body.String(), `"status":400,"error":{"code":"invalid_request"`); n != 4 {
+				t.Errorf("%s: got %d rejected keys, wanted 4: %s", path, n, rr.Body.String())
+			}
+		}
+
+		if ok, _ := af.Exists(index.I.FileSystem, "../escaped.json"); ok {
+			t.Errorf("bulk put wrote outside the data directory")
+		}
+		if ok, _ := af.Exists(index.I.FileSystem, "../outside.json"); !ok {
+			t.Errorf("bulk delete removed a file outside the data directory")
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// how often a comment is sent on idle streams so proxies don't close them
+const keepAliveInterval = 15 * time.Second
+
+// Changes streams every create, update and delete as server-sent events.
+// Streams resume after the sequence number in ?since= or Last-Event-ID
+func Changes(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Info("streaming changes")
+	streamChanges(w, r, "")
+}
+
+// WatchKey streams every change to a single key as server-sent events
+func WatchKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	log.Info("watching key '%s'", key)
+	streamChanges(w, r, key)
+}
+
+// streamChanges writes changes to key, or every key if empty, as they
+// happen until the client goes away
+func streamChanges(w http.ResponseWriter, r *http.Request, key string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, key, "streaming is not supported")
+		return
+	}
+
+	since, resume, err := getSinceParam(r)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, key, "invalid since: %s", err.Error())
+		return
+	}
+
+	var sub *index.Subscription
+	backlog := []index.Change{}
+	if resume {
+		sub, backlog, err = index.I.SubscribeSince(since)
+		if err != nil {
+			writeErr(w, http.StatusGone, CodeInvalidRequest, key, "%s", err.Error())
+			return
+		}
+	} else {
+		sub = index.I.Subscribe()
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, c := range backlog {
+		writeChange(w, r, c, key)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case c, ok := <-sub.C:
+			if !ok {
+				// fell too far behind, the client reconnects with Last-Event-ID
+				return
+			}
+			writeChange(w, r, c, key)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// writeChange writes c as a server-sent event if it is to key, or key is
+// empty, and the caller of r may read it
+func writeChange(w http.ResponseWriter, r *http.Request, c index.Change, key string) {
+	if (key != "" && c.Key != key) || !allowed(r, PermRead, c.Key) {
+		return
+	}
+
+	jsonData, _ := json.Marshal(c)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Type, jsonData)
+}
+
+// getSinceParam returns the sequence number to resume after from ?since= or
+// the Last-Event-ID header, and whether one was given
+func getSinceParam(r *http.Request) (uint64, bool, error) {
+	param := r.URL.Query().Get("since")
+	if param == "" {
+		param = r.Header.Get("Last-Event-ID")
+	}
+	if param == "" {
+		return 0, false, nil
+	}
+
+	since, err := strconv.ParseUint(param, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("'%s' is not a sequence number", param)
+	}
+	return since, true, nil
+}
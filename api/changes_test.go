@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+// readEvent returns the next server-sent event from r with its fields joined by newlines
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("err reading event: %s", err.Error())
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && len(lines) > 0 {
+			return strings.Join(lines, "\n")
+		}
+		if line != "" && !strings.HasPrefix(line, ":") {
+			lines = append(lines, line)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/_changes", Changes)
+	watchRouter := httprouter.New()
+	watchRouter.GET("/:key/:field", GetKeyField)
+
+	shared := index.I
+	defer func() { index.I = shared }()
+
+	setupChanges := func() {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+		index.I.Regenerate()
+	}
+
+	t.Run("resume from since", func(t *testing.T) {
+		setupChanges()
+		_ = index.I.Put(&index.File{FileName: "a"}, []byte(`{"n":1}`))
+		_ = index.I.Put(&index.File{FileName: "a"}, []byte(`{"n":2}`))
+		_ = index.I.Delete(&index.File{FileName: "a"})
+
+		// already cancelled so only the backlog is written
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req, _ := http.NewRequest("GET", "/_changes?since=1", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req.WithContext(ctx))
+		assertHTTPStatus(t, rr, http.StatusOK)
+		if got := rr.Header().Get("Content-Type"); got != "text/event-stream" {
+			t.Errorf("wrong content type: %s", got)
+		}
+
+		events := strings.Split(strings.TrimSpace(rr.Body.String()), "\n\n")
+		if len(events) != 2 {
+			t.Fatalf("got %d events, wanted 2: %s", len(events), rr.Body.String())
+		}
+		assertHTTPContains(t, rr, []string{
+			"id: 2\nevent: update\ndata: {\"seq\":2,\"type\":\"update\",\"key\":\"a\"",
+			"\"document\":{\"n\":2}}",
+			"id: 3\nevent: delete\ndata: {\"seq\":3,\"type\":\"delete\",\"key\":\"a\"",
+		})
+	})
+
+	t.Run("resume from last event id", func(t *testing.T) {
+		setupChanges()
+		_ = index.I.Put(&index.File{FileName: "a"}, []byte(`{"n":1}`))
+		_ = index.I.Put(&index.File{FileName: "b"}, []byte(`{"n":1}`))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req, _ := http.NewRequest("GET", "/_changes", nil)
+		req.Header.Set("Last-Event-ID", "1")
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req.WithContext(ctx))
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPContains(t, rr, []string{"id: 2\nevent: create"})
+		if strings.Contains(rr.Body.String(), "id: 1\n") {
+			t.Errorf("change 1 was sent again: %s", rr.Body.String())
+		}
+	})
+
+	t.Run("invalid and expired since", func(t *testing.T) {
+		setupChanges()
+
+		for since, status := range map[string]int{"abc": http.StatusBadRequest, "5": http.StatusGone} {
+			req, _ := http.NewRequest("GET", "/_changes?since="+since, nil)
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, status)
+		}
+	})
+
+	t.Run("live changes of a watched key", func(t *testing.T) {
+		setupChanges()
+		server := httptest.NewServer(watchRouter)
+		defer server.Close()
+
+		res, err := http.Get(server.URL + "/a/_watch")
+		if err != nil {
+			t.Fatalf("err watching key: %s", err.Error())
+		}
+		defer res.Body.Close()
+
+		_ = index.I.Put(&index.File{FileName: "b"}, []byte(`{"n":1}`))
+		_ = index.I.Put(&index.File{FileName: "a"}, []byte(`{"n":1}`))
+
+		event := readEvent(t, bufio.NewReader(res.Body))
+		if !strings.HasPrefix(event, "id: 2\nevent: create\ndata: {\"seq\":2,\"type\":\"create\",\"key\":\"a\"") {
+			t.Errorf("wrong event: %s", event)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// error codes returned in the error envelope
+const (
+	CodeNotFound           = "not_found"
+	CodeInvalidJSON        = "invalid_json"
+	CodeInvalidRequest     = "invalid_request"
+	CodePreconditionFailed = "precondition_failed"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeInternal           = "internal"
+)
+
+// apiError is returned as {"error": {...}} by every failed request
+type apiError struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Key     string   `json:"key,omitempty"`
+	Details []string `json:"details,omitempty"`
+}
+
+// newAPIError creates an apiError with a formatted message
+func newAPIError(code string, key string, format string, args ...interface{}) *apiError {
+	return &apiError{Code: code, Key: key, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeErr logs and writes an error envelope with the given status
+func writeErr(w http.ResponseWriter, status int, code string, key string, format string, args ...interface{}) {
+	writeAPIError(w, status, newAPIError(code, key, format, args...))
+}
+
+// writeAPIError logs and writes e as an error envelope with the given status
+func writeAPIError(w http.ResponseWriter, status int, e *apiError) {
+	log.Warn("%s", e.Message)
+
+	// create json representation and return
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	jsonData, _ := json.Marshal(struct {
+		Error *apiError `json:"error"`
+	}{
+		Error: e,
+	})
+	fmt.Fprintf(w, "%+v", string(jsonData))
+}
+
+// errorFor returns the status and error envelope matching err returned by
+// the index for a request on key
+func errorFor(key string, err error) (int, *apiError) {
+	var validationErr *index.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		e := newAPIError(CodeValidationFailed, validationErr.Key, "key '%s' failed validation", validationErr.Key)
+		e.Details = validationErr.Errors
+		return http.StatusUnprocessableEntity, e
+	case errors.Is(err, errNotOwner):
+		return http.StatusForbidden, newAPIError(CodeForbidden, key, "key '%s' is not owned by the caller", key)
+	case errors.Is(err, index.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed, newAPIError(CodePreconditionFailed, key, "precondition failed for key '%s'", key)
+	case errors.Is(err, index.ErrInvalidTxn), errors.Is(err, index.ErrInvalidKey), errors.Is(err, index.ErrInvalidPath), errors.Is(err, index.ErrInvalidPatch):
+		return http.StatusBadRequest, newAPIError(CodeInvalidRequest, key, "%s", err.Error())
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, index.ErrFieldNotFound):
+		return http.StatusNotFound, newAPIError(CodeNotFound, key, "%s", err.Error())
+	}
+	return http.StatusInternalServerError, newAPIError(CodeInternal, key, "%s", err.Error())
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// GetByField returns a JSON of all keys whose indexed field has the given value,
+// 404 if the field isn't indexed
+func GetByField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	field := ps.ByName("field")
+	value := ps.ByName("value")
+	log.Info("get keys with field '%s' equal to '%s'", field, value)
+
+	keys, ok := index.I.FindByField(field, value)
+	if !ok {
+		writeErr(w, http.StatusNotFound, CodeNotFound, "", "field '%s' is not indexed", field)
+		return
+	}
+
+	// create temporary struct with matching keys
+	data := struct {
+		Field string   `json:"field"`
+		Value string   `json:"value"`
+		Keys  []string `json:"keys"`
+	}{
+		Field: field,
+		Value: value,
+		Keys:  keys,
+	}
+
+	// create json representation and return
+	w.Header().Set("Content-Type", "application/json")
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(w, "%+v", string(jsonData))
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+func TestGetByField(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/_by/:field/:value", GetByField)
+
+	t.Run("get by unindexed field", func(t *testing.T) {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		req, _ := http.NewRequest("GET", "/_by/email/a@b.c", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusNotFound)
+	})
+
+	t.Run("get by indexed nested field", func(t *testing.T) {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("alice", map[string]interface{}{
+			"profile": map[string]interface{}{"country": "CA"},
+		})
+		_ = makeNewJSON("bob", map[string]interface{}{
+			"profile": map[string]interface{}{"country": "US"},
+		})
+		index.I.Regenerate()
+		index.I.AddFieldIndex("profile.country")
+
+		req, _ := http.NewRequest("GET", "/_by/profile.country/CA", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{
+			"field": "profile.country",
+			"value": "CA",
+			"keys":  []interface{}{"alice"},
+		})
+	})
+}
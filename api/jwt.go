@@ -0,0 +1,200 @@
+package api
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// signing algorithms tokens can be verified with
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+// JWT verifies the json web tokens requests can authenticate with instead
+// of an api key. Tokens are not accepted while it is nil
+var JWT *JWTVerifier
+
+// reasons a token is rejected
+var (
+	errMalformedToken = errors.New("token is not a json web token")
+	errUnsupportedAlg = errors.New("token is signed with an unsupported algorithm")
+	errBadSignature   = errors.New("token signature is invalid")
+	errTokenExpired   = errors.New("token has expired")
+	errTokenNotYet    = errors.New("token is not valid yet")
+)
+
+// JWTVerifier checks the signature and lifetime of tokens signed with an
+// HS256 secret, an RS256 key pair, or both
+type JWTVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// LoadJWTVerifier reads the HS256 secret and the PEM encoded RS256 public key
+// at the given paths. Either path can be empty to not accept that algorithm
+func LoadJWTVerifier(secretFile string, publicKeyFile string) (*JWTVerifier, error) {
+	var secret, publicKey []byte
+	var err error
+
+	if secretFile != "" {
+		if secret, err = ioutil.ReadFile(secretFile); err != nil {
+			return nil, err
+		}
+	}
+	if publicKeyFile != "" {
+		if publicKey, err = ioutil.ReadFile(publicKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return NewJWTVerifier(secret, publicKey)
+}
+
+// NewJWTVerifier creates a verifier from an HS256 secret and a PEM encoded
+// RS256 public key, either of which can be empty
+func NewJWTVerifier(secret []byte, publicKeyPEM []byte) (*JWTVerifier, error) {
+	v := &JWTVerifier{now: time.Now}
+
+	// secret files usually end in a newline
+	v.secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) > 0 && len(v.secret) == 0 {
+		return nil, fmt.Errorf("jwt secret is empty")
+	}
+
+	if len(publicKeyPEM) > 0 {
+		key, err := parseRSAPublicKey(publicKeyPEM)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKey = key
+	}
+
+	if len(v.secret) == 0 && v.publicKey == nil {
+		return nil, fmt.Errorf("jwt verifier needs a secret or a public key")
+	}
+	return v, nil
+}
+
+// parseRSAPublicKey parses a PKIX or PKCS #1 PEM encoded rsa public key
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt public key is not PEM encoded")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("jwt public key cannot be parsed: %s", err.Error())
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("jwt public key is not an rsa key")
+	}
+	return rsaKey, nil
+}
+
+// isJWT returns whether token looks like a json web token rather than an api key
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the signature, expiry and not before time of token and
+// returns its claims
+func (v *JWTVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errMalformedToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	// only the algorithm a key was configured for is accepted with it, so
+	// a public key can never be used as an hmac secret
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == AlgHS256 && len(v.secret) > 0:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errBadSignature
+		}
+	case header.Alg == AlgRS256 && v.publicKey != nil:
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errBadSignature
+		}
+	default:
+		return nil, errUnsupportedAlg
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil || claims == nil {
+		return nil, errMalformedToken
+	}
+
+	exp, hasExp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, errMalformedToken
+	}
+	nbf, hasNbf, ok := numericClaim(claims, "nbf")
+	if !ok {
+		return nil, errMalformedToken
+	}
+
+	now := float64(v.now().Unix())
+	if hasExp && now >= exp {
+		return nil, errTokenExpired
+	}
+	if hasNbf && now < nbf {
+		return nil, errTokenNotYet
+	}
+	return claims, nil
+}
+
+// numericClaim returns the time claim name and whether it is set. A claim
+// that is set to anything other than a number is not ok
+func numericClaim(claims map[string]interface{}, name string) (value float64, present bool, ok bool) {
+	raw, present := claims[name]
+	if !present {
+		return 0, false, true
+	}
+	value, ok = raw.(float64)
+	return value, true, ok
+}
+
+// decodeSegment decodes a base64url encoded json segment of a token into v
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
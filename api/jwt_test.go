@@ -0,0 +1,139 @@
+package api
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "s3cret"
+
+// testRSAKey is generated once as it is slow
+var testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+// signToken returns a token with claims signed with alg, using testJWTSecret
+// for HS256 and testRSAKey for RS256
+func signToken(t *testing.T, alg string, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, []byte(testJWTSecret))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case AlgRS256:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, testRSAKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("err signing token: %s", err.Error())
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// testPublicKeyPEM returns the PKIX PEM encoding of the public half of testRSAKey
+func testPublicKeyPEM(t *testing.T) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(&testRSAKey.PublicKey)
+	if err != nil {
+		t.Fatalf("err encoding public key: %s", err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestNewJWTVerifier(t *testing.T) {
+	if _, err := NewJWTVerifier(nil, nil); err == nil {
+		t.Errorf("verifier without keys should fail")
+	}
+	if _, err := NewJWTVerifier([]byte("\n"), nil); err == nil {
+		t.Errorf("verifier with an empty secret should fail")
+	}
+	if _, err := NewJWTVerifier(nil, []byte("not a key")); err == nil {
+		t.Errorf("verifier with an invalid public key should fail")
+	}
+
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&testRSAKey.PublicKey)})
+	if _, err := NewJWTVerifier(nil, pkcs1); err != nil {
+		t.Errorf("got err %s parsing a PKCS #1 public key", err.Error())
+	}
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	both, err := NewJWTVerifier([]byte(testJWTSecret+"\n"), testPublicKeyPEM(t))
+	if err != nil {
+		t.Fatalf("err creating verifier: %s", err.Error())
+	}
+	onlyRS256, _ := NewJWTVerifier(nil, testPublicKeyPEM(t))
+
+	now := time.Unix(1600000000, 0)
+	both.now = func() time.Time { return now }
+	onlyRS256.now = both.now
+
+	valid := map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix()}
+	hs256 := signToken(t, AlgHS256, valid)
+	rs256 := signToken(t, AlgRS256, valid)
+
+	// the payload of a token for bob with the signature of the one for alice
+	parts := strings.Split(hs256, ".")
+	bob := strings.Split(signToken(t, AlgHS256, map[string]interface{}{"sub": "bob"}), ".")
+	tampered := parts[0] + "." + bob[1] + "." + parts[2]
+
+	tt := []struct {
+		name     string
+		verifier *JWTVerifier
+		token    string
+		err      error
+	}{
+		{"HS256", both, hs256, nil},
+		{"RS256", both, rs256, nil},
+		{"tampered payload", both, tampered, errBadSignature},
+		{"wrong signature", both, hs256[:len(hs256)-4] + "AAAA", errBadSignature},
+		{"not a jwt", both, "k_read", errMalformedToken},
+		{"HS256 without a secret", onlyRS256, hs256, errUnsupportedAlg},
+		{"unsigned", both, "eyJhbGciOiJub25lIn0.eyJzdWIiOiJhbGljZSJ9.", errUnsupportedAlg},
+		{"expired", both, signToken(t, AlgHS256, map[string]interface{}{"sub": "alice", "exp": now.Unix()}), errTokenExpired},
+		{"not valid yet", both, signToken(t, AlgRS256, map[string]interface{}{"sub": "alice", "nbf": now.Add(time.Minute).Unix()}), errTokenNotYet},
+		{"exp not a number", both, signToken(t, AlgHS256, map[string]interface{}{"sub": "alice", "exp": fmt.Sprint(now.Unix())}), errMalformedToken},
+		{"nbf not a number", both, signToken(t, AlgHS256, map[string]interface{}{"sub": "alice", "nbf": nil}), errMalformedToken},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := tc.verifier.Verify(tc.token)
+			if err != tc.err {
+				t.Fatalf("got err %v, wanted %v", err, tc.err)
+			}
+			if err == nil && claims["sub"] != "alice" {
+				t.Errorf("got claims %+v, wanted a sub of alice", claims)
+			}
+		})
+	}
+
+	t.Run("public key can't be used as an HS256 secret", func(t *testing.T) {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256"}`))
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`))
+		mac := hmac.New(sha256.New, testPublicKeyPEM(t))
+		mac.Write([]byte(header + "." + payload))
+		forged := header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+		if _, err := onlyRS256.Verify(forged); err != errUnsupportedAlg {
+			t.Errorf("got err %v, wanted %v", err, errUnsupportedAlg)
+		}
+	})
+}
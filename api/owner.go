@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"reflect"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Rules decide which documents callers authenticated with a token may use
+var Rules []OwnerRule
+
+// errNotOwner is returned when writing a document the caller doesn't own
+var errNotOwner = errors.New("document is not owned by the caller")
+
+// OwnerRule lets token holders use the documents matching Pattern whose
+// Field equals the Claim of their token, e.g.
+//
+//	{"pattern": "note.*", "field": "owner", "claim": "sub", "permissions": ["read", "write", "delete"]}
+//
+// lets a token with a sub of alice read, write and delete every note with an
+// owner of alice, and create notes as long as their owner is alice
+type OwnerRule struct {
+	Pattern     string   `json:"pattern"`
+	Field       string   `json:"field"`
+	Claim       string   `json:"claim"`
+	Permissions []string `json:"permissions"`
+}
+
+// owner is the value the owner field of a document must hold
+type owner struct {
+	path  []string
+	value interface{}
+}
+
+// ownerContextKey is the request context key of the owner a document must have
+type ownerContextKey struct{}
+
+// LoadRules reads the owner rules file at path
+func LoadRules(path string) ([]OwnerRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(data)
+}
+
+// ParseRules parses and checks an owner rules file of the form {"rules": [...]}
+func ParseRules(data []byte) ([]OwnerRule, error) {
+	var body struct {
+		Rules []OwnerRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("rules file cannot be parsed into json: %s", err.Error())
+	}
+
+	for n, rule := range body.Rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return nil, fmt.Errorf("rule %d has invalid pattern '%s'", n, rule.Pattern)
+		}
+		if rule.Field == "" || rule.Claim == "" {
+			return nil, fmt.Errorf("rule %d needs a field and a claim", n)
+		}
+		for _, perm := range rule.Permissions {
+			if perm != PermRead && perm != PermWrite && perm != PermDelete {
+				return nil, fmt.Errorf("rule %d has unknown permission '%s', must be read, write or delete", n, perm)
+			}
+		}
+	}
+	return body.Rules, nil
+}
+
+// ownerFor returns the owner documents must have for the holder of claims
+// to perm key, using the first rule matching key that grants perm. Config
+// documents need admin, which tokens are never granted
+func (a *authState) ownerFor(claims map[string]interface{}, perm string, key string) (*owner, bool) {
+	if index.IsReservedKey(key) {
+		return nil, false
+	}
+
+	for _, rule := range a.rules {
+		if matched, _ := path.Match(rule.Pattern, key); !matched {
+			continue
+		}
+
+		for _, p := range rule.Permissions {
+			value, ok := claims[rule.Claim]
+			if p == perm && ok && value != nil {
+				return &owner{path: index.ParseFieldPath(rule.Field), value: value}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// RequireOwner wraps handle like Require, except that callers with a token
+// are let through if an owner rule grants them perm on the key in the path.
+// handle must then only use documents owned by the caller, see ownerOf
+func RequireOwner(perm string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		c := callerOf(r)
+		if c == nil || c.claims == nil {
+			Require(perm, handle)(w, r, ps)
+			return
+		}
+
+		key := ps.ByName("key")
+		o, ok := authOf(r).ownerFor(c.claims, perm, key)
+		if !ok {
+			writeForbidden(w, perm, key)
+			return
+		}
+		handle(w, r.WithContext(context.WithValue(r.Context(), ownerContextKey{}, o)), ps)
+	}
+}
+
+// ownerOf returns the owner documents used by r must have, nil if any document can be used
+func ownerOf(r *http.Request) *owner {
+	o, _ := r.Context().Value(ownerContextKey{}).(*owner)
+	return o
+}
+
+// owns returns whether doc has the owner
+func (o *owner) owns(doc interface{}) bool {
+	value, ok := index.GetPath(doc, o.path)
+	return ok && reflect.DeepEqual(value, o.value)
+}
+
+// keeps returns whether setting the field at path to value leaves a
+// document with the owner
+func (o *owner) keeps(field string, value interface{}) bool {
+	segments := index.ParseFieldPath(field)
+	if len(segments) > len(o.path) || !reflect.DeepEqual(segments, o.path[:len(segments)]) {
+		// the owner field isn't touched
+		return true
+	}
+
+	// the owner field is value or inside of it
+	inner := &owner{path: o.path[len(segments):], value: o.value}
+	return inner.owns(value)
+}
+
+// precondition only allows writes to documents that don't exist yet or have the owner
+func (o *owner) precondition() index.Precondition {
+	return func(content []byte, exists bool) error {
+		if !exists {
+			return nil
+		}
+
+		var doc interface{}
+		if json.Unmarshal(content, &doc) != nil || !o.owns(doc) {
+			return errNotOwner
+		}
+		return nil
+	}
+}
+
+// writeNotOwner writes a 403 for a request on a document the caller doesn't own
+func writeNotOwner(w http.ResponseWriter, key string) {
+	writeErr(w, http.StatusForbidden, CodeForbidden, key, "key '%s' is not owned by the caller", key)
+}
+
+// readable returns the filter of the references the caller of r may have
+// resolved. Api keys need read on the referenced key, and tokens need an
+// owner rule granting read on it along with owning the referenced document
+func readable(r *http.Request) index.ReadFilter {
+	a := authOf(r)
+	if !a.enabled() {
+		return nil
+	}
+
+	c := callerOf(r)
+	return func(key string, doc map[string]interface{}) bool {
+		if c == nil {
+			return false
+		}
+		if c.claims == nil {
+			return allowed(r, PermRead, key)
+		}
+
+		o, ok := a.ownerFor(c.claims, PermRead, key)
+		return ok && doc != nil && o.owns(doc)
+	}
+}
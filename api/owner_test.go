@@ -0,0 +1,211 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+const testRules = `{"rules": [
+	{"pattern": "note.*", "field": "meta.owner", "claim": "sub", "permissions": ["read", "write", "delete"]},
+	{"pattern": "post.*", "field": "author", "claim": "sub", "permissions": ["read"]}
+]}`
+
+// useRules turns on token authentication with testRules until the returned function is called
+func useRules(t *testing.T) func() {
+	t.Helper()
+
+	rules, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatalf("err parsing rules: %s", err.Error())
+	}
+	JWT, _ = NewJWTVerifier([]byte(testJWTSecret), nil)
+	Rules = rules
+	return func() {
+		JWT = nil
+		Rules = nil
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	tt := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{"not json", `rules`, "rules file cannot be parsed into json"},
+		{"invalid pattern", `{"rules": [{"pattern": "[", "field": "owner", "claim": "sub"}]}`, "rule 0 has invalid pattern '['"},
+		{"no field", `{"rules": [{"pattern": "*", "claim": "sub"}]}`, "rule 0 needs a field and a claim"},
+		{"unknown permission", `{"rules": [{"pattern": "*", "field": "owner", "claim": "sub", "permissions": ["admin"]}]}`, "rule 0 has unknown permission 'admin'"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseRules([]byte(tc.rules))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got err %v, wanted %s", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestOwner_keeps(t *testing.T) {
+	o := &owner{path: []string{"meta", "owner"}, value: "alice"}
+
+	tt := []struct {
+		field string
+		value interface{}
+		keeps bool
+	}{
+		{"title", "hello", true},
+		{"meta.tags", []interface{}{"a"}, true},
+		{"meta.owner", "alice", true},
+		{"meta.owner", "bob", false},
+		{"meta", map[string]interface{}{"owner": "alice", "tags": nil}, true},
+		{"meta", map[string]interface{}{"tags": nil}, false},
+		{"~1meta~1owner", "bob", false},
+	}
+
+	for _, tc := range tt {
+		if got := o.keeps(tc.field, tc.value); got != tc.keeps {
+			t.Errorf("setting %s to %v: got %t, wanted %t", tc.field, tc.value, got, tc.keeps)
+		}
+	}
+}
+
+func TestRequireOwner(t *testing.T) {
+	shared := index.I
+	defer func() { index.I = shared }()
+	defer useRules(t)()
+	defer useKeys(t)()
+
+	router := httprouter.New()
+	router.GET("/:key", RequireOwner(PermRead, GetKey))
+	router.PUT("/:key", RequireOwner(PermWrite, UpdateKey))
+	router.DELETE("/:key", RequireOwner(PermDelete, DeleteKey))
+	router.PATCH("/:key/:field", RequireOwner(PermWrite, PatchKeyField))
+	router.DELETE("/:key/:field", Require(PermWrite, DeleteKeyField))
+	handler := Authenticate(router)
+
+	alice := "Bearer " + signToken(t, AlgHS256, map[string]interface{}{"sub": "alice"})
+	setupOwner := func() {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+		index.I.Regenerate()
+		_ = index.I.Put(&index.File{FileName: "note.a"}, []byte(`{"meta":{"owner":"alice"},"text":"a"}`))
+		_ = index.I.Put(&index.File{FileName: "note.b"}, []byte(`{"meta":{"owner":"bob"},"text":"b"}`))
+		_ = index.I.Put(&index.File{FileName: "post.b"}, []byte(`{"author":"bob"}`))
+	}
+
+	tt := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		auth   string
+		status int
+		code   string
+	}{
+		{"read own", "GET", "/note.a", "", alice, http.StatusOK, ""},
+		{"read someone else's", "GET", "/note.b", "", alice, http.StatusForbidden, CodeForbidden},
+		{"permission not in rule", "PUT", "/post.a", `{"author":"alice"}`, alice, http.StatusForbidden, CodeForbidden},
+		{"no rule for key", "GET", "/user.alice", "", alice, http.StatusForbidden, CodeForbidden},
+		{"route without owner rules", "DELETE", "/note.a/text", "", alice, http.StatusForbidden, CodeForbidden},
+		{"create own", "PUT", "/note.c", `{"meta":{"owner":"alice"}}`, alice, http.StatusOK, ""},
+		{"create for someone else", "PUT", "/note.c", `{"meta":{"owner":"bob"}}`, alice, http.StatusForbidden, CodeForbidden},
+		{"overwrite someone else's", "PUT", "/note.b", `{"meta":{"owner":"alice"}}`, alice, http.StatusForbidden, CodeForbidden},
+		{"patch own", "PATCH", "/note.a/text", `"edited"`, alice, http.StatusOK, ""},
+		{"give away own", "PATCH", "/note.a/meta.owner", `"bob"`, alice, http.StatusForbidden, CodeForbidden},
+		{"patch someone else's", "PATCH", "/note.b/text", `"edited"`, alice, http.StatusForbidden, CodeForbidden},
+		{"delete own", "DELETE", "/note.a", "", alice, http.StatusOK, ""},
+		{"delete someone else's", "DELETE", "/note.b", "", alice, http.StatusForbidden, CodeForbidden},
+		{"expired token", "GET", "/note.a", "", "Bearer " + signToken(t, AlgHS256, map[string]interface{}{"sub": "alice", "exp": 1}), http.StatusUnauthorized, CodeUnauthorized},
+		{"token without the claim", "GET", "/note.a", "", "Bearer " + signToken(t, AlgHS256, map[string]interface{}{}), http.StatusForbidden, CodeForbidden},
+		{"api keys ignore owner rules", "GET", "/post.b", "", "Bearer k_read", http.StatusOK, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			setupOwner()
+			req, _ := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", tc.auth)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, tc.status)
+			if tc.code != "" {
+				key := strings.SplitN(strings.TrimPrefix(tc.path, "/"), "/", 2)[0]
+				if tc.code == CodeUnauthorized {
+					key = ""
+				}
+				assertHTTPErr(t, rr, tc.code, key)
+			}
+		})
+	}
+
+	t.Run("rejected writes change nothing", func(t *testing.T) {
+		setupOwner()
+		for _, path := range []string{"/note.b", "/note.b/text"} {
+			method := "PUT"
+			if strings.Count(path, "/") == 2 {
+				method = "PATCH"
+			}
+			req, _ := http.NewRequest(method, path, strings.NewReader(`{"meta":{"owner":"alice"}}`))
+			req.Header.Set("Authorization", alice)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		assertJSONFileContents(t, index.I, "note.b", map[string]interface{}{
+			"meta": map[string]interface{}{"owner": "bob"},
+			"text": "b",
+		})
+	})
+}
+
+func TestGetKey_referencesCallerCanRead(t *testing.T) {
+	shared := index.I
+	defer func() { index.I = shared }()
+	defer useRules(t)()
+	defer useKeys(t)()
+
+	index.I = index.NewFileIndex(".")
+	index.I.SetFileSystem(af.NewMemMapFs())
+	index.I.Regenerate()
+	_ = index.I.Put(&index.File{FileName: "post.a"}, []byte(`{"author":"alice","note":"REF::note.a","user":"REF::user.alice"}`))
+	_ = index.I.Put(&index.File{FileName: "note.a"}, []byte(`{"meta":{"owner":"alice"},"text":"a","ref":"REF::note.b"}`))
+	_ = index.I.Put(&index.File{FileName: "note.b"}, []byte(`{"meta":{"owner":"bob"},"text":"b"}`))
+	_ = index.I.Put(&index.File{FileName: "user.alice"}, []byte(`{"name":"alice"}`))
+
+	router := httprouter.New()
+	router.GET("/:key", RequireOwner(PermRead, GetKey))
+	handler := Authenticate(router)
+
+	tt := []struct {
+		name string
+		auth string
+		want string
+	}{
+		{"api keys resolve keys they can read", "Bearer k_read", `{"author":"alice","note":"REF::note.a","user":"REF::user.alice"}`},
+		{"api keys with a * grant resolve every key", "Bearer k_ops", `{"author":"alice","note":{"meta":{"owner":"alice"},"ref":{"meta":{"owner":"bob"},"text":"b"},"text":"a"},"user":{"name":"alice"}}`},
+		{"tokens resolve documents they own", "Bearer " + signToken(t, AlgHS256, map[string]interface{}{"sub": "alice"}), `{"author":"alice","note":{"meta":{"owner":"alice"},"ref":"REF::note.b","text":"a"},"user":"REF::user.alice"}`},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/post.a?depth=2", nil)
+			req.Header.Set("Authorization", tc.auth)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, http.StatusOK)
+			var want map[string]interface{}
+			_ = json.Unmarshal([]byte(tc.want), &want)
+			assertHTTPBody(t, rr, want)
+		})
+	}
+}
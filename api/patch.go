@@ -0,0 +1,58 @@
+package api
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// content types of the patch formats accepted by PatchKey
+const (
+	ContentTypeJSONPatch  = "application/json-patch+json"
+	ContentTypeMergePatch = "application/merge-patch+json"
+)
+
+// PatchKey applies a json patch or json merge patch to the document of a
+// key, depending on the Content-Type of the request
+func PatchKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	log.Info("patch key '%s' with %s", key, contentType)
+
+	if contentType != ContentTypeJSONPatch && contentType != ContentTypeMergePatch {
+		writeErr(w, http.StatusUnsupportedMediaType, CodeInvalidRequest, key, "patch must have a Content-Type of %s or %s", ContentTypeJSONPatch, ContentTypeMergePatch)
+		return
+	}
+
+	// get bytes from request body
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, key, "err reading body with key '%s': %s", key, err.Error())
+		return
+	}
+
+	file, ok := index.I.Lookup(key)
+	if !ok {
+		writeErr(w, http.StatusNotFound, CodeNotFound, key, "key '%s' not found", key)
+		return
+	}
+
+	// the whole patch is applied under the document's write lock
+	var etag string
+	if contentType == ContentTypeJSONPatch {
+		etag, err = index.I.JSONPatch(file, bodyBytes, getPreconditions(r)...)
+	} else {
+		etag, err = index.I.MergePatch(file, bodyBytes, getPreconditions(r)...)
+	}
+	if err != nil {
+		writeWriteErr(w, key, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+
+	log.WInfo(w, "patch '%s' successful", key)
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+func TestPatchKey(t *testing.T) {
+	router := httprouter.New()
+	router.PATCH("/:key", PatchKey)
+
+	original := map[string]interface{}{
+		"name":  "alice",
+		"count": float64(1),
+		"tags":  []interface{}{"a"},
+	}
+
+	tt := []struct {
+		name        string
+		key         string
+		contentType string
+		body        string
+		status      int
+		want        map[string]interface{}
+	}{
+		{
+			name:        "json patch",
+			key:         "test",
+			contentType: ContentTypeJSONPatch,
+			body:        `[{"op": "replace", "path": "/count", "value": 2}, {"op": "add", "path": "/tags/0", "value": "z"}, {"op": "remove", "path": "/name"}]`,
+			status:      http.StatusOK,
+			want:        map[string]interface{}{"count": float64(2), "tags": []interface{}{"z", "a"}},
+		},
+		{
+			name:        "merge patch",
+			key:         "test",
+			contentType: ContentTypeMergePatch + "; charset=utf-8",
+			body:        `{"name": null, "profile": {"city": "Vancouver"}}`,
+			status:      http.StatusOK,
+			want:        map[string]interface{}{"count": float64(1), "tags": []interface{}{"a"}, "profile": map[string]interface{}{"city": "Vancouver"}},
+		},
+		{
+			name:        "failed test operation",
+			key:         "test",
+			contentType: ContentTypeJSONPatch,
+			body:        `[{"op": "replace", "path": "/count", "value": 2}, {"op": "test", "path": "/name", "value": "bob"}]`,
+			status:      http.StatusPreconditionFailed,
+			want:        original,
+		},
+		{
+			name:        "invalid operation",
+			key:         "test",
+			contentType: ContentTypeJSONPatch,
+			body:        `[{"op": "replace", "path": "/count", "value": 2}, {"op": "remove", "path": "/nope"}]`,
+			status:      http.StatusBadRequest,
+			want:        original,
+		},
+		{
+			name:        "unsupported content type",
+			key:         "test",
+			contentType: "application/json",
+			body:        `{"name": "bob"}`,
+			status:      http.StatusUnsupportedMediaType,
+			want:        original,
+		},
+		{
+			name:        "missing key",
+			key:         "nothinghere",
+			contentType: ContentTypeMergePatch,
+			body:        `{"name": "bob"}`,
+			status:      http.StatusNotFound,
+			want:        original,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			index.I.SetFileSystem(af.NewMemMapFs())
+			_ = makeNewJSON("test", original)
+			index.I.Regenerate()
+
+			req, _ := http.NewRequest("PATCH", "/"+tc.key, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, tc.status)
+			assertJSONFileContents(t, index.I, "test", tc.want)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jackyzha0/nanoDB/index"
+)
+
+// getPreconditions builds the write preconditions given by the If-Match
+// and If-None-Match headers of r, along with the owner the document must have
+func getPreconditions(r *http.Request) (conds []index.Precondition) {
+	if o := ownerOf(r); o != nil {
+		conds = append(conds, o.precondition())
+	}
+
+	if tags := parseETags(r.Header.Get("If-Match")); len(tags) > 0 {
+		conds = append(conds, index.IfMatch(tags))
+	}
+
+	if tags := parseETags(r.Header.Get("If-None-Match")); len(tags) > 0 {
+		conds = append(conds, index.IfNoneMatch(tags))
+	}
+
+	return conds
+}
+
+// parseETags splits a comma separated list of ETags, ignoring weak prefixes
+func parseETags(header string) (res []string) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag != "" {
+			res = append(res, tag)
+		}
+	}
+	return res
+}
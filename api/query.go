@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Query returns a JSON of all documents matching the filter in the request body
+func Query(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var q index.Query
+	err := json.NewDecoder(r.Body).Decode(&q)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidJSON, "", "query cannot be parsed into json: %s", err.Error())
+		return
+	}
+
+	if q.Skip < 0 || q.Limit < 0 || q.Depth < 0 {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "", "skip, limit and depth must not be negative")
+		return
+	}
+	log.Info("query with filter %+v", q.Filter)
+
+	results, err := index.I.QueryFor(q, readable(r))
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "", "invalid query: %s", err.Error())
+		return
+	}
+
+	// create temporary struct with matching documents
+	data := struct {
+		Count   int                 `json:"count"`
+		Results []index.QueryResult `json:"results"`
+	}{
+		Count:   len(results),
+		Results: results,
+	}
+
+	// create json representation and return
+	w.Header().Set("Content-Type", "application/json")
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(w, "%+v", string(jsonData))
+}
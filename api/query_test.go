@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+func TestQuery(t *testing.T) {
+	router := httprouter.New()
+	router.POST("/_query", Query)
+
+	setupDocs := func() {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("alice", map[string]interface{}{"age": 31, "team": "REF::ops"})
+		_ = makeNewJSON("bob", map[string]interface{}{"age": 25})
+		_ = makeNewJSON("ops", map[string]interface{}{"title": "Operations"})
+		index.I.Regenerate()
+	}
+
+	t.Run("query with filter and sort", func(t *testing.T) {
+		setupDocs()
+
+		body := strings.NewReader(`{"filter": {"age": {"$gt": 20}}, "sort": ["-age"], "limit": 1, "depth": 1}`)
+		req, _ := http.NewRequest("POST", "/_query", body)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{
+			"count": float64(1),
+			"results": []interface{}{
+				map[string]interface{}{
+					"key": "alice",
+					"document": map[string]interface{}{
+						"age":  float64(31),
+						"team": map[string]interface{}{"title": "Operations"},
+					},
+				},
+			},
+		})
+	})
+
+	t.Run("query with no matches", func(t *testing.T) {
+		setupDocs()
+
+		req, _ := http.NewRequest("POST", "/_query", strings.NewReader(`{"filter": {"age": 99}}`))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{
+			"count":   float64(0),
+			"results": []interface{}{},
+		})
+	})
+
+	t.Run("query with invalid json", func(t *testing.T) {
+		setupDocs()
+
+		req, _ := http.NewRequest("POST", "/_query", strings.NewReader(`{"filter": `))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+	})
+
+	t.Run("query with unknown operator", func(t *testing.T) {
+		setupDocs()
+
+		req, _ := http.NewRequest("POST", "/_query", strings.NewReader(`{"filter": {"age": {"$near": 1}}}`))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+	})
+
+	t.Run("query with invalid regex", func(t *testing.T) {
+		setupDocs()
+
+		req, _ := http.NewRequest("POST", "/_query", strings.NewReader(`{"filter": {"name": {"$regex": "("}}}`))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+		assertHTTPErr(t, rr, CodeInvalidRequest, "")
+	})
+
+	t.Run("query with negative limit", func(t *testing.T) {
+		setupDocs()
+
+		req, _ := http.NewRequest("POST", "/_query", strings.NewReader(`{"limit": -1}`))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// DefaultSearchLimit is the default number of search results returned
+const DefaultSearchLimit = 20
+
+// Search returns a JSON of the keys best matching the search terms in ?q=,
+// along with their matching fields with the terms highlighted
+func Search(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q := r.URL.Query().Get("q")
+	if len(index.Tokenize(q)) == 0 {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "", "no search terms provided in 'q'")
+		return
+	}
+
+	limit, err := getLimitParam(r)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "", "invalid limit: %s", err.Error())
+		return
+	}
+	log.Info("search for '%s'", q)
+
+	// create temporary struct with ranked results
+	data := struct {
+		Query   string               `json:"query"`
+		Results []index.SearchResult `json:"results"`
+	}{
+		Query:   q,
+		Results: index.I.Search(q, limit),
+	}
+
+	// create json representation and return
+	w.Header().Set("Content-Type", "application/json")
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(w, "%+v", string(jsonData))
+}
+
+// getLimitParam returns the positive ?limit= of the request or DefaultSearchLimit
+func getLimitParam(r *http.Request) (int, error) {
+	param := r.URL.Query().Get("limit")
+	if param == "" {
+		return DefaultSearchLimit, nil
+	}
+
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("'%s' is not a positive number", param)
+	}
+	return limit, nil
+}
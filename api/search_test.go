@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+func TestSearch(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/_search", Search)
+
+	t.Run("search with no terms", func(t *testing.T) {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		req, _ := http.NewRequest("GET", "/_search?q=+", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+	})
+
+	t.Run("search with invalid limit", func(t *testing.T) {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		req, _ := http.NewRequest("GET", "/_search?q=a&limit=0", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+	})
+
+	t.Run("search with matches", func(t *testing.T) {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("alice", map[string]interface{}{"bio": "Loves Go"})
+		_ = makeNewJSON("bob", map[string]interface{}{"bio": "Loves Rust"})
+		index.I.Regenerate()
+
+		req, _ := http.NewRequest("GET", "/_search?q=go", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{
+			"query": "go",
+			"results": []interface{}{
+				map[string]interface{}{
+					"key":        "alice",
+					"score":      float64(1.099),
+					"highlights": map[string]interface{}{"bio": "Loves <em>Go</em>"},
+				},
+			},
+		})
+	})
+}
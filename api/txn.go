@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Transact applies the list of operations in the request body all-or-nothing
+func Transact(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body struct {
+		Ops []index.TxnOp `json:"ops"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeInvalidJSON, "", "transaction cannot be parsed into json: %s", err.Error())
+		return
+	}
+
+	if len(body.Ops) == 0 {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "", "transaction has no operations")
+		return
+	}
+	log.Info("transaction of %d operations", len(body.Ops))
+
+	for _, op := range body.Ops {
+		if perm := txnPermission(op.Op); !allowed(r, perm, op.Key) {
+			writeForbidden(w, perm, op.Key)
+			return
+		}
+	}
+
+	err = index.I.Transact(body.Ops)
+	if err != nil {
+		writeTxnErr(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	log.WInfo(w, "transaction of %d operations successful", len(body.Ops))
+}
+
+// txnPermission returns the permission needed to run a transaction operation
+func txnPermission(op string) string {
+	switch op {
+	case index.TxnPut, index.TxnPatch:
+		return PermWrite
+	case index.TxnDelete:
+		return PermDelete
+	default:
+		return PermRead
+	}
+}
+
+// writeTxnErr writes why a transaction failed, along with the key of the
+// operation that failed it
+func writeTxnErr(w http.ResponseWriter, err error) {
+	key := ""
+	var txnErr *index.TxnError
+	if errors.As(err, &txnErr) {
+		key = txnErr.Op.Key
+	}
+
+	status, e := errorFor(key, err)
+	e.Message = "transaction rolled back: " + err.Error()
+	writeAPIError(w, status, e)
+}
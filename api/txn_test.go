@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+func TestTransact(t *testing.T) {
+	router := httprouter.New()
+	router.POST("/_txn", Transact)
+
+	setupDocs := func() {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		_ = makeNewJSON("inventory", map[string]interface{}{"stock": 1})
+		index.I.Regenerate()
+	}
+
+	tt := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"invalid json", `{"ops": `, http.StatusBadRequest},
+		{"no operations", `{"ops": []}`, http.StatusBadRequest},
+		{"malformed operation", `{"ops": [{"op": "rename", "key": "a"}]}`, http.StatusBadRequest},
+		{"failed assertion", `{"ops": [{"op": "equals", "key": "inventory", "field": "stock", "value": 0}]}`, http.StatusPreconditionFailed},
+		{"key outside the data directory", `{"ops": [{"op": "put", "key": "../escaped2", "value": {"a": 1}}]}`, http.StatusBadRequest},
+		{"missing key", `{"ops": [{"op": "delete", "key": "order"}]}`, http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			setupDocs()
+
+			req, _ := http.NewRequest("POST", "/_txn", strings.NewReader(tc.body))
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+			assertHTTPStatus(t, rr, tc.status)
+			assertJSONFileContents(t, index.I, "inventory", map[string]interface{}{"stock": float64(1)})
+			if ok, _ := af.Exists(index.I.FileSystem, "../escaped2.json"); ok {
+				t.Errorf("transaction wrote outside the data directory")
+			}
+		})
+	}
+
+	t.Run("successful transaction", func(t *testing.T) {
+		setupDocs()
+
+		body := strings.NewReader(`{"ops": [
+			{"op": "equals", "key": "inventory", "field": "stock", "value": 1},
+			{"op": "patch", "key": "inventory", "field": "stock", "value": 0},
+			{"op": "put", "key": "order", "value": {"item": "inventory"}}
+		]}`)
+		req, _ := http.NewRequest("POST", "/_txn", body)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertJSONFileContents(t, index.I, "inventory", map[string]interface{}{"stock": float64(0)})
+		assertJSONFileContents(t, index.I, "order", map[string]interface{}{"item": "inventory"})
+	})
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// WebhookFailures lists the most recent webhook deliveries that failed every attempt
+func WebhookFailures(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Info("get webhook failures")
+
+	data := struct {
+		Failures []index.WebhookFailure `json:"failures"`
+	}{
+		Failures: index.I.WebhookFailures(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(w, "%+v", string(jsonData))
+}
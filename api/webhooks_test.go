@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+func TestWebhookFailures(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/_webhooks/failures", WebhookFailures)
+
+	shared := index.I
+	defer func() { index.I = shared }()
+
+	index.I = index.NewFileIndex(".")
+	index.I.SetFileSystem(af.NewMemMapFs())
+	index.I.Regenerate()
+
+	getFailures := func() []index.WebhookFailure {
+		req, _ := http.NewRequest("GET", "/_webhooks/failures", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+
+		var res struct {
+			Failures []index.WebhookFailure `json:"failures"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatalf("err parsing failures %s: %s", rr.Body.String(), err.Error())
+		}
+		return res.Failures
+	}
+
+	if failures := getFailures(); len(failures) != 0 {
+		t.Errorf("expected no failures, got %+v", failures)
+	}
+
+	// a target that always fails
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	stop := index.I.StartWebhooks(1, time.Millisecond)
+	_ = index.I.Put(&index.File{FileName: index.WebhooksKey}, []byte(fmt.Sprintf(`{"targets": [{"url": "%s", "prefixes": ["a"]}]}`, target.URL)))
+	_ = index.I.Put(&index.File{FileName: "a"}, []byte(`{}`))
+
+	// wait for every attempt to fail
+	deadline := time.Now().Add(5 * time.Second)
+	for len(index.I.WebhookFailures()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+
+	failures := getFailures()
+	if len(failures) != 1 || failures[0].URL != target.URL || failures[0].Change.Key != "a" {
+		t.Errorf("expected a failed delivery of key 'a', got %+v", failures)
+	}
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// websocket opcodes (RFC 6455)
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// websocket close codes
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+	wsCloseTryAgainLater = 1013
+)
+
+// wsGUID is appended to the client's key to compute the handshake accept key
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxMessageSize is the largest message accepted from a client
+const wsMaxMessageSize = 1 << 20
+
+// errWSClosed is returned when reading from a connection the other side closed
+var errWSClosed = errors.New("websocket closed")
+
+// wsConn is a websocket connection. Messages can be written from any
+// goroutine but must only be read from one
+type wsConn struct {
+	conn net.Conn
+	buf  *bufio.ReadWriter
+
+	// clients mask the frames they send, servers must not
+	client bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// upgradeWebSocket completes the websocket handshake of r and takes over
+// its connection, writing an error response if r isn't a valid handshake
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "", "expected a websocket handshake")
+		return nil, fmt.Errorf("not a websocket handshake")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeErr(w, http.StatusUpgradeRequired, CodeInvalidRequest, "", "only websocket version 13 is supported")
+		return nil, fmt.Errorf("unsupported websocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "", "invalid Sec-WebSocket-Key")
+		return nil, fmt.Errorf("invalid websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, "", "websockets are not supported")
+		return nil, fmt.Errorf("connection can't be hijacked")
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", wsAcceptKey(key))
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, buf: buf}, nil
+}
+
+// wsAcceptKey returns the Sec-WebSocket-Accept value for a client's key
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains returns whether the comma separated header contains token
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header[name] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message, answering pings and
+// joining fragmented messages along the way. Returns errWSClosed once the
+// other side closes the connection
+func (c *wsConn) readMessage() (opcode byte, payload []byte, err error) {
+	for {
+		fin, op, data, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// echo the close code back before hanging up
+			code := wsCloseNormal
+			if len(data) >= 2 {
+				code = int(binary.BigEndian.Uint16(data))
+			}
+			_ = c.close(code, "")
+			return 0, nil, errWSClosed
+		case wsContinuation:
+			if opcode == 0 {
+				_ = c.close(wsCloseProtocolError, "unexpected continuation frame")
+				return 0, nil, fmt.Errorf("unexpected continuation frame")
+			}
+		case wsText, wsBinary:
+			if opcode != 0 {
+				_ = c.close(wsCloseProtocolError, "expected a continuation frame")
+				return 0, nil, fmt.Errorf("expected a continuation frame")
+			}
+			opcode = op
+		default:
+			_ = c.close(wsCloseProtocolError, "unknown opcode")
+			return 0, nil, fmt.Errorf("unknown opcode %d", op)
+		}
+
+		if len(payload)+len(data) > wsMaxMessageSize {
+			_ = c.close(wsCloseTooBig, "message too big")
+			return 0, nil, fmt.Errorf("message too big")
+		}
+		payload = append(payload, data...)
+		if fin {
+			return opcode, payload, nil
+		}
+	}
+}
+
+// readFrame reads a single frame, unmasking its payload
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.buf, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	if masked == c.client {
+		_ = c.close(wsCloseProtocolError, "wrong frame masking")
+		return false, 0, nil, fmt.Errorf("wrong frame masking")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.buf, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.buf, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessageSize {
+		_ = c.close(wsCloseTooBig, "message too big")
+		return false, 0, nil, fmt.Errorf("frame too big")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.buf, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.buf, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for n := range payload {
+			payload[n] ^= mask[n%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes payload as a single unfragmented frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errWSClosed
+	}
+
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		header[1] |= 0x80
+		header = append(header, mask[:]...)
+
+		masked := make([]byte, len(payload))
+		for n := range payload {
+			masked[n] = payload[n] ^ mask[n%4]
+		}
+		payload = masked
+	}
+
+	if _, err := c.buf.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.buf.Write(payload); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+// writeJSON writes v as a json text message
+func (c *wsConn) writeJSON(v interface{}) error {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, jsonData)
+}
+
+// close sends a close frame with the given code and reason and closes the
+// underlying connection. Later writes fail with errWSClosed
+func (c *wsConn) close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	_ = c.writeFrame(wsClose, payload)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
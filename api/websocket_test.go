@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// dialWS opens a client websocket connection to the server at url, sending
+// header along with the handshake
+func dialWS(t *testing.T, url string, header http.Header) *wsConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("err dialing: %s", err.Error())
+	}
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	req, _ := http.NewRequest("GET", url+"/_ws", nil)
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("err writing handshake: %s", err.Error())
+	}
+
+	buf := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	res, err := http.ReadResponse(buf.Reader, req)
+	if err != nil {
+		t.Fatalf("err reading handshake: %s", err.Error())
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		t.Fatalf("handshake failed: %s", res.Status)
+	}
+
+	return &wsConn{conn: conn, buf: buf, client: true}
+}
+
+// pipeWS returns the server and client ends of an in memory websocket connection
+func pipeWS() (*wsConn, *wsConn) {
+	a, b := net.Pipe()
+	server := &wsConn{conn: a, buf: bufio.NewReadWriter(bufio.NewReader(a), bufio.NewWriter(a))}
+	client := &wsConn{conn: b, buf: bufio.NewReadWriter(bufio.NewReader(b), bufio.NewWriter(b)), client: true}
+	return server, client
+}
+
+func TestWSAcceptKey(t *testing.T) {
+	// example from RFC 6455
+	if got := wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("wrong accept key: %s", got)
+	}
+}
+
+func TestWSConn(t *testing.T) {
+	t.Run("messages of every length", func(t *testing.T) {
+		server, client := pipeWS()
+		defer server.conn.Close()
+		defer client.conn.Close()
+
+		for _, n := range []int{0, 125, 126, 70000} {
+			payload := bytes.Repeat([]byte("a"), n)
+			go func() { _ = client.writeFrame(wsText, payload) }()
+
+			op, got, err := server.readMessage()
+			if err != nil || op != wsText || !bytes.Equal(got, payload) {
+				t.Errorf("message of length %d didn't round trip: %v", n, err)
+			}
+		}
+	})
+
+	t.Run("fragments are joined and pings answered", func(t *testing.T) {
+		server, client := pipeWS()
+		defer server.conn.Close()
+		defer client.conn.Close()
+
+		go func() {
+			frames := [][]byte{
+				{0x01, 0x83, 0, 0, 0, 0, 'a', 'b', 'c'},
+				{0x89, 0x80, 0, 0, 0, 0},
+				{0x80, 0x82, 0, 0, 0, 0, 'd', 'e'},
+			}
+			for _, f := range frames {
+				_, _ = client.buf.Write(f)
+				_ = client.buf.Flush()
+			}
+		}()
+
+		pong := make(chan byte, 1)
+		go func() {
+			_, op, _, _ := client.readFrame()
+			pong <- op
+		}()
+
+		op, got, err := server.readMessage()
+		if err != nil || op != wsText || string(got) != "abcde" {
+			t.Errorf("fragmented message wasn't joined: %q %v", got, err)
+		}
+		if op := <-pong; op != wsPong {
+			t.Errorf("ping wasn't answered, got opcode %d", op)
+		}
+	})
+
+	t.Run("unmasked client frames are rejected", func(t *testing.T) {
+		server, client := pipeWS()
+		defer client.conn.Close()
+
+		go func() {
+			_, _ = client.buf.Write([]byte{0x81, 0x01, 'a'})
+			_ = client.buf.Flush()
+			_, _, _, _ = client.readFrame()
+		}()
+
+		if _, _, err := server.readMessage(); err == nil {
+			t.Errorf("unmasked frame was accepted")
+		}
+	})
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	tt := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"not an upgrade", map[string]string{}, http.StatusBadRequest},
+		{"wrong version", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusUpgradeRequired},
+		{"invalid key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/_ws", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+
+			_, err := upgradeWebSocket(rr, req)
+			if err == nil {
+				t.Errorf("handshake should have failed")
+			}
+			assertHTTPStatus(t, rr, tc.status)
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// actions clients can send over /_ws
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+)
+
+// reasons a request from a client is rejected
+var (
+	errInvalidAction = errors.New("action must be subscribe or unsubscribe")
+	errNegativeDepth = errors.New("depth must not be negative")
+)
+
+// wsRequest is a message sent by a client to change what it is subscribed to
+type wsRequest struct {
+	Action   string   `json:"action"`
+	Keys     []string `json:"keys,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+	Depth    int      `json:"depth,omitempty"`
+}
+
+// wsMessage is a message sent to a client. Snapshots hold the whole
+// document, changes only hold a merge patch from the last document sent
+type wsMessage struct {
+	Type     string      `json:"type"`
+	Seq      uint64      `json:"seq,omitempty"`
+	Change   string      `json:"change,omitempty"`
+	Key      string      `json:"key,omitempty"`
+	Document interface{} `json:"document,omitempty"`
+	Diff     interface{} `json:"diff,omitempty"`
+	Keys     []string    `json:"keys,omitempty"`
+	Prefixes []string    `json:"prefixes,omitempty"`
+	Message  string      `json:"message,omitempty"`
+}
+
+// wsSession tracks the subscriptions of a single client and the last
+// version of every document it was sent, so only diffs need to be sent
+type wsSession struct {
+	conn *wsConn
+
+	// depth to resolve references to by subscribed key and prefix
+	keys     map[string]int
+	prefixes map[string]int
+
+	// last document sent by key, and the seq it was read at
+	docs  map[string]interface{}
+	after map[string]uint64
+
+	// whether the client may read key
+	canRead func(key string) bool
+	// which references the client may have resolved
+	readRefs index.ReadFilter
+}
+
+// WebSocket lets clients subscribe to keys and key prefixes and pushes a
+// snapshot of every matching document followed by diffs as they change
+func WebSocket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Warn("err upgrading websocket: %s", err.Error())
+		return
+	}
+	// net/http no longer closes hijacked connections, so close it
+	// however the session ends. Closing twice does nothing
+	defer conn.close(wsCloseNormal, "")
+	log.Info("websocket connected from %s", r.RemoteAddr)
+
+	// subscribe before any snapshot is read so no change is missed
+	sub := index.I.Subscribe()
+	defer sub.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	requests := readRequests(conn, done)
+
+	ping := time.NewTicker(keepAliveInterval)
+	defer ping.Stop()
+
+	s := &wsSession{
+		conn:     conn,
+		keys:     map[string]int{},
+		prefixes: map[string]int{},
+		docs:     map[string]interface{}{},
+		after:    map[string]uint64{},
+		canRead:  func(key string) bool { return allowed(r, PermRead, key) },
+		readRefs: readable(r),
+	}
+
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				log.Info("websocket from %s disconnected", r.RemoteAddr)
+				return
+			}
+			err = s.handleRequest(req)
+		case c, ok := <-sub.C:
+			if !ok {
+				_ = conn.close(wsCloseTryAgainLater, "fell too far behind")
+				return
+			}
+			err = s.handleChange(c)
+		case <-ping.C:
+			err = conn.writeFrame(wsPing, nil)
+		}
+
+		if err != nil {
+			log.Warn("err writing to websocket from %s: %s", r.RemoteAddr, err.Error())
+			_ = conn.close(wsCloseNormal, "")
+			return
+		}
+	}
+}
+
+// readRequests reads requests from conn until it closes or done is closed.
+// Messages that aren't valid requests are answered with an error
+func readRequests(conn *wsConn, done chan struct{}) <-chan wsRequest {
+	requests := make(chan wsRequest)
+	go func() {
+		defer close(requests)
+		for {
+			_, payload, err := conn.readMessage()
+			if err != nil {
+				return
+			}
+
+			var req wsRequest
+			err = json.Unmarshal(payload, &req)
+			if err == nil && req.Action != wsSubscribe && req.Action != wsUnsubscribe {
+				err = errInvalidAction
+			}
+			if err == nil && req.Depth < 0 {
+				err = errNegativeDepth
+			}
+			if err != nil {
+				_ = conn.writeJSON(wsMessage{Type: "error", Message: "invalid request: " + err.Error()})
+				continue
+			}
+
+			select {
+			case requests <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return requests
+}
+
+// handleRequest subscribes or unsubscribes the client
+func (s *wsSession) handleRequest(req wsRequest) error {
+	if req.Action == wsUnsubscribe {
+		for _, key := range req.Keys {
+			delete(s.keys, key)
+		}
+		for _, prefix := range req.Prefixes {
+			delete(s.prefixes, prefix)
+		}
+
+		// forget documents that are no longer subscribed to
+		for key := range s.docs {
+			if _, ok := s.depthOf(key); !ok {
+				delete(s.docs, key)
+				delete(s.after, key)
+			}
+		}
+		return s.conn.writeJSON(wsMessage{Type: "unsubscribed", Keys: req.Keys, Prefixes: req.Prefixes})
+	}
+
+	for _, key := range req.Keys {
+		s.keys[key] = req.Depth
+	}
+	for _, prefix := range req.Prefixes {
+		s.prefixes[prefix] = req.Depth
+	}
+
+	err := s.conn.writeJSON(wsMessage{Type: "subscribed", Keys: req.Keys, Prefixes: req.Prefixes})
+	if err != nil {
+		return err
+	}
+
+	// send the current version of every newly subscribed document
+	keys := map[string]bool{}
+	for _, key := range req.Keys {
+		keys[key] = true
+	}
+	for _, key := range index.I.List() {
+		for _, prefix := range req.Prefixes {
+			keys[key] = keys[key] || strings.HasPrefix(key, prefix)
+		}
+	}
+
+	sorted := []string{}
+	for key, ok := range keys {
+		if ok {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		if err := s.sendSnapshot(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendSnapshot sends the whole document of key, if it exists
+func (s *wsSession) sendSnapshot(key string) error {
+	depth, ok := s.depthOf(key)
+	if !ok {
+		return nil
+	}
+
+	// changes up to here are already part of the document read below
+	seq := index.I.LastSeq()
+
+	file, ok := index.I.Lookup(key)
+	if !ok {
+		return nil
+	}
+	jsonMap, err := file.ToMap()
+	if err != nil {
+		return nil
+	}
+
+	doc := index.ResolveReferencesFor(jsonMap, depth, s.readRefs)
+	s.docs[key] = doc
+	s.after[key] = seq
+	return s.conn.writeJSON(wsMessage{Type: "snapshot", Seq: seq, Key: key, Document: doc})
+}
+
+// handleChange sends the diff of a change to a subscribed document
+func (s *wsSession) handleChange(c index.Change) error {
+	depth, ok := s.depthOf(c.Key)
+	if !ok || c.Seq <= s.after[c.Key] {
+		return nil
+	}
+
+	msg := wsMessage{Type: "change", Seq: c.Seq, Change: c.Type, Key: c.Key}
+	if c.Type == index.ChangeDelete {
+		delete(s.docs, c.Key)
+		return s.conn.writeJSON(msg)
+	}
+
+	doc := index.ResolveReferencesFor(c.Document, depth, s.readRefs)
+	previous, seen := s.docs[c.Key]
+	msg.Diff = index.CreateMergePatch(previous, doc)
+	s.docs[c.Key] = doc
+
+	// nothing the client can see changed
+	if diff, isMap := msg.Diff.(map[string]interface{}); seen && isMap && len(diff) == 0 {
+		return nil
+	}
+	return s.conn.writeJSON(msg)
+}
+
+// depthOf returns the depth to resolve references of key to, the deepest of
+// every subscription matching it, and whether any subscription matches it
+// that the client may read
+func (s *wsSession) depthOf(key string) (int, bool) {
+	if !s.canRead(key) {
+		return 0, false
+	}
+
+	depth, ok := s.keys[key]
+	for prefix, d := range s.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			if !ok || d > depth {
+				depth = d
+			}
+			ok = true
+		}
+	}
+	return depth, ok
+}
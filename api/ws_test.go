@@ -0,0 +1,207 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+)
+
+// readWSMessage returns the next message sent to client
+func readWSMessage(t *testing.T, client *wsConn) wsMessage {
+	t.Helper()
+
+	_ = client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, payload, err := client.readMessage()
+	if err != nil {
+		t.Fatalf("err reading message: %s", err.Error())
+	}
+
+	var msg wsMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		t.Fatalf("err parsing message %s: %s", payload, err.Error())
+	}
+	return msg
+}
+
+func assertWSMessage(t *testing.T, got wsMessage, want wsMessage) {
+	t.Helper()
+
+	got.Seq = 0
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got message %+v, wanted %+v", got, want)
+	}
+}
+
+// closeNotifyingListener accepts connections that close closed when they are closed
+type closeNotifyingListener struct {
+	net.Listener
+	closed chan struct{}
+}
+
+func (l *closeNotifyingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &closeNotifyingConn{Conn: conn, closed: l.closed}, nil
+}
+
+type closeNotifyingConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestWebSocket_dropped(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/_ws", WebSocket)
+
+	shared := index.I
+	defer func() { index.I = shared }()
+	index.I = index.NewFileIndex(".")
+	index.I.SetFileSystem(af.NewMemMapFs())
+	index.I.Regenerate()
+
+	server := httptest.NewUnstartedServer(router)
+	closed := make(chan struct{})
+	server.Listener = &closeNotifyingListener{Listener: server.Listener, closed: closed}
+	server.Start()
+	defer server.Close()
+
+	// drop the connection without a close frame
+	client := dialWS(t, server.URL, nil)
+	_ = client.conn.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("server should close connections dropped by the client")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/_ws", WebSocket)
+
+	shared := index.I
+	defer func() { index.I = shared }()
+
+	setupWS := func(header http.Header) (*wsConn, func()) {
+		index.I = index.NewFileIndex(".")
+		index.I.SetFileSystem(af.NewMemMapFs())
+		index.I.Regenerate()
+
+		// wait for the handler to exit when done so it doesn't outlive the subtest
+		var handlers sync.WaitGroup
+		handler := Authenticate(router)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+			handler.ServeHTTP(w, r)
+		}))
+		client := dialWS(t, server.URL, header)
+		return client, func() {
+			_ = client.conn.Close()
+			handlers.Wait()
+			server.Close()
+		}
+	}
+
+	t.Run("key subscriptions receive a snapshot then diffs", func(t *testing.T) {
+		client, done := setupWS(nil)
+		defer done()
+		_ = index.I.Put(&index.File{FileName: "a"}, []byte(`{"n":1,"name":"a"}`))
+
+		_ = client.writeJSON(wsRequest{Action: wsSubscribe, Keys: []string{"a"}})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "subscribed", Keys: []string{"a"}})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "snapshot", Key: "a",
+			Document: map[string]interface{}{"n": float64(1), "name": "a"}})
+
+		_ = index.I.Put(&index.File{FileName: "b"}, []byte(`{"n":1}`))
+		_ = index.I.Put(&index.File{FileName: "a"}, []byte(`{"n":2,"name":"a"}`))
+		_ = index.I.Delete(&index.File{FileName: "a"})
+
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "change", Change: index.ChangeUpdate, Key: "a",
+			Diff: map[string]interface{}{"n": float64(2)}})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "change", Change: index.ChangeDelete, Key: "a"})
+	})
+
+	t.Run("prefix subscriptions resolve references", func(t *testing.T) {
+		client, done := setupWS(nil)
+		defer done()
+		_ = index.I.Put(&index.File{FileName: "user.alice"}, []byte(`{"friend":"REF::user.bob"}`))
+		_ = index.I.Put(&index.File{FileName: "user.bob"}, []byte(`{"age":30}`))
+
+		_ = client.writeJSON(wsRequest{Action: wsSubscribe, Prefixes: []string{"user."}, Depth: 1})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "subscribed", Prefixes: []string{"user."}})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "snapshot", Key: "user.alice",
+			Document: map[string]interface{}{"friend": map[string]interface{}{"age": float64(30)}}})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "snapshot", Key: "user.bob",
+			Document: map[string]interface{}{"age": float64(30)}})
+
+		_ = index.I.Put(&index.File{FileName: "user.carol"}, []byte(`{"age":25}`))
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "change", Change: index.ChangeCreate, Key: "user.carol",
+			Diff: map[string]interface{}{"age": float64(25)}})
+	})
+
+	t.Run("unsubscribed keys stop receiving changes", func(t *testing.T) {
+		client, done := setupWS(nil)
+		defer done()
+
+		_ = client.writeJSON(wsRequest{Action: wsSubscribe, Keys: []string{"a", "b"}})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "subscribed", Keys: []string{"a", "b"}})
+		_ = client.writeJSON(wsRequest{Action: wsUnsubscribe, Keys: []string{"a"}})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "unsubscribed", Keys: []string{"a"}})
+
+		_ = index.I.Put(&index.File{FileName: "a"}, []byte(`{"n":1}`))
+		_ = index.I.Put(&index.File{FileName: "b"}, []byte(`{"n":1}`))
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "change", Change: index.ChangeCreate, Key: "b",
+			Diff: map[string]interface{}{"n": float64(1)}})
+	})
+
+	t.Run("invalid requests are answered with an error", func(t *testing.T) {
+		client, done := setupWS(nil)
+		defer done()
+
+		_ = client.writeFrame(wsText, []byte(`{"action":"watch"}`))
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "error", Message: "invalid request: " + errInvalidAction.Error()})
+		_ = client.writeFrame(wsText, []byte(`{"action":"subscribe","depth":-1}`))
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "error", Message: "invalid request: " + errNegativeDepth.Error()})
+		_ = client.writeFrame(wsText, []byte(`not json`))
+		if msg := readWSMessage(t, client); msg.Type != "error" {
+			t.Errorf("expected an error, got %+v", msg)
+		}
+	})
+
+	t.Run("keys the api key can't read are left out", func(t *testing.T) {
+		defer useKeys(t)()
+		client, done := setupWS(http.Header{"Authorization": {"Bearer k_read"}})
+		defer done()
+		_ = index.I.Put(&index.File{FileName: "post.1"}, []byte(`{"n":1}`))
+		_ = index.I.Put(&index.File{FileName: "user.1"}, []byte(`{"n":1}`))
+
+		_ = client.writeJSON(wsRequest{Action: wsSubscribe, Keys: []string{"user.1", "post.1"}})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "subscribed", Keys: []string{"user.1", "post.1"}})
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "snapshot", Key: "post.1",
+			Document: map[string]interface{}{"n": float64(1)}})
+
+		_ = index.I.Put(&index.File{FileName: "user.1"}, []byte(`{"n":2}`))
+		_ = index.I.Put(&index.File{FileName: "post.1"}, []byte(`{"n":2}`))
+		assertWSMessage(t, readWSMessage(t, client), wsMessage{Type: "change", Change: index.ChangeUpdate, Key: "post.1",
+			Diff: map[string]interface{}{"n": float64(2)}})
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// openOffline opens the database in dir for a one-off command, making sure
+// no server or shell is using it at the same time
+func openOffline(dir string) (closeDB func(), err error) {
+	index.I = index.NewFileIndex(dir)
+
+	err = acquireLock(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s, is nanodb running? stop it or use its api instead", err.Error())
+	}
+
+	// roll forward any operations interrupted by a crash
+	err = index.I.OpenJournal()
+	if err != nil {
+		_ = releaseLock(dir)
+		return nil, err
+	}
+
+	index.I.Regenerate()
+	return func() {
+		if err := index.I.CloseJournal(); err != nil {
+			log.Warn("couldn't close journal: %s", err.Error())
+		}
+		if err := releaseLock(dir); err != nil {
+			log.Warn("couldn't remove lock: %s", err.Error())
+		}
+	}, nil
+}
+
+// backup writes a snapshot of every document in dir to out
+func backup(dir string, out string) error {
+	closeDB, err := openOffline(dir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	f, err := index.I.FileSystem.Create(out)
+	if err != nil {
+		return err
+	}
+
+	count, err := index.I.Snapshot(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = index.I.FileSystem.Remove(out)
+		return err
+	}
+
+	log.Success("backed up %d documents to %s", count, out)
+	return nil
+}
+
+// restore replaces the documents in dir with the snapshot at from. Existing
+// documents are only replaced if force is set
+func restore(dir string, from string, force bool) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	closeDB, err := openOffline(dir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	if index.I.HasDocuments() && !force {
+		return fmt.Errorf("%s already has documents, use --force to replace them", dir)
+	}
+
+	f, err := index.I.FileSystem.Open(from)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	count, err := index.I.Restore(f)
+	if err != nil {
+		return err
+	}
+
+	log.Success("restored %d documents from %s", count, from)
+	return nil
+}
@@ -0,0 +1,174 @@
+package index
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// types of changes published to subscribers
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// DefaultChangeBuffer is how many recent changes are kept so subscribers can resume
+const DefaultChangeBuffer = 1024
+
+// subscriberBuffer is how many changes a subscriber can fall behind by
+// before it is dropped, so a slow subscriber never holds up writes
+const subscriberBuffer = 256
+
+// ErrChangesExpired is returned when resuming from a sequence number that
+// is no longer buffered
+var ErrChangesExpired = errors.New("changes since the given sequence number are no longer available")
+
+// Change is a single create, update or delete of a document. Seq increases
+// by one with every change. Document is left out for deletes
+type Change struct {
+	Seq      uint64                 `json:"seq"`
+	Type     string                 `json:"type"`
+	Key      string                 `json:"key"`
+	Time     time.Time              `json:"time"`
+	Document map[string]interface{} `json:"document,omitempty"`
+}
+
+// changeFeed numbers every change and fans them out to subscribers
+type changeFeed struct {
+	mu     sync.Mutex
+	seq    uint64
+	recent []Change
+	limit  int
+	subs   map[*Subscription]bool
+}
+
+func newChangeFeed(limit int) *changeFeed {
+	return &changeFeed{
+		limit: limit,
+		subs:  map[*Subscription]bool{},
+	}
+}
+
+// Subscription receives every change made after it was created on C. C is
+// closed once the subscription is closed or falls too far behind
+type Subscription struct {
+	C    <-chan Change
+	ch   chan Change
+	feed *changeFeed
+}
+
+// Close stops the subscription and closes C
+func (s *Subscription) Close() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	s.feed.drop(s)
+}
+
+// drop removes s from the feed. Callers must hold feed.mu
+func (feed *changeFeed) drop(s *Subscription) {
+	if feed.subs[s] {
+		delete(feed.subs, s)
+		close(s.ch)
+	}
+}
+
+// Subscribe returns a subscription to every change from now on
+func (i *FileIndex) Subscribe() *Subscription {
+	s, _, _ := i.subscribe(0, false)
+	return s
+}
+
+// SubscribeSince returns a subscription to every change from now on along
+// with the buffered changes with a sequence number after seq, so nothing
+// is missed in between. Returns ErrChangesExpired if some of those changes
+// are no longer buffered
+func (i *FileIndex) SubscribeSince(seq uint64) (*Subscription, []Change, error) {
+	return i.subscribe(seq, true)
+}
+
+func (i *FileIndex) subscribe(since uint64, resume bool) (*Subscription, []Change, error) {
+	feed := i.changes
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	backlog := []Change{}
+	if resume {
+		// the change right after since must still be buffered. sequence
+		// numbers start over on restart so later ones can't be resumed either
+		oldest := feed.seq + 1
+		if len(feed.recent) > 0 {
+			oldest = feed.recent[0].Seq
+		}
+		if since+1 < oldest || since > feed.seq {
+			return nil, nil, ErrChangesExpired
+		}
+
+		for _, c := range feed.recent {
+			if c.Seq > since {
+				backlog = append(backlog, c)
+			}
+		}
+	}
+
+	ch := make(chan Change, subscriberBuffer)
+	s := &Subscription{C: ch, ch: ch, feed: feed}
+	feed.subs[s] = true
+	return s, backlog, nil
+}
+
+// LastSeq returns the sequence number of the most recent change
+func (i *FileIndex) LastSeq() uint64 {
+	i.changes.mu.Lock()
+	defer i.changes.mu.Unlock()
+	return i.changes.seq
+}
+
+// publish numbers a change to key and sends it to every subscriber and
+// matching webhook. Callers hold the write lock of key so changes to it are
+// published in order
+func (i *FileIndex) publish(changeType string, key string, doc map[string]interface{}) {
+	c := i.changes.add(changeType, key, doc)
+
+	// config documents hold the webhook secrets, so they are never delivered
+	if !IsReservedKey(key) {
+		i.webhooks.enqueue(c)
+	}
+}
+
+// add numbers a change and sends it to every subscriber
+func (feed *changeFeed) add(changeType string, key string, doc map[string]interface{}) Change {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	feed.seq++
+	c := Change{Seq: feed.seq, Type: changeType, Key: key, Time: time.Now().UTC(), Document: doc}
+
+	feed.recent = append(feed.recent, c)
+	if len(feed.recent) > feed.limit {
+		feed.recent = feed.recent[len(feed.recent)-feed.limit:]
+	}
+
+	for s := range feed.subs {
+		select {
+		case s.ch <- c:
+		default:
+			// too far behind, it can resume from its last seq
+			feed.drop(s)
+		}
+	}
+	return c
+}
+
+// isLive returns whether the document of f is on disk and hasn't expired.
+// Callers must hold the lock of f
+func (i *FileIndex) isLive(f *File) bool {
+	if _, err := i.FileSystem.Stat(f.ResolvePath()); err != nil {
+		return false
+	}
+
+	// read lock on index
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return !i.isExpired(f.FileName, time.Now())
+}
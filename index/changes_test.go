@@ -0,0 +1,138 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receive returns the next n changes of s
+func receive(t *testing.T, s *Subscription, n int) []Change {
+	t.Helper()
+
+	res := []Change{}
+	for len(res) < n {
+		select {
+		case c := <-s.C:
+			res = append(res, c)
+		default:
+			t.Fatalf("got %d changes, want %d", len(res), n)
+		}
+	}
+	return res
+}
+
+func TestFileIndex_Subscribe(t *testing.T) {
+	t.Run("every mutation is published in order", func(t *testing.T) {
+		setup()
+		s := I.Subscribe()
+		defer s.Close()
+
+		file := &File{FileName: "doc"}
+		assertNilErr(t, I.Put(file, []byte(`{"n":1}`)))
+		assertNilErr(t, I.Put(file, []byte(`{"n":2}`)))
+		_, err := I.PatchField(file, "m", 3)
+		assertNilErr(t, err)
+		assertNilErr(t, I.Delete(file))
+
+		changes := receive(t, s, 4)
+		for n, want := range []string{ChangeCreate, ChangeUpdate, ChangeUpdate, ChangeDelete} {
+			assert.Equal(t, want, changes[n].Type)
+			assert.Equal(t, "doc", changes[n].Key)
+			if n > 0 {
+				assert.Equal(t, changes[n-1].Seq+1, changes[n].Seq)
+			}
+		}
+		checkDeepEquals(t, changes[2].Document, map[string]interface{}{"n": float64(2), "m": float64(3)})
+		assert.Nil(t, changes[3].Document)
+	})
+
+	t.Run("transactions publish each changed document", func(t *testing.T) {
+		setup()
+		makeNewJSON("a", map[string]interface{}{"n": 1})
+		I.Regenerate()
+		s := I.Subscribe()
+		defer s.Close()
+
+		assertNilErr(t, I.Transact(parseTxn(t, `[
+			{"op": "delete", "key": "a"},
+			{"op": "put", "key": "b", "value": {"n": 2}},
+			{"op": "exists", "key": "b"}
+		]`)))
+
+		changes := receive(t, s, 2)
+		assert.Equal(t, ChangeDelete, changes[0].Type)
+		assert.Equal(t, "a", changes[0].Key)
+		assert.Equal(t, ChangeCreate, changes[1].Type)
+		assert.Equal(t, "b", changes[1].Key)
+	})
+
+	t.Run("failed writes publish nothing", func(t *testing.T) {
+		setup()
+		s := I.Subscribe()
+		defer s.Close()
+
+		err := I.Put(&File{FileName: "doc"}, []byte(`{}`), IfMatch([]string{`"stale"`}))
+		assert.Equal(t, ErrPreconditionFailed, err)
+		assert.Len(t, s.C, 0)
+	})
+
+	t.Run("closed subscriptions stop receiving", func(t *testing.T) {
+		setup()
+		s := I.Subscribe()
+		s.Close()
+		s.Close()
+
+		assertNilErr(t, I.Put(&File{FileName: "doc"}, []byte(`{}`)))
+		_, open := <-s.C
+		assert.False(t, open)
+	})
+
+	t.Run("slow subscribers are dropped", func(t *testing.T) {
+		setup()
+		s := I.Subscribe()
+
+		file := &File{FileName: "doc"}
+		for n := 0; n <= subscriberBuffer; n++ {
+			assertNilErr(t, I.Put(file, []byte(`{}`)))
+		}
+
+		receive(t, s, subscriberBuffer)
+		_, open := <-s.C
+		assert.False(t, open)
+	})
+}
+
+func TestFileIndex_SubscribeSince(t *testing.T) {
+	setup()
+	I.changes = newChangeFeed(3)
+
+	file := &File{FileName: "doc"}
+	for n := 0; n < 5; n++ {
+		assertNilErr(t, I.Put(file, []byte(`{}`)))
+	}
+	assert.Equal(t, uint64(5), I.LastSeq())
+
+	t.Run("buffered changes are replayed", func(t *testing.T) {
+		s, backlog, err := I.SubscribeSince(3)
+		assertNilErr(t, err)
+		defer s.Close()
+
+		assert.Len(t, backlog, 2)
+		assert.Equal(t, uint64(4), backlog[0].Seq)
+		assert.Equal(t, uint64(5), backlog[1].Seq)
+
+		assertNilErr(t, I.Put(file, []byte(`{}`)))
+		assert.Equal(t, uint64(6), receive(t, s, 1)[0].Seq)
+	})
+
+	t.Run("changes no longer buffered", func(t *testing.T) {
+		_, _, err := I.SubscribeSince(1)
+		assert.Equal(t, ErrChangesExpired, err)
+	})
+
+	t.Run("sequence numbers from before a restart", func(t *testing.T) {
+		_, _, err := I.SubscribeSince(100)
+		assert.Equal(t, ErrChangesExpired, err)
+	})
+}
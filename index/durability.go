@@ -0,0 +1,246 @@
+package index
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// Durability controls when writes are flushed to stable storage
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing to the operating system
+	DurabilityNone Durability = iota
+	// DurabilityPerWrite syncs the file and its directory on every write
+	DurabilityPerWrite
+	// DurabilityBatched groups writes together and syncs them on an interval
+	DurabilityBatched
+)
+
+// DefaultBatchInterval is how often batched writes are synced by default
+const DefaultBatchInterval = 10 * time.Millisecond
+
+var durabilityNames = map[string]Durability{
+	"none":      DurabilityNone,
+	"per-write": DurabilityPerWrite,
+	"batched":   DurabilityBatched,
+}
+
+// ParseDurability converts a durability mode name into a Durability
+func ParseDurability(s string) (Durability, error) {
+	if d, ok := durabilityNames[s]; ok {
+		return d, nil
+	}
+	return DurabilityNone, fmt.Errorf("unknown durability mode '%s', must be one of none, per-write, batched", s)
+}
+
+func (d Durability) String() string {
+	for name, mode := range durabilityNames {
+		if mode == d {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// SetDurability changes when writes are flushed to disk. interval is only
+// used in batched mode and determines how often writes are group committed
+func (i *FileIndex) SetDurability(mode Durability, interval time.Duration) {
+	// write lock on index so no writes are in flight
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.syncer != nil {
+		i.syncer.stop()
+	}
+
+	if mode == DurabilityBatched {
+		if interval <= 0 {
+			interval = DefaultBatchInterval
+		}
+		i.syncer = newGroupSyncer(interval)
+	}
+
+	i.durability = mode
+	log.Info("using durability mode %s", mode)
+}
+
+// syncDir flushes directory entries (creates, renames, removes) in dir to disk
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	d, err := I.FileSystem.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// syncRequest is a single write waiting on the next group commit
+type syncRequest struct {
+	// tmp is renamed over path once synced, if set
+	tmp  string
+	path string
+
+	journal *Journal
+	done    chan error
+}
+
+// groupSyncer collects writes and syncs them all together on an interval
+// so many writers share the cost of a single round of fsyncs
+type groupSyncer struct {
+	mu      sync.Mutex
+	pending []*syncRequest
+	closed  bool
+	quit    chan struct{}
+	stopped chan struct{}
+}
+
+func newGroupSyncer(interval time.Duration) *groupSyncer {
+	s := &groupSyncer{
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer close(s.stopped)
+
+		for {
+			select {
+			case <-ticker.C:
+				s.flush()
+			case <-s.quit:
+				s.flush()
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// commit blocks until the next group commit has synced tmp, renamed it
+// over path and synced the directory containing path
+func (s *groupSyncer) commit(tmp string, path string, journal *Journal) error {
+	req := &syncRequest{
+		tmp:     tmp,
+		path:    path,
+		journal: journal,
+		done:    make(chan error, 1),
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, req)
+	closed := s.closed
+	s.mu.Unlock()
+
+	// nothing will flush for us once stopped
+	if closed {
+		s.flush()
+	}
+
+	return <-req.done
+}
+
+// stop flushes any pending writes and stops the background goroutine.
+// Writes committed after stop are synced immediately
+func (s *groupSyncer) stop() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.quit)
+	<-s.stopped
+}
+
+// flush syncs everything that is currently pending
+func (s *groupSyncer) flush() {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	// journal entries go to disk before any of the documents they describe
+	journals := map[*Journal]error{}
+	for _, req := range batch {
+		if req.journal != nil {
+			if _, ok := journals[req.journal]; !ok {
+				journals[req.journal] = req.journal.sync()
+			}
+		}
+	}
+
+	errs := make([]error, len(batch))
+	dirs := map[string]error{}
+	for n, req := range batch {
+		if req.journal != nil {
+			errs[n] = journals[req.journal]
+		}
+
+		if req.tmp != "" {
+			if errs[n] == nil {
+				errs[n] = syncFile(req.tmp)
+			}
+			if errs[n] == nil {
+				errs[n] = I.FileSystem.Rename(req.tmp, req.path)
+			}
+			if errs[n] != nil {
+				_ = I.FileSystem.Remove(req.tmp)
+			}
+		}
+
+		dirs[filepath.Dir(req.path)] = nil
+	}
+
+	// one directory sync covers every rename and remove inside it
+	for dir := range dirs {
+		dirs[dir] = syncDir(dir)
+	}
+
+	for n, req := range batch {
+		if errs[n] == nil {
+			errs[n] = dirs[filepath.Dir(req.path)]
+		}
+		req.done <- errs[n]
+	}
+}
+
+// syncFile flushes the contents of the file at path to disk
+func syncFile(path string) error {
+	f, err := I.FileSystem.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// Flush waits for any batched writes to be synced and stops batching,
+// later writes are synced as they happen
+func (i *FileIndex) Flush() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.syncer != nil {
+		i.syncer.stop()
+	}
+}
@@ -0,0 +1,97 @@
+package index
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDurability(t *testing.T) {
+	t.Run("parses known modes", func(t *testing.T) {
+		for _, mode := range []Durability{DurabilityNone, DurabilityPerWrite, DurabilityBatched} {
+			got, err := ParseDurability(mode.String())
+			assertNilErr(t, err)
+			checkDeepEquals(t, got, mode)
+		}
+	})
+
+	t.Run("rejects unknown modes", func(t *testing.T) {
+		_, err := ParseDurability("sometimes")
+		assertErr(t, err)
+	})
+}
+
+func TestFileIndex_SetDurability(t *testing.T) {
+	content := map[string]interface{}{
+		"field": "value",
+	}
+
+	for _, mode := range []Durability{DurabilityNone, DurabilityPerWrite, DurabilityBatched} {
+		t.Run(fmt.Sprintf("put and delete with durability %s", mode), func(t *testing.T) {
+			setup()
+			I.SetDurability(mode, time.Millisecond)
+			defer I.Flush()
+
+			file := &File{FileName: "durable"}
+			err := I.Put(file, []byte(mapToString(content)))
+			assertNilErr(t, err)
+			assertFileExists(t, "durable")
+			checkContentEqual(t, "durable", content)
+
+			err = I.Delete(file)
+			assertNilErr(t, err)
+			assertFileDoesNotExist(t, "durable")
+		})
+	}
+
+	t.Run("batched writes are grouped together", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.OpenJournal())
+		I.SetDurability(DurabilityBatched, 5*time.Millisecond)
+
+		var wg sync.WaitGroup
+		for n := 0; n < 20; n++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				key := fmt.Sprintf("batched%d", n)
+				err := I.Put(&File{FileName: key}, []byte(mapToString(content)))
+				assertNilErr(t, err)
+			}(n)
+		}
+		wg.Wait()
+
+		checkDeepEquals(t, len(I.List()), 20)
+		for n := 0; n < 20; n++ {
+			assertFileExists(t, fmt.Sprintf("batched%d", n))
+		}
+
+		entries, err := readJournal(JournalName)
+		assertNilErr(t, err)
+		checkDeepEquals(t, len(pendingEntries(entries)), 0)
+
+		I.Flush()
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("writes after flush are synced immediately", func(t *testing.T) {
+		setup()
+		I.SetDurability(DurabilityBatched, time.Hour)
+		I.Flush()
+
+		done := make(chan error)
+		go func() {
+			done <- I.Put(&File{FileName: "after_flush"}, []byte("{}"))
+		}()
+
+		select {
+		case err := <-done:
+			assertNilErr(t, err)
+		case <-time.After(time.Second):
+			assert.Fail(t, "write after flush never completed")
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/log"
+	af "github.com/spf13/afero"
+)
+
+// ExpiryDir is the hidden folder inside the database directory that
+// holds the expiry time of keys with a TTL
+const ExpiryDir = ".expiry"
+
+// DefaultReapInterval is how often expired keys are deleted by default
+const DefaultReapInterval = time.Second
+
+// expiryPath returns the location of the expiry time of key
+func expiryPath(key string) string {
+	return filepath.Join(I.dir, ExpiryDir, key)
+}
+
+// isExpired returns whether key has an expiry time that has passed.
+// Callers must hold i.mu
+func (i *FileIndex) isExpired(key string, now time.Time) bool {
+	at, ok := i.expiry[key]
+	return ok && !now.Before(at)
+}
+
+// Expire deletes key once ttl has passed, replacing any previous expiry
+func (i *FileIndex) Expire(key string, ttl time.Duration) error {
+	file, ok := i.Lookup(key)
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	// write lock on file so the expiry can't race with a write
+	file, err := i.claim(file, false)
+	if err != nil {
+		return err
+	}
+	defer file.mu.Unlock()
+
+	return i.setExpiry(file, time.Now().Add(ttl))
+}
+
+// setExpiry makes f expire at the given time. Callers must hold f.mu
+func (i *FileIndex) setExpiry(f *File, at time.Time) error {
+	if err := writeExpiry(f.FileName, at); err != nil {
+		return err
+	}
+
+	// write lock on index
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.expiry[f.FileName] = at
+	return nil
+}
+
+// writeExpiry saves the expiry time of key to disk
+func writeExpiry(key string, at time.Time) error {
+	err := I.FileSystem.MkdirAll(filepath.Dir(expiryPath(key)), 0755)
+	if err != nil {
+		return err
+	}
+	return af.WriteFile(I.FileSystem, expiryPath(key), []byte(at.Format(time.RFC3339Nano)), 0644)
+}
+
+// TTL returns how long key has left before it expires and whether it has an expiry
+func (i *FileIndex) TTL(key string) (time.Duration, bool) {
+	// read lock on index
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	at, ok := i.expiry[key]
+	return time.Until(at), ok
+}
+
+// clearExpiry removes any expiry time of f. Callers must hold f.mu
+func (i *FileIndex) clearExpiry(f *File) {
+	// write lock on index
+	i.mu.Lock()
+	_, ok := i.expiry[f.FileName]
+	delete(i.expiry, f.FileName)
+	i.mu.Unlock()
+
+	if ok {
+		_ = I.FileSystem.Remove(expiryPath(f.FileName))
+	}
+}
+
+// loadExpiry reads the expiry times of all keys from disk
+func loadExpiry(dir string) map[string]time.Time {
+	res := map[string]time.Time{}
+
+	expiryDir := filepath.Join(dir, ExpiryDir)
+	files, err := af.ReadDir(I.FileSystem, expiryDir)
+	if err != nil {
+		return res
+	}
+
+	for _, file := range files {
+		b, err := af.ReadFile(I.FileSystem, filepath.Join(expiryDir, file.Name()))
+		if err != nil {
+			continue
+		}
+
+		at, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+		if err != nil {
+			log.Warn("ignoring unreadable expiry of key '%s'", file.Name())
+			continue
+		}
+		res[file.Name()] = at
+	}
+
+	return res
+}
+
+// expiredKeys returns all keys whose expiry time has passed
+func (i *FileIndex) expiredKeys() (res []string) {
+	// read lock on index
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	now := time.Now()
+	for key := range i.expiry {
+		if i.isExpired(key, now) {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// Reap deletes all expired keys and returns how many were deleted
+func (i *FileIndex) Reap() int {
+	deleted := 0
+	for _, key := range i.expiredKeys() {
+		// read lock on index
+		i.mu.RLock()
+		file, ok := i.index[key]
+		i.mu.RUnlock()
+
+		if !ok {
+			file = &File{FileName: key}
+		}
+
+		err := i.Delete(file, i.stillExpired(key))
+
+		// expired keys that are already gone only need their expiry removed
+		if os.IsNotExist(err) {
+			file.mu.Lock()
+			i.clearExpiry(file)
+			file.mu.Unlock()
+			continue
+		}
+
+		if err != nil {
+			if err != ErrPreconditionFailed {
+				log.Warn("err deleting expired key '%s': %s", key, err.Error())
+			}
+			continue
+		}
+		deleted++
+	}
+
+	return deleted
+}
+
+// stillExpired is a precondition that makes sure key wasn't given
+// a new expiry or rewritten after being picked for reaping
+func (i *FileIndex) stillExpired(key string) Precondition {
+	return func(content []byte, exists bool) error {
+		// read lock on index
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+
+		if i.isExpired(key, time.Now()) {
+			return nil
+		}
+		return ErrPreconditionFailed
+	}
+}
+
+// StartReaper deletes expired keys every interval in the background until
+// the returned stop function is called
+func (i *FileIndex) StartReaper(interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer close(stopped)
+
+		for {
+			select {
+			case <-ticker.C:
+				if n := i.Reap(); n > 0 {
+					log.Info("deleted %d expired keys", n)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-stopped
+	}
+}
@@ -0,0 +1,137 @@
+package index
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// expireNow makes key expire in the past without waiting
+func expireNow(t *testing.T, key string) {
+	t.Helper()
+
+	assertNilErr(t, I.Expire(key, -time.Second))
+}
+
+func TestFileIndex_Expire(t *testing.T) {
+	t.Run("expire non-existent key", func(t *testing.T) {
+		setup()
+
+		err := I.Expire("doesnt_exist", time.Minute)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("expired keys are hidden from lookup and list", func(t *testing.T) {
+		setup()
+
+		createAndReturnFile(t, "expired")
+		createAndReturnFile(t, "alive")
+		expireNow(t, "expired")
+		assertNilErr(t, I.Expire("alive", time.Minute))
+
+		_, ok := I.Lookup("expired")
+		assert.False(t, ok)
+		_, ok = I.Lookup("alive")
+		assert.True(t, ok)
+		checkDeepEquals(t, I.List(), []string{"alive"})
+
+		ttl, ok := I.TTL("alive")
+		assert.True(t, ok)
+		assert.True(t, ttl > 0 && ttl <= time.Minute)
+	})
+
+	t.Run("expiry survives regenerate", func(t *testing.T) {
+		setup()
+
+		createAndReturnFile(t, "expired")
+		expireNow(t, "expired")
+		I.Regenerate()
+
+		_, ok := I.Lookup("expired")
+		assert.False(t, ok)
+	})
+
+	t.Run("put clears expiry", func(t *testing.T) {
+		setup()
+
+		file := createAndReturnFile(t, "rewritten")
+		expireNow(t, "rewritten")
+		assertNilErr(t, I.Put(file, []byte("{}")))
+
+		_, ok := I.Lookup("rewritten")
+		assert.True(t, ok)
+		_, ok = I.TTL("rewritten")
+		assert.False(t, ok)
+	})
+
+	t.Run("put with a ttl writes the expiry along with the document", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.OpenJournal())
+
+		file := createAndReturnFile(t, "short_lived")
+		assertNilErr(t, I.PutWithTTL(file, []byte(`{"v":2}`), time.Minute))
+
+		ttl, ok := I.TTL("short_lived")
+		assert.True(t, ok)
+		assert.True(t, ttl > 0 && ttl <= time.Minute)
+
+		entries, err := I.Entries()
+		assertNilErr(t, err)
+		if expires := entries[len(entries)-1].Expires; assert.NotNil(t, expires) {
+			left := time.Until(*expires)
+			assert.True(t, left > 0 && left <= time.Minute)
+		}
+		assertNilErr(t, I.CloseJournal())
+
+		// the expiry is on disk too
+		I.Regenerate()
+		_, ok = I.TTL("short_lived")
+		assert.True(t, ok)
+	})
+}
+
+func TestFileIndex_Reap(t *testing.T) {
+	t.Run("reap deletes only expired keys", func(t *testing.T) {
+		setup()
+
+		createAndReturnFile(t, "expired")
+		createAndReturnFile(t, "alive")
+		expireNow(t, "expired")
+		assertNilErr(t, I.Expire("alive", time.Minute))
+
+		checkDeepEquals(t, I.Reap(), 1)
+		assertFileDoesNotExist(t, "expired")
+		assertFileExists(t, "alive")
+		checkKeyNotInIndex(t, "expired")
+
+		_, ok := I.TTL("expired")
+		assert.False(t, ok)
+	})
+
+	t.Run("reap forgets expiry of keys removed by hand", func(t *testing.T) {
+		setup()
+
+		createAndReturnFile(t, "gone")
+		expireNow(t, "gone")
+		assertNilErr(t, I.FileSystem.Remove("gone.json"))
+
+		checkDeepEquals(t, I.Reap(), 0)
+		_, ok := I.TTL("gone")
+		assert.False(t, ok)
+	})
+
+	t.Run("reaper runs in the background", func(t *testing.T) {
+		setup()
+
+		createAndReturnFile(t, "background")
+		assertNilErr(t, I.Expire("background", 10*time.Millisecond))
+
+		stop := I.StartReaper(5 * time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		stop()
+
+		assertFileDoesNotExist(t, "background")
+	})
+}
@@ -0,0 +1,235 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// formats documents can be exported to and imported from
+const (
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+// what to do when an imported key already exists
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictFail      = "fail"
+)
+
+// exportRecord is a single document in an ndjson export
+type exportRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// ImportStats counts what happened to the documents of an import
+type ImportStats struct {
+	Imported int
+	Skipped  int
+}
+
+// checkFormat returns an error if format isn't a supported format
+func checkFormat(format string) error {
+	if format != FormatNDJSON && format != FormatCSV {
+		return fmt.Errorf("unknown format '%s', must be %s or %s", format, FormatNDJSON, FormatCSV)
+	}
+	return nil
+}
+
+// Export writes every document to w one at a time in the given format,
+// with references resolved to depth. ndjson has one {"key", "value"} object
+// per line, csv has a key and value column holding the document as json.
+// Documents that aren't json are skipped. Returns the number exported
+func (i *FileIndex) Export(w io.Writer, format string, depth int) (int, error) {
+	if err := checkFormat(format); err != nil {
+		return 0, err
+	}
+
+	buf := bufio.NewWriter(w)
+	csvWriter := csv.NewWriter(buf)
+	if format == FormatCSV {
+		if err := csvWriter.Write([]string{"key", "value"}); err != nil {
+			return 0, err
+		}
+	}
+
+	keys := i.List()
+	sort.Strings(keys)
+
+	count := 0
+	for _, key := range keys {
+		value, err := i.exportValue(key, depth)
+		if err != nil {
+			log.Warn("skipping key '%s': %s", key, err.Error())
+			continue
+		}
+
+		if format == FormatCSV {
+			err = csvWriter.Write([]string{key, string(value)})
+		} else {
+			var line []byte
+			line, err = json.Marshal(exportRecord{Key: key, Value: value})
+			if err == nil {
+				_, err = buf.Write(append(line, '\n'))
+			}
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return count, err
+	}
+	return count, buf.Flush()
+}
+
+// exportValue returns the compact json of key with references resolved to depth
+func (i *FileIndex) exportValue(key string, depth int) ([]byte, error) {
+	file, ok := i.Lookup(key)
+	if !ok {
+		return nil, fmt.Errorf("key no longer exists")
+	}
+
+	jsonMap, err := file.ToMap()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ResolveReferences(jsonMap, depth))
+}
+
+// Import reads documents in the given format from r, as written by Export,
+// and puts them into the index. The whole input is checked before anything
+// is written. policy decides what happens to keys that already exist
+func (i *FileIndex) Import(r io.Reader, format string, policy string) (ImportStats, error) {
+	stats := ImportStats{}
+	if err := checkFormat(format); err != nil {
+		return stats, err
+	}
+	if policy != ConflictSkip && policy != ConflictOverwrite && policy != ConflictFail {
+		return stats, fmt.Errorf("unknown conflict policy '%s', must be %s, %s or %s", policy, ConflictSkip, ConflictOverwrite, ConflictFail)
+	}
+
+	var records []exportRecord
+	var err error
+	if format == FormatCSV {
+		records, err = readCSVRecords(r)
+	} else {
+		records, err = readNDJSONRecords(r)
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	if policy == ConflictFail {
+		for _, rec := range records {
+			if _, exists := i.Lookup(rec.Key); exists {
+				return stats, fmt.Errorf("key '%s' already exists, nothing was imported", rec.Key)
+			}
+		}
+	}
+
+	for _, rec := range records {
+		var conds []Precondition
+		if policy != ConflictOverwrite {
+			conds = append(conds, IfNoneMatch([]string{"*"}))
+		}
+
+		file, _ := i.Lookup(rec.Key)
+		err := i.Put(file, rec.Value, conds...)
+		if err == ErrPreconditionFailed && policy == ConflictSkip {
+			stats.Skipped++
+			continue
+		}
+		if err != nil {
+			return stats, fmt.Errorf("err importing key '%s': %s", rec.Key, err.Error())
+		}
+		stats.Imported++
+	}
+
+	return stats, nil
+}
+
+// checkRecord makes sure rec can be imported, compacting its value. seen
+// holds the keys of the records before it, which rec can't repeat
+func checkRecord(rec *exportRecord, line int, seen map[string]bool) error {
+	if err := ValidateKey(rec.Key); err != nil {
+		return fmt.Errorf("line %d: %s", line, err.Error())
+	}
+	if seen[rec.Key] {
+		return fmt.Errorf("line %d: key '%s' appears more than once", line, rec.Key)
+	}
+	seen[rec.Key] = true
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, rec.Value); err != nil {
+		return fmt.Errorf("line %d: value of key '%s' is not valid json", line, rec.Key)
+	}
+	if err := ParseDocument(compact.Bytes()); err != nil {
+		return fmt.Errorf("line %d: value of key '%s' must be a json object", line, rec.Key)
+	}
+	rec.Value = compact.Bytes()
+	return nil
+}
+
+// readNDJSONRecords parses one {"key", "value"} object per line
+func readNDJSONRecords(r io.Reader) ([]exportRecord, error) {
+	res := []exportRecord{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var rec exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		if err := checkRecord(&rec, line, seen); err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+
+	return res, scanner.Err()
+}
+
+// readCSVRecords parses a csv with a key and value column
+func readCSVRecords(r io.Reader) ([]exportRecord, error) {
+	reader := csv.NewReader(r)
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 || len(rows[0]) != 2 || rows[0][0] != "key" || rows[0][1] != "value" {
+		return nil, fmt.Errorf("csv must start with a 'key,value' header")
+	}
+
+	res := []exportRecord{}
+	seen := map[string]bool{}
+	for n, row := range rows[1:] {
+		rec := exportRecord{Key: row[0], Value: json.RawMessage(row[1])}
+		if err := checkRecord(&rec, n+2, seen); err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+	return res, nil
+}
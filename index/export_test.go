@@ -0,0 +1,126 @@
+package index
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupExportDocs() {
+	setup()
+	makeNewJSON("a", map[string]interface{}{"ref": "REF::b"})
+	makeNewJSON("b", map[string]interface{}{"text": "hi, \"there\""})
+	makeNewFile("broken.json", "not json")
+	I.Regenerate()
+}
+
+func TestFileIndex_Export(t *testing.T) {
+	t.Run("ndjson", func(t *testing.T) {
+		setupExportDocs()
+
+		var buf bytes.Buffer
+		count, err := I.Export(&buf, FormatNDJSON, 0)
+		assertNilErr(t, err)
+		assert.Equal(t, 2, count)
+		assert.Equal(t, `{"key":"a","value":{"ref":"REF::b"}}`+"\n"+
+			`{"key":"b","value":{"text":"hi, \"there\""}}`+"\n", buf.String())
+	})
+
+	t.Run("csv with resolved references", func(t *testing.T) {
+		setupExportDocs()
+
+		var buf bytes.Buffer
+		count, err := I.Export(&buf, FormatCSV, 1)
+		assertNilErr(t, err)
+		assert.Equal(t, 2, count)
+		assert.Equal(t, "key,value\n"+
+			`a,"{""ref"":{""text"":""hi, \""there\""""}}"`+"\n"+
+			`b,"{""text"":""hi, \""there\""""}"`+"\n", buf.String())
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		setupExportDocs()
+
+		_, err := I.Export(&bytes.Buffer{}, "xml", 0)
+		assertErr(t, err)
+	})
+}
+
+func TestFileIndex_Import(t *testing.T) {
+	ndjson := `{"key":"a","value":{"n":2}}` + "\n\n" + `{"key":"c","value": {"n": 3}}` + "\n"
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, format := range []string{FormatNDJSON, FormatCSV} {
+			setupExportDocs()
+
+			var buf bytes.Buffer
+			_, err := I.Export(&buf, format, 0)
+			assertNilErr(t, err)
+
+			setup()
+			stats, err := I.Import(&buf, format, ConflictFail)
+			assertNilErr(t, err)
+			assert.Equal(t, ImportStats{Imported: 2}, stats)
+			checkContentEqual(t, "a", map[string]interface{}{"ref": "REF::b"})
+			checkContentEqual(t, "b", map[string]interface{}{"text": "hi, \"there\""})
+		}
+	})
+
+	t.Run("skip existing", func(t *testing.T) {
+		setupExportDocs()
+
+		stats, err := I.Import(strings.NewReader(ndjson), FormatNDJSON, ConflictSkip)
+		assertNilErr(t, err)
+		assert.Equal(t, ImportStats{Imported: 1, Skipped: 1}, stats)
+		checkContentEqual(t, "a", map[string]interface{}{"ref": "REF::b"})
+		checkContentEqual(t, "c", map[string]interface{}{"n": 3})
+	})
+
+	t.Run("overwrite existing", func(t *testing.T) {
+		setupExportDocs()
+
+		stats, err := I.Import(strings.NewReader(ndjson), FormatNDJSON, ConflictOverwrite)
+		assertNilErr(t, err)
+		assert.Equal(t, ImportStats{Imported: 2}, stats)
+		checkContentEqual(t, "a", map[string]interface{}{"n": 2})
+	})
+
+	t.Run("fail on existing writes nothing", func(t *testing.T) {
+		setupExportDocs()
+
+		_, err := I.Import(strings.NewReader(ndjson), FormatNDJSON, ConflictFail)
+		assertErr(t, err)
+		checkKeyNotInIndex(t, "c")
+	})
+
+	t.Run("invalid input writes nothing", func(t *testing.T) {
+		invalid := []struct {
+			format string
+			input  string
+		}{
+			{FormatNDJSON, `{"key":"c","value":{}}` + "\n" + `{"key":"d","value":`},
+			{FormatNDJSON, `{"value":{}}`},
+			{FormatCSV, "key,value\nc,{}\nd,not json"},
+			{FormatCSV, "name,body\nc,{}"},
+			{FormatNDJSON + "2", ""},
+			{FormatNDJSON, `{"key":"c","value":{}}` + "\n" + `{"key":"../escaped","value":{}}`},
+			{FormatCSV, "key,value\nc,{}\n.history,{}"},
+			{FormatNDJSON, `{"key":"c","value":{}}` + "\n" + `{"key":"d","value":[1,2]}`},
+			{FormatCSV, "key,value\nc,{}\nd,5"},
+			{FormatNDJSON, `{"key":"c","value":{}}` + "\n" + `{"key":"c","value":{"n":2}}`},
+		}
+
+		for _, tc := range invalid {
+			setup()
+			_, err := I.Import(strings.NewReader(tc.input), tc.format, ConflictFail)
+			assertErr(t, err)
+			checkKeyNotInIndex(t, "c")
+			assertFileDoesNotExist(t, "../escaped")
+		}
+
+		_, err := I.Import(strings.NewReader(ndjson), FormatNDJSON, "replace")
+		assertErr(t, err)
+	})
+}
@@ -0,0 +1,220 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// fieldIndex maps the values of a single document field to the keys
+// of the documents holding that value
+type fieldIndex struct {
+	segments []string
+
+	// value -> set of keys
+	keys map[string]map[string]bool
+	// key -> values currently indexed for it
+	values map[string][]string
+}
+
+func newFieldIndex(path string) *fieldIndex {
+	return &fieldIndex{
+		segments: SplitPath(path),
+		keys:     map[string]map[string]bool{},
+		values:   map[string][]string{},
+	}
+}
+
+// IndexValue returns the string form of a json value used as a lookup key in
+// field indexes. Strings are used as is, anything else is encoded as json
+func IndexValue(val interface{}) string {
+	if s, ok := val.(string); ok {
+		return s
+	}
+
+	b, _ := json.Marshal(val)
+	return string(b)
+}
+
+// update replaces the entries of key with the values found in doc,
+// a nil doc removes key entirely
+func (fi *fieldIndex) update(key string, doc map[string]interface{}) {
+	for _, val := range fi.values[key] {
+		delete(fi.keys[val], key)
+		if len(fi.keys[val]) == 0 {
+			delete(fi.keys, val)
+		}
+	}
+	delete(fi.values, key)
+
+	if doc == nil {
+		return
+	}
+
+	val, ok := GetPath(doc, fi.segments)
+	if !ok {
+		return
+	}
+
+	// every element of an array is indexed on its own
+	vals := []interface{}{val}
+	if arr, isArr := val.([]interface{}); isArr {
+		vals = arr
+	}
+
+	for _, v := range vals {
+		s := IndexValue(v)
+		if fi.keys[s] == nil {
+			fi.keys[s] = map[string]bool{}
+		}
+		fi.keys[s][key] = true
+		fi.values[key] = append(fi.values[key], s)
+	}
+}
+
+// AddFieldIndex starts maintaining an index of all documents by the value
+// at the dotted field path, e.g. email or profile.country
+func (i *FileIndex) AddFieldIndex(path string) {
+	start := time.Now()
+	fi := newFieldIndex(path)
+
+	// write lock on index
+	i.mu.Lock()
+	i.fields[path] = fi
+	i.mu.Unlock()
+
+	i.indexDocuments([]*fieldIndex{fi}, nil)
+	log.Info("built index on field '%s' in %d ms", path, time.Since(start).Milliseconds())
+}
+
+// IndexedFields returns the paths of all indexed fields
+func (i *FileIndex) IndexedFields() (res []string) {
+	// read lock on index
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for path := range i.fields {
+		res = append(res, path)
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+// FindByField returns the sorted keys of all documents where the field at
+// path holds value. ok is false if path isn't indexed
+func (i *FileIndex) FindByField(path string, value string) (res []string, ok bool) {
+	// read lock on index
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	fi, ok := i.fields[path]
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+	res = []string{}
+	for key := range fi.keys[value] {
+		if !i.isExpired(key, now) {
+			res = append(res, key)
+		}
+	}
+
+	sort.Strings(res)
+	return res, true
+}
+
+// updateIndexes reindexes key with its new contents in the field and
+// full-text indexes, the schemas, the webhooks and the redaction rules,
+// nil if deleted
+func (i *FileIndex) updateIndexes(key string, doc map[string]interface{}) {
+	// write lock on index
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, fi := range i.fields {
+		fi.update(key, doc)
+	}
+	i.text.update(key, doc)
+	i.updateSchema(key, doc)
+	i.updateWebhooks(key, doc)
+	i.updateRedactions(key, doc)
+}
+
+// resetFields empties every field index so it can be rebuilt with
+// indexDocuments. Callers must hold i.mu
+func (i *FileIndex) resetFields() (res []*fieldIndex) {
+	for path := range i.fields {
+		i.fields[path] = newFieldIndex(path)
+		res = append(res, i.fields[path])
+	}
+	return res
+}
+
+// indexDocuments adds every document in the index to fis and text, if not nil.
+// Each file is read locked while it is indexed so concurrent writes aren't missed
+func (i *FileIndex) indexDocuments(fis []*fieldIndex, text *textIndex) {
+	if len(fis) == 0 && text == nil {
+		return
+	}
+
+	// read lock on index
+	i.mu.RLock()
+	files := make(map[string]*File, len(i.index))
+	for key, file := range i.index {
+		files[key] = file
+	}
+	i.mu.RUnlock()
+
+	for key, file := range files {
+		file.mu.RLock()
+		doc := readDocMap(file)
+
+		// write lock on index
+		i.mu.Lock()
+		for _, fi := range fis {
+			fi.update(key, doc)
+		}
+		if text != nil {
+			text.update(key, doc)
+		}
+		i.mu.Unlock()
+
+		file.mu.RUnlock()
+	}
+}
+
+// readDocMap returns the parsed contents of file or nil if it isn't a json
+// object. Callers must hold file.mu
+func readDocMap(file *File) map[string]interface{} {
+	m, err := file.toMap()
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// ParseDocument makes sure b is a json object so it can be stored as a document
+func ParseDocument(b []byte) error {
+	var jsonVal interface{}
+	if err := json.Unmarshal(b, &jsonVal); err != nil {
+		return err
+	}
+	if _, ok := jsonVal.(map[string]interface{}); !ok {
+		return fmt.Errorf("value is not an object")
+	}
+	return nil
+}
+
+// parseDocMap parses b as a json object, nil if it isn't one
+func parseDocMap(b []byte) map[string]interface{} {
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,104 @@
+package index
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func findByField(t *testing.T, path string, value string) []string {
+	t.Helper()
+
+	keys, ok := I.FindByField(path, value)
+	assert.True(t, ok)
+	return keys
+}
+
+func TestIndexValue(t *testing.T) {
+	checkDeepEquals(t, IndexValue("text"), "text")
+	checkDeepEquals(t, IndexValue(float64(42)), "42")
+	checkDeepEquals(t, IndexValue(true), "true")
+	checkDeepEquals(t, IndexValue(nil), "null")
+}
+
+func TestFileIndex_FindByField(t *testing.T) {
+	alice := map[string]interface{}{
+		"email":   "alice@example.com",
+		"profile": map[string]interface{}{"country": "CA"},
+		"tags":    []interface{}{"admin", "staff"},
+	}
+	bob := map[string]interface{}{
+		"email":   "bob@example.com",
+		"profile": map[string]interface{}{"country": "CA"},
+		"age":     30,
+	}
+
+	t.Run("unindexed field", func(t *testing.T) {
+		setup()
+
+		_, ok := I.FindByField("email", "alice@example.com")
+		assert.False(t, ok)
+	})
+
+	t.Run("index built from existing documents", func(t *testing.T) {
+		setup()
+		makeNewJSON("alice", alice)
+		makeNewJSON("bob", bob)
+		makeNewFile("broken.json", "not json")
+		I.Regenerate()
+
+		I.AddFieldIndex("email")
+		I.AddFieldIndex("profile.country")
+		I.AddFieldIndex("age")
+		I.AddFieldIndex("tags")
+
+		checkDeepEquals(t, I.IndexedFields(), []string{"age", "email", "profile.country", "tags"})
+		checkDeepEquals(t, findByField(t, "email", "alice@example.com"), []string{"alice"})
+		checkDeepEquals(t, findByField(t, "profile.country", "CA"), []string{"alice", "bob"})
+		checkDeepEquals(t, findByField(t, "age", "30"), []string{"bob"})
+		checkDeepEquals(t, findByField(t, "tags", "staff"), []string{"alice"})
+		checkDeepEquals(t, findByField(t, "email", "nobody"), []string{})
+	})
+
+	t.Run("index follows put, patch and delete", func(t *testing.T) {
+		setup()
+		I.AddFieldIndex("email")
+
+		file := &File{FileName: "alice"}
+		assertNilErr(t, I.Put(file, []byte(mapToString(alice))))
+		checkDeepEquals(t, findByField(t, "email", "alice@example.com"), []string{"alice"})
+
+		_, err := I.PatchField(file, "email", "new@example.com")
+		assertNilErr(t, err)
+		checkDeepEquals(t, findByField(t, "email", "alice@example.com"), []string{})
+		checkDeepEquals(t, findByField(t, "email", "new@example.com"), []string{"alice"})
+
+		assertNilErr(t, I.Put(file, []byte("not json")))
+		checkDeepEquals(t, findByField(t, "email", "new@example.com"), []string{})
+
+		assertNilErr(t, I.Put(file, []byte(mapToString(alice))))
+		assertNilErr(t, I.Delete(file))
+		checkDeepEquals(t, findByField(t, "email", "alice@example.com"), []string{})
+	})
+
+	t.Run("index is rebuilt on regenerate", func(t *testing.T) {
+		setup()
+		I.AddFieldIndex("email")
+
+		makeNewJSON("bob", bob)
+		checkDeepEquals(t, findByField(t, "email", "bob@example.com"), []string{})
+
+		I.Regenerate()
+		checkDeepEquals(t, findByField(t, "email", "bob@example.com"), []string{"bob"})
+	})
+
+	t.Run("expired keys are not returned", func(t *testing.T) {
+		setup()
+		I.AddFieldIndex("email")
+
+		assertNilErr(t, I.Put(&File{FileName: "bob"}, []byte(mapToString(bob))))
+		assertNilErr(t, I.Expire("bob", -time.Second))
+		checkDeepEquals(t, findByField(t, "email", "bob@example.com"), []string{})
+	})
+}
@@ -0,0 +1,129 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	af "github.com/spf13/afero"
+)
+
+// HistoryDir is the hidden folder inside the database directory that
+// holds previous versions of documents
+const HistoryDir = ".history"
+
+// DefaultHistoryLimit is the default number of previous versions kept per key
+const DefaultHistoryLimit = 10
+
+// Version describes a single saved revision of a document
+type Version struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+// SetHistoryLimit sets how many previous versions are kept for every key,
+// 0 disables history entirely
+func (i *FileIndex) SetHistoryLimit(n int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.historyLimit = n
+}
+
+// historyPath returns the folder holding previous versions of key
+func historyPath(key string) string {
+	return filepath.Join(I.dir, HistoryDir, key)
+}
+
+// versionPath returns the location of a single version of key
+func versionPath(key string, version int) string {
+	return filepath.Join(historyPath(key), fmt.Sprintf("%d.json", version))
+}
+
+// History returns all saved versions of key, oldest first
+func (i *FileIndex) History(key string) ([]Version, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+
+	files, err := af.ReadDir(i.FileSystem, historyPath(key))
+	if os.IsNotExist(err) {
+		return []Version{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := []Version{}
+	for _, file := range files {
+		n, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		res = append(res, Version{Version: n, Time: file.ModTime()})
+	}
+
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Version < res[b].Version
+	})
+	return res, nil
+}
+
+// GetVersion returns the contents of a saved version of key
+func (i *FileIndex) GetVersion(key string, version int) ([]byte, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+	return af.ReadFile(i.FileSystem, versionPath(key, version))
+}
+
+// saveVersion copies the current contents of f into its history and drops
+// versions beyond the history limit. Does nothing if f doesn't exist yet.
+// Callers must hold f.mu
+func (f *File) saveVersion() error {
+	limit := I.historyLimit
+	if limit < 1 {
+		return nil
+	}
+
+	current, err := f.readBytes()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	versions, err := I.History(f.FileName)
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+
+	err = I.FileSystem.MkdirAll(historyPath(f.FileName), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = af.WriteFile(I.FileSystem, versionPath(f.FileName, next), current, 0644)
+	if err != nil {
+		return err
+	}
+
+	// prune oldest versions, accounting for the one just saved
+	versions = append(versions, Version{Version: next})
+	for len(versions) > limit {
+		_ = I.FileSystem.Remove(versionPath(f.FileName, versions[0].Version))
+		versions = versions[1:]
+	}
+
+	return nil
+}
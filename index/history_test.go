@@ -0,0 +1,97 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func versionNumbers(t *testing.T, key string) (res []int) {
+	t.Helper()
+
+	versions, err := I.History(key)
+	assertNilErr(t, err)
+	for _, v := range versions {
+		res = append(res, v.Version)
+	}
+	return res
+}
+
+func TestFileIndex_History(t *testing.T) {
+	t.Run("no history without a limit", func(t *testing.T) {
+		setup()
+
+		file := createAndReturnFile(t, "no_history")
+		assertNilErr(t, I.Put(file, []byte("{}")))
+
+		checkDeepEquals(t, len(versionNumbers(t, "no_history")), 0)
+	})
+
+	t.Run("put, patch and delete save previous versions", func(t *testing.T) {
+		setup()
+		I.SetHistoryLimit(5)
+
+		file := &File{FileName: "history"}
+		assertNilErr(t, I.Put(file, []byte(`{"v":1}`)))
+		assertNilErr(t, I.Put(file, []byte(`{"v":2}`)))
+		_, err := I.PatchField(file, "v", 3)
+		assertNilErr(t, err)
+		assertNilErr(t, I.Delete(file))
+
+		checkDeepEquals(t, versionNumbers(t, "history"), []int{1, 2, 3})
+		for n, want := range []string{`{"v":1}`, `{"v":2}`, `{"v":3}`} {
+			got, err := I.GetVersion("history", n+1)
+			assertNilErr(t, err)
+			checkDeepEquals(t, string(got), want)
+		}
+
+		// history is kept in a hidden folder that isn't indexed
+		I.Regenerate()
+		checkDeepEquals(t, len(I.List()), 0)
+	})
+
+	t.Run("only the most recent versions are kept", func(t *testing.T) {
+		setup()
+		I.SetHistoryLimit(2)
+
+		file := &File{FileName: "pruned"}
+		for n := 1; n <= 5; n++ {
+			assertNilErr(t, I.Put(file, []byte(fmt.Sprintf(`{"v":%d}`, n))))
+		}
+
+		checkDeepEquals(t, versionNumbers(t, "pruned"), []int{3, 4})
+		_, err := I.GetVersion("pruned", 1)
+		assertErr(t, err)
+	})
+
+	t.Run("history lives inside the database directory", func(t *testing.T) {
+		setup()
+		I.dir = "db"
+		I.SetHistoryLimit(1)
+
+		file := &File{FileName: "nested"}
+		assertNilErr(t, I.Put(file, []byte("{}")))
+		assertNilErr(t, I.Put(file, []byte("{}")))
+
+		assertFileExists(t, "db/.history/nested/1")
+	})
+
+	t.Run("keys can't reach outside the history folder", func(t *testing.T) {
+		setup()
+		I.SetHistoryLimit(1)
+		makeNewFile("secret/1.json", `{"secret":true}`)
+
+		_, err := I.GetVersion("../secret", 1)
+		assert.True(t, errors.Is(err, ErrInvalidKey))
+		_, err = I.History("../secret")
+		assert.True(t, errors.Is(err, ErrInvalidKey))
+
+		// saving a version would write secret/2.json and prune secret/1.json
+		file := makeNewJSON("../secret", map[string]interface{}{})
+		assert.True(t, errors.Is(I.Put(file, []byte("{}")), ErrInvalidKey))
+		assertFileExists(t, "secret/1")
+		assertFileDoesNotExist(t, "secret/2")
+	})
+}
@@ -2,7 +2,9 @@
 package index
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"sync"
 	"time"
 
@@ -19,6 +21,13 @@ func NewFileIndex(dir string) *FileIndex {
 	return &FileIndex{
 		dir:        dir,
 		index:      map[string]*File{},
+		expiry:     map[string]time.Time{},
+		fields:     map[string]*fieldIndex{},
+		text:       newTextIndex(),
+		schemas:    map[string]*schemaBinding{},
+		changes:    newChangeFeed(DefaultChangeBuffer),
+		webhooks:   newWebhookDispatcher(),
+		durability: DurabilityPerWrite,
 		FileSystem: af.NewOsFs(),
 	}
 }
@@ -28,6 +37,31 @@ type FileIndex struct {
 	mu         sync.RWMutex
 	dir        string
 	index      map[string]*File
+	journal    *Journal
+	durability Durability
+	syncer     *groupSyncer
+
+	// number of previous versions to keep per key
+	historyLimit int
+
+	// when keys with a ttl expire
+	expiry map[string]time.Time
+
+	// secondary indexes by field path
+	fields map[string]*fieldIndex
+	// full-text index over string values
+	text *textIndex
+
+	// schemas by the key of the document holding them
+	schemas map[string]*schemaBinding
+	// rules applied to documents inlined by ResolveReferences
+	redactions []redactionRule
+
+	// recent changes and their subscribers
+	changes *changeFeed
+	// targets changes are delivered to
+	webhooks *webhookDispatcher
+
 	FileSystem af.Fs
 }
 
@@ -48,8 +82,11 @@ func (i *FileIndex) List() (res []string) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
+	now := time.Now()
 	for k := range i.index {
-		res = append(res, k)
+		if !i.isExpired(k, now) {
+			res = append(res, k)
+		}
 	}
 
 	return res
@@ -63,23 +100,240 @@ func (i *FileIndex) Lookup(key string) (*File, bool) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	// get if File exists, return nil and false otherwise
-	if file, ok := i.index[key]; ok {
+	// get if File exists and hasn't expired, return nil and false otherwise
+	if file, ok := i.index[key]; ok && !i.isExpired(key, time.Now()) {
 		return file, true
 	}
 
 	return &File{FileName: key}, false
 }
 
-// Put creates/updates file in the fileindex
-func (i *FileIndex) Put(file *File, bytes []byte) error {
-	// write lock on index
+// Put creates/updates file in the fileindex. The write only happens
+// if all conds hold for the current contents of file
+func (i *FileIndex) Put(file *File, bytes []byte, conds ...Precondition) error {
+	return i.PutWithTTL(file, bytes, 0, conds...)
+}
+
+// PutWithTTL puts file like Put, deleting it once ttl has passed. The expiry
+// is written along with the document, a ttl of 0 removes any previous one
+func (i *FileIndex) PutWithTTL(file *File, bytes []byte, ttl time.Duration, conds ...Precondition) error {
+	// write lock on file, adding the key to the index if missing
+	file, err := i.claim(file, true)
+	if err != nil {
+		return err
+	}
+	defer file.mu.Unlock()
+	journal := i.activeJournal()
+
+	err = file.checkPreconditions(conds)
+	if err == nil {
+		err = i.Validate(file.FileName, bytes)
+	}
+	if err != nil {
+		i.unclaimIfMissing(file)
+		return err
+	}
+
+	entry := JournalEntry{Op: OpPut, Key: file.FileName, Data: string(bytes)}
+	if ttl > 0 {
+		at := time.Now().Add(ttl)
+		entry.Expires = &at
+	}
+
+	// record intent before touching the file
+	seq, err := journal.record(entry)
+	if err != nil {
+		return err
+	}
+
+	changeType := ChangeUpdate
+	if !i.isLive(file) {
+		changeType = ChangeCreate
+	}
+
+	err = file.saveVersion()
+	if err == nil {
+		err = file.writeAtomic(bytes)
+	}
+
+	// a new document starts without a ttl unless one is given
+	if err == nil && entry.Expires != nil {
+		err = i.setExpiry(file, *entry.Expires)
+	} else if err == nil {
+		i.clearExpiry(file)
+	}
+	journal.finish(seq, err)
+
+	if err == nil {
+		doc := parseDocMap(bytes)
+		i.updateIndexes(file.FileName, doc)
+		i.publish(changeType, file.FileName, doc)
+	}
+	return err
+}
+
+// PatchField sets the field at path inside file to value, creating any
+// missing objects along the way. path is dotted or an escaped json pointer,
+// see ParseFieldPath. The write only happens if all conds hold for the
+// current contents of file. Returns the ETag of the new contents
+func (i *FileIndex) PatchField(file *File, path string, value interface{}, conds ...Precondition) (string, error) {
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	entry := JournalEntry{Op: OpPatch, Key: file.FileName, Field: path, Value: valueJSON}
+	return i.modify(file, entry, conds, func(jsonMap map[string]interface{}) (map[string]interface{}, error) {
+		return jsonMap, applyFieldEntry(jsonMap, entry)
+	})
+}
+
+// DeleteField removes the field at path inside file. The write only happens
+// if all conds hold for the current contents of file. Returns the ETag of
+// the new contents
+func (i *FileIndex) DeleteField(file *File, path string, conds ...Precondition) (string, error) {
+	entry := JournalEntry{Op: OpDeleteField, Key: file.FileName, Field: path}
+	return i.modify(file, entry, conds, func(jsonMap map[string]interface{}) (map[string]interface{}, error) {
+		return jsonMap, applyFieldEntry(jsonMap, entry)
+	})
+}
+
+// modify replaces the json document of file with the result of apply as a
+// single read-modify-write, recording entry in the journal. Returns the ETag
+// of the new contents
+func (i *FileIndex) modify(file *File, entry JournalEntry, conds []Precondition, apply func(map[string]interface{}) (map[string]interface{}, error)) (string, error) {
+	// file stays write locked for the whole read-modify-write
+	file, err := i.claim(file, false)
+	if err != nil {
+		return "", err
+	}
+	defer file.mu.Unlock()
+	journal := i.activeJournal()
+
+	err = file.checkPreconditions(conds)
+	if err != nil {
+		return "", err
+	}
+
+	jsonMap, err := file.toMap()
+	if err != nil {
+		return "", err
+	}
+
+	jsonMap, err = apply(jsonMap)
+	if err != nil {
+		return "", err
+	}
+
+	jsonData, err := json.Marshal(jsonMap)
+	if err != nil {
+		return "", err
+	}
+
+	err = i.Validate(file.FileName, jsonData)
+	if err != nil {
+		return "", err
+	}
+
+	// record the resulting document too so replaying is idempotent,
+	// appending to an array twice would otherwise add two items
+	entry.Data = string(jsonData)
+
+	// record intent before touching the file
+	seq, err := journal.record(entry)
+	if err != nil {
+		return "", err
+	}
+
+	err = file.saveVersion()
+	if err == nil {
+		err = file.writeAtomic(jsonData)
+	}
+	journal.finish(seq, err)
+	if err != nil {
+		return "", err
+	}
+
+	i.updateIndexes(file.FileName, jsonMap)
+	i.publish(ChangeUpdate, file.FileName, jsonMap)
+	return ETag(jsonData), nil
+}
+
+// applyFieldEntry applies the field patch or delete in entry to jsonMap
+func applyFieldEntry(jsonMap map[string]interface{}, entry JournalEntry) error {
+	segments := ParseFieldPath(entry.Field)
+	if entry.Op == OpDeleteField {
+		_, err := DeletePath(jsonMap, segments)
+		return err
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(entry.Value, &value); err != nil {
+		return err
+	}
+	_, err := SetPath(jsonMap, segments, value)
+	return err
+}
+
+// claim returns the indexed File for file's key with its write lock held,
+// adding file to the index if it is missing and add is set. This makes sure
+// all writers of a key share one lock. File locks are always taken before
+// the index lock, never while holding it. Nothing is locked if the key is
+// invalid
+func (i *FileIndex) claim(file *File, add bool) (*File, error) {
+	key := file.FileName
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+
+	for {
+		// read lock on index to find the current file
+		i.mu.RLock()
+		if existing, ok := i.index[key]; ok {
+			file = existing
+		}
+		i.mu.RUnlock()
+
+		file.mu.Lock()
+
+		// make sure the key wasn't claimed by a different file in the meantime
+		i.mu.Lock()
+		current, ok := i.index[key]
+		if ok && current != file {
+			i.mu.Unlock()
+			file.mu.Unlock()
+			continue
+		}
+		if !ok && add {
+			i.index[key] = file
+		}
+		i.mu.Unlock()
+
+		return file, nil
+	}
+}
+
+// activeJournal returns the journal mutations are currently recorded to
+func (i *FileIndex) activeJournal() *Journal {
+	// read lock on index
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.journal
+}
+
+// unclaimIfMissing drops a key added by claim again if its file was never
+// written. Callers must hold file.mu
+func (i *FileIndex) unclaimIfMissing(file *File) {
+	if _, err := file.readBytes(); !os.IsNotExist(err) {
+		return
+	}
+
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	i.index[file.FileName] = file
-	err := file.ReplaceContent(string(bytes))
-	return err
+	if i.index[file.FileName] == file {
+		delete(i.index, file.FileName)
+	}
 }
 
 // ResolvePath returns a string representing the path to file
@@ -95,13 +349,26 @@ func (f *File) ResolvePath() string {
 func (i *FileIndex) Regenerate() {
 	// write lock on index
 	i.mu.Lock()
-	defer i.mu.Unlock()
 
 	start := time.Now()
 	log.Info("building index for directory %s...", i.dir)
 
+	removeTempFiles(i.dir)
 	i.index = i.buildIndexMap()
-	log.Success("built index of %d files in %d ms", len(i.index), time.Since(start).Milliseconds())
+	i.expiry = loadExpiry(i.dir)
+	fields := i.resetFields()
+	i.text = newTextIndex()
+	text := i.text
+	i.schemas = map[string]*schemaBinding{}
+	count := len(i.index)
+	i.mu.Unlock()
+
+	// documents are read without holding the index lock
+	i.indexDocuments(fields, text)
+	i.loadSchemas()
+	i.loadWebhooks()
+	i.loadRedactions()
+	log.Success("built index of %d files in %d ms", count, time.Since(start).Milliseconds())
 }
 
 // RegenerateNew rebuilds the file index at a new given directory
@@ -116,24 +383,55 @@ func (i *FileIndex) buildIndexMap() map[string]*File {
 
 	files := crawlDirectory(i.dir)
 	for _, f := range files {
+		// keep existing entries so their locks stay shared
+		if existing, ok := i.index[f]; ok {
+			newIndexMap[f] = existing
+			continue
+		}
 		newIndexMap[f] = &File{FileName: f}
 	}
 
 	return newIndexMap
 }
 
-// Delete deletes the given file and then removes it from I
-func (i *FileIndex) Delete(file *File) error {
-	// write lock on index
-	i.mu.Lock()
-	defer i.mu.Unlock()
+// Delete deletes the given file and then removes it from I. The delete
+// only happens if all conds hold for the current contents of file
+func (i *FileIndex) Delete(file *File, conds ...Precondition) error {
+	// write lock on file
+	file, err := i.claim(file, false)
+	if err != nil {
+		return err
+	}
+	defer file.mu.Unlock()
+	journal := i.activeJournal()
 
-	// delete first so pointer isn't nil
-	err := file.Delete()
+	err = file.checkPreconditions(conds)
+	if err != nil {
+		return err
+	}
+
+	// record intent before touching the file
+	seq, err := journal.record(JournalEntry{Op: OpDelete, Key: file.FileName})
+	if err != nil {
+		return err
+	}
 
+	// delete first so pointer isn't nil
+	err = file.saveVersion()
 	if err == nil {
-		delete(i.index, file.FileName)
+		err = file.remove()
 	}
+	if err == nil {
+		// write lock on index
+		i.mu.Lock()
+		delete(i.index, file.FileName)
+		i.mu.Unlock()
 
+		i.clearExpiry(file)
+		i.updateIndexes(file.FileName, nil)
+		i.publish(ChangeDelete, file.FileName, nil)
+		err = file.persistRemove()
+	}
+	journal.finish(seq, err)
 	return err
 }
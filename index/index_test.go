@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"testing"
 
+	af "github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -157,6 +158,19 @@ func TestFileIndex_Regenerate(t *testing.T) {
 		assert.True(t, sliceContains(I.List(), "regenerate2"))
 	})
 
+	t.Run("test regenerate cleans up interrupted writes", func(t *testing.T) {
+		setup()
+
+		makeNewFile("regenerate1.json", "test")
+		makeNewFile("regenerate2.json"+tempSuffix, "half written")
+
+		I.Regenerate()
+
+		checkDeepEquals(t, I.List(), []string{"regenerate1"})
+		exists, _ := af.Exists(I.FileSystem, "regenerate2.json"+tempSuffix)
+		assert.False(t, exists)
+	})
+
 	t.Run("test RegenerateNew correctly updates index with files in directory", func(t *testing.T) {
 		setup()
 
@@ -219,3 +233,76 @@ func TestFileIndex_Put(t *testing.T) {
 		checkContentEqual(t, key, newContent)
 	})
 }
+
+func TestFileIndex_PatchField(t *testing.T) {
+	t.Run("patch adds field and keeps the rest", func(t *testing.T) {
+		setup()
+
+		file := makeNewJSON("patch", map[string]interface{}{"field": "value"})
+		I.Regenerate()
+
+		_, err := I.PatchField(file, "new", map[string]interface{}{"nested": "json"})
+		assertNilErr(t, err)
+
+		checkContentEqual(t, "patch", map[string]interface{}{
+			"field": "value",
+			"new":   map[string]interface{}{"nested": "json"},
+		})
+	})
+
+	t.Run("patch of non-json document fails", func(t *testing.T) {
+		setup()
+
+		makeNewFile("patch_bad.json", "not json")
+		_, err := I.PatchField(&File{FileName: "patch_bad"}, "field", "value")
+		assertErr(t, err)
+	})
+
+	t.Run("patch nested field creates missing objects", func(t *testing.T) {
+		setup()
+
+		file := makeNewJSON("patch_nested", map[string]interface{}{"user": map[string]interface{}{"name": "alice"}})
+		I.Regenerate()
+
+		_, err := I.PatchField(file, "user.address.city", "Vancouver")
+		assertNilErr(t, err)
+		_, err = I.PatchField(file, "~1user~1tags", []interface{}{"a"})
+		assertNilErr(t, err)
+
+		checkContentEqual(t, "patch_nested", map[string]interface{}{
+			"user": map[string]interface{}{
+				"name":    "alice",
+				"address": map[string]interface{}{"city": "Vancouver"},
+				"tags":    []interface{}{"a"},
+			},
+		})
+	})
+}
+
+func TestFileIndex_DeleteField(t *testing.T) {
+	t.Run("delete removes nested field", func(t *testing.T) {
+		setup()
+
+		file := makeNewJSON("unset", map[string]interface{}{
+			"user": map[string]interface{}{"name": "alice", "age": 30},
+		})
+		I.Regenerate()
+
+		_, err := I.DeleteField(file, "user.age")
+		assertNilErr(t, err)
+		checkContentEqual(t, "unset", map[string]interface{}{
+			"user": map[string]interface{}{"name": "alice"},
+		})
+	})
+
+	t.Run("delete of missing field fails", func(t *testing.T) {
+		setup()
+
+		file := makeNewJSON("unset", map[string]interface{}{"name": "alice"})
+		I.Regenerate()
+
+		_, err := I.DeleteField(file, "age")
+		assert.Equal(t, ErrFieldNotFound, err)
+		checkContentEqual(t, "unset", map[string]interface{}{"name": "alice"})
+	})
+}
@@ -10,6 +10,9 @@ import (
 	af "github.com/spf13/afero"
 )
 
+// suffix appended to a document path while it is being written
+const tempSuffix = ".tmp"
+
 func crawlDirectory(directory string) []string {
 	files, err := af.ReadDir(I.FileSystem, directory)
 	if err != nil {
@@ -29,9 +32,19 @@ func crawlDirectory(directory string) []string {
 	return res
 }
 
+// ToMap parses the contents of the file into a map
 func (f *File) ToMap() (res map[string]interface{}, err error) {
+	// read lock on file
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.toMap()
+}
+
+// toMap is ToMap without locking, callers must hold f.mu
+func (f *File) toMap() (res map[string]interface{}, err error) {
 	// get bytes
-	bytes, err := f.GetByteArray()
+	bytes, err := f.readBytes()
 	if err != nil {
 		return res, err
 	}
@@ -47,6 +60,11 @@ func (f *File) GetByteArray() ([]byte, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
+	return f.readBytes()
+}
+
+// readBytes is GetByteArray without locking, callers must hold f.mu
+func (f *File) readBytes() ([]byte, error) {
 	return af.ReadFile(I.FileSystem, f.ResolvePath())
 }
 
@@ -56,27 +74,63 @@ func (f *File) ReplaceContent(str string) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// create blank file
-	_, err := I.FileSystem.Create(f.ResolvePath())
+	return f.writeAtomic([]byte(str))
+}
+
+// tempPath returns the path of the scratch file used while writing f
+func (f *File) tempPath() string {
+	return f.ResolvePath() + tempSuffix
+}
+
+// writeAtomic writes b to a temp file next to f, syncs it to disk and then
+// renames it over f so a crash never leaves a truncated document behind
+func (f *File) writeAtomic(b []byte) error {
+	tmp := f.tempPath()
+	file, err := I.FileSystem.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
 
-	file, err := I.FileSystem.OpenFile(f.ResolvePath(), os.O_WRONLY, os.ModeAppend)
+	// write and flush contents before the file becomes visible
+	_, err = file.Write(b)
+	if err == nil && I.durability == DurabilityPerWrite {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		_ = I.FileSystem.Remove(tmp)
 		return err
 	}
 
-	defer file.Close()
+	// let the next group commit sync and swap in the new content
+	if I.durability == DurabilityBatched {
+		return I.syncer.commit(tmp, f.ResolvePath(), I.journal)
+	}
 
-	// appends the given str to the now empty file
-	_, err = file.WriteString(str)
+	// atomically swap in the new content
+	err = I.FileSystem.Rename(tmp, f.ResolvePath())
+	if err == nil && I.durability == DurabilityPerWrite {
+		err = syncDir(filepath.Dir(f.ResolvePath()))
+	}
+	return err
+}
+
+// removeTempFiles deletes any scratch files left behind by interrupted writes
+func removeTempFiles(directory string) {
+	files, err := af.ReadDir(I.FileSystem, directory)
 	if err != nil {
-		return err
+		return
 	}
 
-	// success
-	return nil
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json"+tempSuffix) {
+			path := filepath.Join(directory, file.Name())
+			log.Warnf("removing incomplete write %s", path)
+			_ = I.FileSystem.Remove(path)
+		}
+	}
 }
 
 // Delete tries to remove the file
@@ -86,10 +140,27 @@ func (f *File) Delete() error {
 	defer f.mu.Unlock()
 
 	// tries to delete the file
-	err := I.FileSystem.Remove(f.ResolvePath())
+	err := f.remove()
 	if err != nil {
 		return err
 	}
 
+	return f.persistRemove()
+}
+
+// remove unlinks the file, callers must hold f.mu
+func (f *File) remove() error {
+	return I.FileSystem.Remove(f.ResolvePath())
+}
+
+// persistRemove makes sure a removal is on disk, callers must hold f.mu
+func (f *File) persistRemove() error {
+	switch I.durability {
+	case DurabilityPerWrite:
+		return syncDir(filepath.Dir(f.ResolvePath()))
+	case DurabilityBatched:
+		return I.syncer.commit("", f.ResolvePath(), I.journal)
+	}
+
 	return nil
 }
@@ -3,6 +3,8 @@ package index
 import (
 	"os"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestMain(m *testing.M) {
@@ -134,6 +136,38 @@ func TestReplaceContent(t *testing.T) {
 		assertNilErr(t, err)
 		checkJSONEquals(t, got, new)
 	})
+
+	t.Run("no temp file left after write", func(t *testing.T) {
+		setup()
+
+		f := &File{FileName: "test"}
+		err := f.ReplaceContent(mapToString(map[string]interface{}{
+			"field": "value",
+		}))
+		assertNilErr(t, err)
+
+		_, err = I.FileSystem.Stat(f.tempPath())
+		assert.True(t, os.IsNotExist(err))
+		checkDeepEquals(t, crawlDirectory(""), []string{"test"})
+	})
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	t.Run("removes leftover temp files only", func(t *testing.T) {
+		setup()
+
+		makeNewFile("test.json", "file1")
+		makeNewFile("test.json"+tempSuffix, "half written")
+		makeNewFile("notes.tmp", "unrelated")
+
+		removeTempFiles("")
+
+		assertFileExists(t, "test")
+		_, err := I.FileSystem.Stat("test.json" + tempSuffix)
+		assert.True(t, os.IsNotExist(err))
+		_, err = I.FileSystem.Stat("notes.tmp")
+		assertNilErr(t, err)
+	})
 }
 
 func TestDelete(t *testing.T) {
@@ -0,0 +1,388 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/log"
+	af "github.com/spf13/afero"
+)
+
+// JournalName is the name of the journal file inside the database directory
+const JournalName = "nanodb_journal"
+
+// DefaultJournalCheckpointSize is the size in bytes the journal can grow to
+// before it is emptied the next time no operation is in progress
+const DefaultJournalCheckpointSize = 1 << 20
+
+// types of operations recorded in the journal
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+	OpPatch  = "patch"
+	OpTxn    = "txn"
+
+	// OpDeleteField removes a single field of a document
+	OpDeleteField = "delete_field"
+
+	// markers appended once an operation has been applied or has failed
+	opCommit = "commit"
+	opAbort  = "abort"
+
+	// marker starting an emptied journal, holding the last sequence number
+	opCheckpoint = "checkpoint"
+)
+
+// JournalEntry is a single line in the journal
+type JournalEntry struct {
+	Seq   uint64          `json:"seq"`
+	Op    string          `json:"op"`
+	Time  time.Time       `json:"time"`
+	Key   string          `json:"key,omitempty"`
+	Field string          `json:"field,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Data  string          `json:"data,omitempty"`
+
+	// when a put document expires, nil if it has no ttl
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// the puts and deletes making up a transaction
+	Ops []JournalEntry `json:"ops,omitempty"`
+}
+
+// Journal is an append-only log of every mutation to the index.
+// Operations are recorded before they touch any document and are marked
+// as committed once applied, so incomplete operations can be rolled forward
+// after a crash. Once every operation is done and the journal has grown past
+// checkpointSize it is emptied. A nil Journal records nothing.
+type Journal struct {
+	mu   sync.Mutex
+	file af.File
+	seq  uint64
+
+	// operations recorded but not yet finished
+	open int
+	// bytes in the journal file
+	size           int64
+	checkpointSize int64
+}
+
+// journalPath returns the location of the journal for the given directory
+func journalPath(dir string) string {
+	if dir == "" || dir == "." {
+		return JournalName
+	}
+	return dir + "/" + JournalName
+}
+
+// OpenJournal opens (or creates) the journal in the index directory,
+// rolls forward any operations that were not committed and then starts
+// recording new mutations to it
+func (i *FileIndex) OpenJournal() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	path := journalPath(i.dir)
+	entries, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := I.FileSystem.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	// terminate a torn entry so new entries start on their own line
+	if !endsCleanly(path) {
+		if _, err := file.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	j := &Journal{file: file, size: info.Size(), checkpointSize: DefaultJournalCheckpointSize}
+	if len(entries) > 0 {
+		j.seq = entries[len(entries)-1].Seq
+	}
+
+	// roll forward anything that never got marked as done
+	pending := pendingEntries(entries)
+	if len(pending) > 0 {
+		log.Warn("replaying %d incomplete operations from journal", len(pending))
+	}
+	j.open = len(pending)
+	for _, e := range pending {
+		err := replay(e)
+		if err != nil {
+			log.Warn("err replaying %s of key '%s': %s", e.Op, e.Key, err.Error())
+		}
+		j.finish(e.Seq, err)
+	}
+
+	// nothing is in progress yet, so a large journal can be emptied right away
+	if j.size >= j.checkpointSize {
+		j.mu.Lock()
+		err = j.checkpoint()
+		j.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	i.journal = j
+	return nil
+}
+
+// CloseJournal stops recording mutations and closes the journal file
+func (i *FileIndex) CloseJournal() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.journal == nil {
+		return nil
+	}
+
+	err := i.journal.file.Close()
+	i.journal = nil
+	return err
+}
+
+// Entries returns every operation recorded in the journal in order
+func (i *FileIndex) Entries() ([]JournalEntry, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	entries, err := readJournal(journalPath(i.dir))
+	if err != nil {
+		return nil, err
+	}
+
+	res := []JournalEntry{}
+	for _, e := range entries {
+		if !isMarker(e.Op) {
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+// isMarker returns whether op marks the state of the journal rather than being a mutation
+func isMarker(op string) bool {
+	return op == opCommit || op == opAbort || op == opCheckpoint
+}
+
+// readJournal parses all complete entries in the journal at path
+func readJournal(path string) ([]JournalEntry, error) {
+	contents, err := af.ReadFile(I.FileSystem, path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []JournalEntry{}
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		// a torn final line means the op was never acknowledged, skip it
+		var e JournalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Warn("skipping unreadable journal entry")
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// endsCleanly reports whether the journal at path is empty or ends in a newline
+func endsCleanly(path string) bool {
+	contents, err := af.ReadFile(I.FileSystem, path)
+	return err != nil || len(contents) == 0 || contents[len(contents)-1] == '\n'
+}
+
+// pendingEntries returns the operations that were never committed or aborted
+func pendingEntries(entries []JournalEntry) []JournalEntry {
+	done := map[uint64]bool{}
+	for _, e := range entries {
+		if e.Op == opCommit || e.Op == opAbort {
+			done[e.Seq] = true
+		}
+	}
+
+	res := []JournalEntry{}
+	for _, e := range entries {
+		if !isMarker(e.Op) && !done[e.Seq] {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// replay applies a single journal entry directly to the file system
+func replay(e JournalEntry) error {
+	file := &File{FileName: e.Key}
+
+	switch e.Op {
+	case OpPut:
+		if err := file.ReplaceContent(e.Data); err != nil {
+			return err
+		}
+		if e.Expires != nil {
+			return writeExpiry(e.Key, *e.Expires)
+		}
+
+		// puts without a ttl remove any previous expiry
+		err := I.FileSystem.Remove(expiryPath(e.Key))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	case OpDelete:
+		err := file.Delete()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	case OpPatch, OpDeleteField:
+		if e.Data != "" {
+			return file.ReplaceContent(e.Data)
+		}
+
+		// entries written before the resulting document was recorded
+		jsonMap, err := file.ToMap()
+		if err != nil {
+			return err
+		}
+
+		err = applyFieldEntry(jsonMap, e)
+		if err == ErrFieldNotFound {
+			// already removed before the crash
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		jsonData, err := json.Marshal(jsonMap)
+		if err != nil {
+			return err
+		}
+		return file.ReplaceContent(string(jsonData))
+	case OpTxn:
+		// every part of a transaction is idempotent so all are reapplied
+		var firstErr error
+		for _, op := range e.Ops {
+			if err := replay(op); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	return nil
+}
+
+// record appends e to the journal and returns its sequence number
+func (j *Journal) record(e JournalEntry) (uint64, error) {
+	if j == nil {
+		return 0, nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	e.Seq = j.seq
+	e.Time = time.Now()
+
+	if err := j.append(e); err != nil {
+		j.seq--
+		return 0, err
+	}
+	j.open++
+	return e.Seq, nil
+}
+
+// finish marks the operation seq as committed, or aborted if err is not nil
+func (j *Journal) finish(seq uint64, err error) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	op := opCommit
+	if err != nil {
+		op = opAbort
+	}
+
+	if err := j.append(JournalEntry{Seq: seq, Op: op, Time: time.Now()}); err != nil {
+		log.Warn("err marking journal entry %d as done: %s", seq, err.Error())
+	}
+
+	// every finished operation has reached its documents by now, as writes
+	// sync before returning or wait for the group commit syncing them
+	j.open--
+	if j.open == 0 && j.size >= j.checkpointSize {
+		if err := j.checkpoint(); err != nil {
+			log.Warn("err emptying journal: %s", err.Error())
+		}
+	}
+}
+
+// checkpoint empties the journal, leaving only a marker with the last
+// sequence number so numbering continues after a restart. Callers hold j.mu
+// and make sure no operation is in progress
+func (j *Journal) checkpoint() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	j.size = 0
+	return j.append(JournalEntry{Seq: j.seq, Op: opCheckpoint, Time: time.Now()})
+}
+
+// append writes a single entry as one line
+func (j *Journal) append(e JournalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	n, err := j.file.Write(append(b, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	// batched writes sync the journal as part of the group commit
+	if I.durability == DurabilityPerWrite {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// sync flushes all appended entries to disk
+func (j *Journal) sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Sync()
+}
@@ -0,0 +1,235 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeJournal(t *testing.T, entries ...JournalEntry) {
+	t.Helper()
+
+	var contents []byte
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		assertNilErr(t, err)
+		contents = append(contents, append(b, '\n')...)
+	}
+
+	makeNewFile(JournalName, string(contents))
+}
+
+func journalOps(t *testing.T) (ops []string) {
+	t.Helper()
+
+	entries, err := I.Entries()
+	assertNilErr(t, err)
+	for _, e := range entries {
+		ops = append(ops, e.Op+":"+e.Key)
+	}
+	return ops
+}
+
+func TestJournal_Record(t *testing.T) {
+	t.Run("mutations are recorded and committed in order", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.OpenJournal())
+
+		file := createAndReturnFile(t, "journal1")
+		_, err := I.PatchField(makeNewJSON("journal2", map[string]interface{}{}), "f", "v")
+		assertNilErr(t, err)
+		assertNilErr(t, I.Delete(file))
+
+		checkDeepEquals(t, journalOps(t), []string{"put:journal1", "patch:journal2", "delete:journal1"})
+
+		entries, err := readJournal(JournalName)
+		assertNilErr(t, err)
+		checkDeepEquals(t, len(pendingEntries(entries)), 0)
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("failed operations are aborted", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.OpenJournal())
+
+		err := I.Delete(&File{FileName: "doesnt-exist"})
+		assertErr(t, err)
+
+		entries, err := readJournal(JournalName)
+		assertNilErr(t, err)
+		checkDeepEquals(t, entries[len(entries)-1].Op, opAbort)
+		checkDeepEquals(t, len(pendingEntries(entries)), 0)
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("nothing recorded without a journal", func(t *testing.T) {
+		setup()
+
+		createAndReturnFile(t, "no_journal")
+
+		exists, _ := af.Exists(I.FileSystem, JournalName)
+		assert.False(t, exists)
+	})
+}
+
+func TestJournal_Replay(t *testing.T) {
+	t.Run("incomplete put is rolled forward", func(t *testing.T) {
+		setup()
+		writeJournal(t,
+			JournalEntry{Seq: 1, Op: OpPut, Key: "done", Data: `{"a":"old"}`},
+			JournalEntry{Seq: 1, Op: opCommit},
+			JournalEntry{Seq: 2, Op: OpPut, Key: "pending", Data: `{"a":"new"}`},
+		)
+
+		assertNilErr(t, I.OpenJournal())
+		I.Regenerate()
+
+		checkContentEqual(t, "pending", map[string]interface{}{"a": "new"})
+		assertFileDoesNotExist(t, "done")
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("incomplete put restores its expiry", func(t *testing.T) {
+		setup()
+		createAndReturnFile(t, "cleared")
+		assertNilErr(t, I.Expire("cleared", time.Minute))
+		at := time.Now().Add(-time.Second)
+		writeJournal(t,
+			JournalEntry{Seq: 1, Op: OpPut, Key: "expired", Data: `{}`, Expires: &at},
+			JournalEntry{Seq: 2, Op: OpPut, Key: "cleared", Data: `{}`},
+		)
+
+		assertNilErr(t, I.OpenJournal())
+		I.Regenerate()
+
+		_, ok := I.Lookup("expired")
+		assert.False(t, ok)
+		_, ok = I.TTL("cleared")
+		assert.False(t, ok)
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("incomplete delete and patch are rolled forward", func(t *testing.T) {
+		setup()
+		makeNewJSON("deleted", map[string]interface{}{"a": "b"})
+		makeNewJSON("patched", map[string]interface{}{"a": "b", "d": map[string]interface{}{"e": 1, "f": 2}})
+		writeJournal(t,
+			JournalEntry{Seq: 1, Op: OpDelete, Key: "deleted"},
+			JournalEntry{Seq: 2, Op: OpPatch, Key: "patched", Field: "c", Value: json.RawMessage(`[1,2]`)},
+			JournalEntry{Seq: 3, Op: OpDeleteField, Key: "patched", Field: "d.e"},
+		)
+
+		assertNilErr(t, I.OpenJournal())
+		I.Regenerate()
+
+		assertFileDoesNotExist(t, "deleted")
+		checkContentEqual(t, "patched", map[string]interface{}{
+			"a": "b",
+			"c": []interface{}{1, 2},
+			"d": map[string]interface{}{"f": 2},
+		})
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("aborted operations and torn entries are not replayed", func(t *testing.T) {
+		setup()
+		writeJournal(t,
+			JournalEntry{Seq: 1, Op: OpPut, Key: "aborted", Data: "{}"},
+			JournalEntry{Seq: 1, Op: opAbort},
+		)
+		f, _ := I.FileSystem.OpenFile(JournalName, os.O_WRONLY|os.O_APPEND, 0644)
+		_, _ = f.WriteString(`{"seq":2,"op":"put","key":"torn`)
+		f.Close()
+
+		assertNilErr(t, I.OpenJournal())
+		I.Regenerate()
+
+		checkDeepEquals(t, len(I.List()), 0)
+
+		// new entries are still readable after the torn one
+		createAndReturnFile(t, "after_torn")
+		checkDeepEquals(t, journalOps(t), []string{"put:aborted", "put:after_torn"})
+
+		// replay is recorded so it only happens once
+		entries, err := readJournal(JournalName)
+		assertNilErr(t, err)
+		checkDeepEquals(t, len(pendingEntries(entries)), 0)
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("sequence numbers continue after reopen", func(t *testing.T) {
+		setup()
+		writeJournal(t,
+			JournalEntry{Seq: 7, Op: OpPut, Key: "old", Data: "{}"},
+			JournalEntry{Seq: 7, Op: opCommit},
+		)
+
+		assertNilErr(t, I.OpenJournal())
+		createAndReturnFile(t, "new")
+
+		entries, err := I.Entries()
+		assertNilErr(t, err)
+		checkDeepEquals(t, entries[len(entries)-1].Seq, uint64(8))
+		assertNilErr(t, I.CloseJournal())
+	})
+}
+
+func TestJournal_Checkpoint(t *testing.T) {
+	journalSize := func(t *testing.T) int {
+		t.Helper()
+		contents, err := af.ReadFile(I.FileSystem, JournalName)
+		assertNilErr(t, err)
+		return len(contents)
+	}
+
+	t.Run("journal shrinks once operations are done", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.OpenJournal())
+		I.journal.checkpointSize = 512
+
+		for n := 0; n < 20; n++ {
+			createAndReturnFile(t, fmt.Sprintf("doc%d", n))
+		}
+
+		assert.True(t, journalSize(t) < 1024, "journal should have been emptied")
+		assert.True(t, len(journalOps(t)) < 20, "journal should have been emptied")
+		checkDeepEquals(t, len(I.List()), 20)
+
+		// numbering continues after the journal is reopened
+		assertNilErr(t, I.CloseJournal())
+		assertNilErr(t, I.OpenJournal())
+		createAndReturnFile(t, "after")
+		entries, err := I.Entries()
+		assertNilErr(t, err)
+		checkDeepEquals(t, entries[len(entries)-1].Seq, uint64(21))
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("large journal is emptied after replay", func(t *testing.T) {
+		setup()
+		big := fmt.Sprintf(`{"a":"%s"}`, strings.Repeat("x", DefaultJournalCheckpointSize))
+		writeJournal(t,
+			JournalEntry{Seq: 1, Op: OpPut, Key: "done", Data: big},
+			JournalEntry{Seq: 1, Op: opCommit},
+			JournalEntry{Seq: 2, Op: OpPut, Key: "pending", Data: `{"a":"new"}`},
+		)
+
+		assertNilErr(t, I.OpenJournal())
+		I.Regenerate()
+
+		checkContentEqual(t, "pending", map[string]interface{}{"a": "new"})
+		assert.True(t, journalSize(t) < 1024, "journal should have been emptied")
+		assert.Empty(t, journalOps(t))
+
+		entries, err := readJournal(JournalName)
+		assertNilErr(t, err)
+		checkDeepEquals(t, len(pendingEntries(entries)), 0)
+		assertNilErr(t, I.CloseJournal())
+	})
+}
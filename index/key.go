@@ -0,0 +1,62 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// ErrInvalidKey is returned when a key can't be used as the name of a document
+var ErrInvalidKey = errors.New("invalid key")
+
+// ValidateKey makes sure key names a document inside the data directory.
+// Keys can't be empty, hold a path separator or start with a dot, which
+// also keeps them clear of .history, .expiry and the journal
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: no key given", ErrInvalidKey)
+	case strings.ContainsAny(key, `/\`):
+		return fmt.Errorf("%w: key '%s' can't contain / or \\", ErrInvalidKey, key)
+	case strings.HasPrefix(key, "."):
+		return fmt.Errorf("%w: key '%s' can't start with a dot", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// IsReservedKey returns whether key holds configuration of the database
+// itself, which are the schemas, webhook targets and redaction rules
+func IsReservedKey(key string) bool {
+	return key == WebhooksKey || key == RedactionsKey || strings.HasPrefix(key, SchemaPrefix)
+}
+
+// readConfigDoc returns the contents of the config document at key, nil if
+// it doesn't exist or can't be decoded
+func (i *FileIndex) readConfigDoc(key string) map[string]interface{} {
+	file, ok := i.Lookup(key)
+	if !ok {
+		return nil
+	}
+
+	doc, err := file.ToMap()
+	if err != nil {
+		log.Warn("ignoring config document '%s': %s", key, err.Error())
+		return nil
+	}
+	return doc
+}
+
+// usableConfig returns whether the config document doc at key parsed without
+// errs, logging them otherwise. Invalid documents are rejected on write, so
+// this only happens when the document is deleted or edited on disk
+func usableConfig(key string, doc map[string]interface{}, errs []string) bool {
+	if len(errs) == 0 {
+		return true
+	}
+	if doc != nil {
+		log.Warn("ignoring invalid config document '%s': %s", key, strings.Join(errs, ", "))
+	}
+	return false
+}
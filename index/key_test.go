@@ -0,0 +1,36 @@
+package index
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateKey(t *testing.T) {
+	for _, key := range []string{"a", "user.alice", "_schema.user", "a..b", "a-b_c"} {
+		assert.NoError(t, ValidateKey(key), key)
+	}
+
+	for _, key := range []string{"", ".", "..", "../escaped", "a/b", `a\b`, ".history", ".expiry"} {
+		assert.True(t, errors.Is(ValidateKey(key), ErrInvalidKey), key)
+	}
+}
+
+func TestFileIndex_invalidKeys(t *testing.T) {
+	setup()
+	makeNewJSON("../outside", map[string]interface{}{"a": 1})
+	I.Regenerate()
+
+	err := I.Put(&File{FileName: "../escaped"}, []byte(`{}`))
+	assert.True(t, errors.Is(err, ErrInvalidKey))
+	assertFileDoesNotExist(t, "../escaped")
+	checkKeyNotInIndex(t, "../escaped")
+
+	_, err = I.PatchField(&File{FileName: "../outside"}, "a", 2)
+	assert.True(t, errors.Is(err, ErrInvalidKey))
+
+	err = I.Delete(&File{FileName: "../outside"})
+	assert.True(t, errors.Is(err, ErrInvalidKey))
+	assertFileExists(t, "../outside")
+}
@@ -0,0 +1,309 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// types of operations in a json patch
+const (
+	PatchAdd     = "add"
+	PatchRemove  = "remove"
+	PatchReplace = "replace"
+	PatchMove    = "move"
+	PatchCopy    = "copy"
+	PatchTest    = "test"
+)
+
+// ErrInvalidPatch is returned when a patch is malformed or can't be applied
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// PatchOp is a single operation of a json patch (RFC 6902)
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch applies a json patch (RFC 6902) to file. Either every operation
+// applies or nothing is written. A failed test operation returns
+// ErrPreconditionFailed. The write only happens if all conds hold for the
+// current contents of file. Returns the ETag of the new contents
+func (i *FileIndex) JSONPatch(file *File, patch []byte, conds ...Precondition) (string, error) {
+	var ops []PatchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return "", fmt.Errorf("%w: json patch must be an array of operations: %s", ErrInvalidPatch, err.Error())
+	}
+
+	entry := JournalEntry{Op: OpPut, Key: file.FileName}
+	return i.modify(file, entry, conds, func(jsonMap map[string]interface{}) (map[string]interface{}, error) {
+		var doc interface{} = jsonMap
+		for n, op := range ops {
+			var err error
+			doc, err = op.apply(doc)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d (%s of '%s') failed: %w", n, op.Op, op.Path, err)
+			}
+		}
+		return patchedDoc(doc)
+	})
+}
+
+// MergePatch applies a json merge patch (RFC 7396) to file. The write only
+// happens if all conds hold for the current contents of file. Returns the
+// ETag of the new contents
+func (i *FileIndex) MergePatch(file *File, patch []byte, conds ...Precondition) (string, error) {
+	var patchVal interface{}
+	if err := json.Unmarshal(patch, &patchVal); err != nil {
+		return "", fmt.Errorf("%w: merge patch is not valid json: %s", ErrInvalidPatch, err.Error())
+	}
+
+	entry := JournalEntry{Op: OpPut, Key: file.FileName}
+	return i.modify(file, entry, conds, func(jsonMap map[string]interface{}) (map[string]interface{}, error) {
+		return patchedDoc(ApplyMergePatch(jsonMap, patchVal))
+	})
+}
+
+// patchedDoc makes sure a patched document is still a json object
+func patchedDoc(doc interface{}) (map[string]interface{}, error) {
+	jsonMap, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: patched document must be a json object", ErrInvalidPatch)
+	}
+	return jsonMap, nil
+}
+
+// ApplyMergePatch merges patch into target as described by RFC 7396 and
+// returns the result. Members of patch set to null are removed from target
+func ApplyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetMap, ok := target.(map[string]interface{})
+	if !ok {
+		targetMap = map[string]interface{}{}
+	}
+
+	for k, v := range patchMap {
+		if v == nil {
+			delete(targetMap, k)
+			continue
+		}
+		targetMap[k] = ApplyMergePatch(targetMap[k], v)
+	}
+	return targetMap
+}
+
+// CreateMergePatch returns the json merge patch (RFC 7396) that turns
+// original into modified. Since null removes a member, members of modified
+// that are null can't be expressed and are removed instead
+func CreateMergePatch(original interface{}, modified interface{}) interface{} {
+	originalMap, ok := original.(map[string]interface{})
+	modifiedMap, isMap := modified.(map[string]interface{})
+	if !ok || !isMap {
+		return modified
+	}
+
+	patch := map[string]interface{}{}
+	for k := range originalMap {
+		if _, kept := modifiedMap[k]; !kept {
+			patch[k] = nil
+		}
+	}
+
+	for k, v := range modifiedMap {
+		old, existed := originalMap[k]
+		if !existed {
+			patch[k] = v
+			continue
+		}
+
+		_, wasMap := old.(map[string]interface{})
+		_, isMap := v.(map[string]interface{})
+		if wasMap && isMap {
+			if nested := CreateMergePatch(old, v).(map[string]interface{}); len(nested) > 0 {
+				patch[k] = nested
+			}
+		} else if !reflect.DeepEqual(old, v) {
+			patch[k] = v
+		}
+	}
+	return patch
+}
+
+// SplitPointer splits a json pointer like /user/tags/0 into its unescaped segments
+func SplitPointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("%w: pointer '%s' must start with /", ErrInvalidPatch, ptr)
+	}
+
+	segments := strings.Split(ptr[1:], "/")
+	for n, seg := range segments {
+		segments[n] = strings.Replace(strings.Replace(seg, "~1", "/", -1), "~0", "~", -1)
+	}
+	return segments, nil
+}
+
+// apply runs op against doc and returns the updated document
+func (op PatchOp) apply(doc interface{}) (interface{}, error) {
+	path, err := SplitPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case PatchAdd, PatchReplace, PatchTest:
+		var value interface{}
+		if len(op.Value) == 0 || json.Unmarshal(op.Value, &value) != nil {
+			return nil, fmt.Errorf("%w: %s needs a json value", ErrInvalidPatch, op.Op)
+		}
+
+		if op.Op == PatchTest {
+			got, ok := GetPath(doc, path)
+			if !ok || !reflect.DeepEqual(got, value) {
+				return nil, ErrPreconditionFailed
+			}
+			return doc, nil
+		}
+		if op.Op == PatchReplace && len(path) > 0 {
+			if _, ok := GetPath(doc, path); !ok {
+				return nil, fmt.Errorf("%w: path does not exist", ErrInvalidPatch)
+			}
+			doc, err = removePointer(doc, path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return addPointer(doc, path, value)
+	case PatchRemove:
+		return removePointer(doc, path)
+	case PatchMove, PatchCopy:
+		from, err := SplitPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		value, ok := GetPath(doc, from)
+		if !ok {
+			return nil, fmt.Errorf("%w: from '%s' does not exist", ErrInvalidPatch, op.From)
+		}
+
+		if op.Op == PatchCopy {
+			// copies must not share nested objects with the original
+			copied, _ := json.Marshal(value)
+			value = nil
+			_ = json.Unmarshal(copied, &value)
+		} else {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, fmt.Errorf("%w: can't move '%s' into itself", ErrInvalidPatch, op.From)
+			}
+			doc, err = removePointer(doc, from)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return addPointer(doc, path, value)
+	}
+
+	return nil, fmt.Errorf("%w: unknown operation '%s'", ErrInvalidPatch, op.Op)
+}
+
+// addPointer adds value at path inside doc. Objects get a new or replaced
+// member and arrays get value inserted before the index, or appended for -.
+// Everything but the last segment must already exist
+func addPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return atParent(doc, path, func(parent interface{}, last string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[last] = value
+			return node, nil
+		case []interface{}:
+			n := len(node)
+			if last != "-" {
+				var err error
+				if n, err = pointerIndex(last, len(node)); err != nil {
+					return nil, err
+				}
+			}
+
+			res := make([]interface{}, 0, len(node)+1)
+			res = append(res, node[:n]...)
+			res = append(res, value)
+			return append(res, node[n:]...), nil
+		}
+		return nil, fmt.Errorf("%w: can't add '%s' to a value that isn't an object or array", ErrInvalidPatch, last)
+	})
+}
+
+// removePointer removes the value at path inside doc, which must exist
+func removePointer(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: can't remove the whole document", ErrInvalidPatch)
+	}
+
+	return atParent(doc, path, func(parent interface{}, last string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[last]; ok {
+				delete(node, last)
+				return node, nil
+			}
+		case []interface{}:
+			n, err := pointerIndex(last, len(node)-1)
+			if err == nil {
+				return append(node[:n:n], node[n+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("%w: path does not exist", ErrInvalidPatch)
+	})
+}
+
+// atParent calls change with the parent of the value at path and the last
+// segment of path, and puts the parent it returns back into doc
+func atParent(doc interface{}, path []string, change func(interface{}, string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(doc, path[0])
+	}
+
+	child, ok := GetPath(doc, path[:1])
+	if !ok {
+		return nil, fmt.Errorf("%w: path does not exist", ErrInvalidPatch)
+	}
+
+	child, err := atParent(child, path[1:], change)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		n, _ := strconv.Atoi(path[0])
+		node[n] = child
+	}
+	return doc, nil
+}
+
+// pointerIndex parses an array index of a json pointer no larger than max
+func pointerIndex(seg string, max int) (int, error) {
+	n, err := strconv.Atoi(seg)
+	if err != nil || n < 0 || n > max || (len(seg) > 1 && seg[0] == '0') {
+		return 0, fmt.Errorf("%w: '%s' is not a valid array index", ErrInvalidPatch, seg)
+	}
+	return n, nil
+}
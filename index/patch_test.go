@@ -0,0 +1,184 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+
+	var val interface{}
+	assertNilErr(t, json.Unmarshal([]byte(s), &val))
+	return val
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	// examples from appendix A of RFC 7396
+	cases := []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, c := range cases {
+		got := ApplyMergePatch(parseJSON(t, c.target), parseJSON(t, c.patch))
+		checkDeepEquals(t, got, parseJSON(t, c.want))
+	}
+}
+
+func TestCreateMergePatch(t *testing.T) {
+	cases := []struct{ original, modified, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"a":"b","b":"c"}`, `{"b":"c"}`},
+		{`{"a":"b","b":"c"}`, `{"b":"c"}`, `{"a":null}`},
+		{`{"a":{"b":"c","d":"e"}}`, `{"a":{"b":"c","d":"f"}}`, `{"a":{"d":"f"}}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"c"}}`, `{}`},
+		{`{"a":[1,2]}`, `{"a":[1,3]}`, `{"a":[1,3]}`},
+		{`{"a":{"b":"c"}}`, `{"a":"b"}`, `{"a":"b"}`},
+		{`null`, `{"a":1}`, `{"a":1}`},
+	}
+
+	for _, c := range cases {
+		original, modified := parseJSON(t, c.original), parseJSON(t, c.modified)
+		patch := CreateMergePatch(original, modified)
+		checkDeepEquals(t, patch, parseJSON(t, c.want))
+
+		// applying the patch gives back the modified document
+		copied := parseJSON(t, c.original)
+		checkDeepEquals(t, ApplyMergePatch(copied, patch), modified)
+	}
+}
+
+func TestPatchOp_apply(t *testing.T) {
+	run := func(doc string, ops string) (interface{}, error) {
+		var patch []PatchOp
+		assertNilErr(t, json.Unmarshal([]byte(ops), &patch))
+
+		res := parseJSON(t, doc)
+		for _, op := range patch {
+			var err error
+			if res, err = op.apply(res); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	t.Run("operations from RFC 6902", func(t *testing.T) {
+		cases := []struct{ doc, ops, want string }{
+			{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+			{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+			{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+			{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+			{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+			{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+			{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+			{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+			{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"add","path":"/baz/bar","value":2}]`, `{"foo":{"bar":1},"baz":{"bar":2}}`},
+			{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+			{`{"a/b":1,"m~n":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"replace","path":"/m~0n","value":3}]`, `{"m~n":3}`},
+			{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":{"baz":1}}]`, `{"baz":1}`},
+		}
+
+		for _, c := range cases {
+			got, err := run(c.doc, c.ops)
+			assertNilErr(t, err)
+			checkDeepEquals(t, got, parseJSON(t, c.want))
+		}
+	})
+
+	t.Run("failed test", func(t *testing.T) {
+		_, err := run(`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`)
+		assert.Equal(t, ErrPreconditionFailed, err)
+	})
+
+	t.Run("invalid operations", func(t *testing.T) {
+		invalid := []string{
+			`[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+			`[{"op":"add","path":"/foo/5","value":1}]`,
+			`[{"op":"add","path":"/foo/01","value":1}]`,
+			`[{"op":"add","path":"/bar"}]`,
+			`[{"op":"remove","path":"/nope"}]`,
+			`[{"op":"remove","path":""}]`,
+			`[{"op":"replace","path":"/nope","value":1}]`,
+			`[{"op":"move","from":"/nope","path":"/bar"}]`,
+			`[{"op":"move","from":"/foo","path":"/foo/0"}]`,
+			`[{"op":"add","path":"bar","value":1}]`,
+			`[{"op":"rename","path":"/foo"}]`,
+		}
+		for _, ops := range invalid {
+			_, err := run(`{"foo":["a"]}`, ops)
+			assert.True(t, errors.Is(err, ErrInvalidPatch), "%s: got %v", ops, err)
+		}
+	})
+}
+
+func TestFileIndex_JSONPatch(t *testing.T) {
+	t.Run("applies every operation", func(t *testing.T) {
+		setup()
+		file := makeNewJSON("patched", map[string]interface{}{"count": 1, "tags": []interface{}{"a"}})
+		I.Regenerate()
+
+		_, err := I.JSONPatch(file, []byte(`[
+			{"op": "test", "path": "/count", "value": 1},
+			{"op": "replace", "path": "/count", "value": 2},
+			{"op": "add", "path": "/tags/-", "value": "b"}
+		]`))
+		assertNilErr(t, err)
+		checkContentEqual(t, "patched", map[string]interface{}{"count": 2, "tags": []interface{}{"a", "b"}})
+	})
+
+	t.Run("failed operation changes nothing", func(t *testing.T) {
+		setup()
+		file := makeNewJSON("patched", map[string]interface{}{"count": 1})
+		I.Regenerate()
+
+		_, err := I.JSONPatch(file, []byte(`[
+			{"op": "replace", "path": "/count", "value": 2},
+			{"op": "test", "path": "/count", "value": 1}
+		]`))
+		assert.True(t, errors.Is(err, ErrPreconditionFailed))
+		checkContentEqual(t, "patched", map[string]interface{}{"count": 1})
+	})
+
+	t.Run("patch must leave an object", func(t *testing.T) {
+		setup()
+		file := makeNewJSON("patched", map[string]interface{}{"count": 1})
+		I.Regenerate()
+
+		_, err := I.JSONPatch(file, []byte(`[{"op": "replace", "path": "", "value": [1]}]`))
+		assert.True(t, errors.Is(err, ErrInvalidPatch))
+		checkContentEqual(t, "patched", map[string]interface{}{"count": 1})
+	})
+}
+
+func TestFileIndex_MergePatch(t *testing.T) {
+	setup()
+	file := makeNewJSON("merged", map[string]interface{}{
+		"name":    "alice",
+		"age":     30,
+		"profile": map[string]interface{}{"city": "Vancouver", "country": "CA"},
+	})
+	I.Regenerate()
+
+	_, err := I.MergePatch(file, []byte(`{"age": null, "profile": {"city": "Toronto"}}`))
+	assertNilErr(t, err)
+	checkContentEqual(t, "merged", map[string]interface{}{
+		"name":    "alice",
+		"profile": map[string]interface{}{"city": "Toronto", "country": "CA"},
+	})
+
+	_, err = I.MergePatch(file, []byte(`"not an object"`))
+	assert.True(t, errors.Is(err, ErrInvalidPatch))
+}
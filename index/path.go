@@ -0,0 +1,179 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrFieldNotFound is returned when a field path doesn't exist in a document
+var ErrFieldNotFound = errors.New("field not found")
+
+// ErrInvalidPath is returned when a field path can't be followed through a document
+var ErrInvalidPath = errors.New("invalid field path")
+
+// SplitPath splits a dotted field path like profile.country or tags.0
+// into its segments
+func SplitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// ParseFieldPath splits a field path given in a url into its segments.
+// Paths are dotted like address.city, or json pointers with their slashes
+// escaped like ~1address~1city since a url segment can't hold a slash
+func ParseFieldPath(path string) []string {
+	if !strings.HasPrefix(path, "~1") {
+		return SplitPath(path)
+	}
+
+	segments := strings.Split(path[len("~1"):], "~1")
+	for n, seg := range segments {
+		segments[n] = strings.Replace(seg, "~0", "~", -1)
+	}
+	return segments
+}
+
+// GetPath returns the value at the given path segments inside a json value,
+// traversing maps by key and slices by index
+func GetPath(jsonVal interface{}, segments []string) (interface{}, bool) {
+	cur := jsonVal
+	for _, seg := range segments {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			val, ok := node[seg]
+			if !ok {
+				return nil, false
+			}
+			cur = val
+		case []interface{}:
+			n, err := strconv.Atoi(seg)
+			if err != nil || n < 0 || n >= len(node) {
+				return nil, false
+			}
+			cur = node[n]
+		default:
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+// SetPath sets the value at the given path segments inside a json value and
+// returns the updated value. Missing objects along the path are created, and
+// an array index equal to the length of the array, or -, appends to it
+func SetPath(jsonVal interface{}, segments []string, value interface{}) (interface{}, error) {
+	if len(segments) == 0 {
+		return value, nil
+	}
+	seg, rest := segments[0], segments[1:]
+
+	switch node := jsonVal.(type) {
+	case nil:
+		child, err := SetPath(nil, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{seg: child}, nil
+	case map[string]interface{}:
+		child, err := SetPath(node[seg], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		node[seg] = child
+		return node, nil
+	case []interface{}:
+		n, err := arrayIndex(node, seg, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if n == len(node) {
+			child, err := SetPath(nil, rest, value)
+			if err != nil {
+				return nil, err
+			}
+			return append(node, child), nil
+		}
+
+		child, err := SetPath(node[n], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		node[n] = child
+		return node, nil
+	}
+
+	return nil, fmt.Errorf("%w: can't set '%s' inside a value that isn't an object or array", ErrInvalidPath, seg)
+}
+
+// DeletePath removes the value at the given path segments inside a json
+// value and returns the updated value
+func DeletePath(jsonVal interface{}, segments []string) (interface{}, error) {
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%w: can't delete the whole document", ErrInvalidPath)
+	}
+	seg, rest := segments[0], segments[1:]
+
+	switch node := jsonVal.(type) {
+	case map[string]interface{}:
+		child, ok := node[seg]
+		if !ok {
+			return nil, ErrFieldNotFound
+		}
+		if len(rest) == 0 {
+			delete(node, seg)
+			return node, nil
+		}
+
+		child, err := DeletePath(child, rest)
+		if err != nil {
+			return nil, err
+		}
+		node[seg] = child
+		return node, nil
+	case []interface{}:
+		n, err := arrayIndex(node, seg, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return append(node[:n], node[n+1:]...), nil
+		}
+
+		child, err := DeletePath(node[n], rest)
+		if err != nil {
+			return nil, err
+		}
+		node[n] = child
+		return node, nil
+	}
+
+	return nil, ErrFieldNotFound
+}
+
+// arrayIndex parses seg as an index into node. If appending is allowed,
+// the index just past the end of node, or -, is also valid
+func arrayIndex(node []interface{}, seg string, appending bool) (int, error) {
+	if seg == "-" && appending {
+		return len(node), nil
+	}
+
+	n, err := strconv.Atoi(seg)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: '%s' is not an array index", ErrInvalidPath, seg)
+	}
+
+	max := len(node) - 1
+	if appending {
+		max = len(node)
+	}
+	if n > max {
+		if appending {
+			return 0, fmt.Errorf("%w: index %d is out of range", ErrInvalidPath, n)
+		}
+		return 0, ErrFieldNotFound
+	}
+	return n, nil
+}
@@ -0,0 +1,104 @@
+package index
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"name": "alice",
+		"profile": map[string]interface{}{
+			"country": "CA",
+		},
+		"tags": []interface{}{"a", map[string]interface{}{"b": "c"}},
+	}
+
+	t.Run("top level field", func(t *testing.T) {
+		got, ok := GetPath(doc, SplitPath("name"))
+		assert.True(t, ok)
+		checkDeepEquals(t, got, "alice")
+	})
+
+	t.Run("nested field", func(t *testing.T) {
+		got, ok := GetPath(doc, SplitPath("profile.country"))
+		assert.True(t, ok)
+		checkDeepEquals(t, got, "CA")
+	})
+
+	t.Run("array index", func(t *testing.T) {
+		got, ok := GetPath(doc, SplitPath("tags.1.b"))
+		assert.True(t, ok)
+		checkDeepEquals(t, got, "c")
+	})
+
+	t.Run("missing paths", func(t *testing.T) {
+		for _, path := range []string{"nope", "profile.city", "tags.2", "tags.x", "name.first"} {
+			_, ok := GetPath(doc, SplitPath(path))
+			assert.False(t, ok, path)
+		}
+	})
+}
+
+func TestParseFieldPath(t *testing.T) {
+	checkDeepEquals(t, ParseFieldPath("address.city"), []string{"address", "city"})
+	checkDeepEquals(t, ParseFieldPath("~1address~1city"), []string{"address", "city"})
+	checkDeepEquals(t, ParseFieldPath("~1a.b~1c~0d"), []string{"a.b", "c~d"})
+	checkDeepEquals(t, ParseFieldPath("name"), []string{"name"})
+}
+
+func TestSetPath(t *testing.T) {
+	newDoc := func() map[string]interface{} {
+		return map[string]interface{}{
+			"name": "alice",
+			"tags": []interface{}{"a", "b"},
+		}
+	}
+
+	t.Run("creates missing objects", func(t *testing.T) {
+		got, err := SetPath(newDoc(), SplitPath("address.city"), "Vancouver")
+		assertNilErr(t, err)
+		checkDeepEquals(t, got.(map[string]interface{})["address"], map[string]interface{}{"city": "Vancouver"})
+	})
+
+	t.Run("replaces and appends array items", func(t *testing.T) {
+		doc := newDoc()
+		_, err := SetPath(doc, SplitPath("tags.0"), "z")
+		assertNilErr(t, err)
+		_, err = SetPath(doc, SplitPath("tags.2"), "c")
+		assertNilErr(t, err)
+		_, err = SetPath(doc, SplitPath("tags.-"), "d")
+		assertNilErr(t, err)
+		checkDeepEquals(t, doc["tags"], []interface{}{"z", "b", "c", "d"})
+	})
+
+	t.Run("invalid paths", func(t *testing.T) {
+		for _, path := range []string{"name.first", "tags.5", "tags.x"} {
+			_, err := SetPath(newDoc(), SplitPath(path), 1)
+			assert.True(t, errors.Is(err, ErrInvalidPath), path)
+		}
+	})
+}
+
+func TestDeletePath(t *testing.T) {
+	doc := map[string]interface{}{
+		"profile": map[string]interface{}{"city": "Vancouver", "country": "CA"},
+		"tags":    []interface{}{"a", "b", "c"},
+	}
+
+	_, err := DeletePath(doc, SplitPath("profile.city"))
+	assertNilErr(t, err)
+	_, err = DeletePath(doc, SplitPath("tags.1"))
+	assertNilErr(t, err)
+	checkDeepEquals(t, doc, map[string]interface{}{
+		"profile": map[string]interface{}{"country": "CA"},
+		"tags":    []interface{}{"a", "c"},
+	})
+
+	for _, path := range []string{"nope", "profile.city", "tags.2", "profile.country.x"} {
+		_, err := DeletePath(doc, SplitPath(path))
+		assert.Equal(t, ErrFieldNotFound, err, path)
+	}
+}
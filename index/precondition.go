@@ -0,0 +1,75 @@
+package index
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+)
+
+// ErrPreconditionFailed is returned when a write is rejected by one of its preconditions
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Precondition is checked against the current contents of a document while
+// it is locked for writing. exists is false if the document doesn't exist yet
+type Precondition func(content []byte, exists bool) error
+
+// ETag returns a quoted hash of content suitable for use as an http ETag
+func ETag(content []byte) string {
+	sum := sha1.Sum(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// IfMatch only allows the write if the document exists and its ETag is one of
+// tags. A tag of * matches any existing document
+func IfMatch(tags []string) Precondition {
+	return func(content []byte, exists bool) error {
+		if exists && matchesAny(tags, content) {
+			return nil
+		}
+		return ErrPreconditionFailed
+	}
+}
+
+// IfNoneMatch only allows the write if the document's ETag is none of tags.
+// A tag of * only allows the write if the document doesn't exist yet
+func IfNoneMatch(tags []string) Precondition {
+	return func(content []byte, exists bool) error {
+		if exists && matchesAny(tags, content) {
+			return ErrPreconditionFailed
+		}
+		return nil
+	}
+}
+
+// matchesAny returns whether the ETag of content is in tags
+func matchesAny(tags []string, content []byte) bool {
+	etag := ETag(content)
+	for _, tag := range tags {
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions runs all conds against the current contents of f.
+// Callers must hold f.mu
+func (f *File) checkPreconditions(conds []Precondition) error {
+	if len(conds) == 0 {
+		return nil
+	}
+
+	content, err := f.readBytes()
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, cond := range conds {
+		if err := cond(content, exists); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETag(t *testing.T) {
+	t.Run("same content has same etag", func(t *testing.T) {
+		checkDeepEquals(t, ETag([]byte("{}")), ETag([]byte("{}")))
+	})
+
+	t.Run("different content has different etag", func(t *testing.T) {
+		if ETag([]byte(`{"a":1}`)) == ETag([]byte(`{"a":2}`)) {
+			t.Errorf("etags should differ")
+		}
+	})
+}
+
+func TestPreconditions(t *testing.T) {
+	content := []byte(`{"field":"value"}`)
+	etag := ETag(content)
+
+	t.Run("put with matching if-match succeeds", func(t *testing.T) {
+		setup()
+		file := makeNewJSON("cond", map[string]interface{}{"field": "value"})
+		I.Regenerate()
+
+		err := I.Put(file, []byte("{}"), IfMatch([]string{etag}))
+		assertNilErr(t, err)
+		checkContentEqual(t, "cond", map[string]interface{}{})
+	})
+
+	t.Run("put with stale if-match fails", func(t *testing.T) {
+		setup()
+		file := makeNewJSON("cond", map[string]interface{}{"field": "other"})
+		I.Regenerate()
+
+		err := I.Put(file, []byte("{}"), IfMatch([]string{etag}))
+		assert.Equal(t, ErrPreconditionFailed, err)
+		checkContentEqual(t, "cond", map[string]interface{}{"field": "other"})
+	})
+
+	t.Run("if-match any fails on missing document", func(t *testing.T) {
+		setup()
+
+		err := I.Put(&File{FileName: "missing"}, []byte("{}"), IfMatch([]string{"*"}))
+		assert.Equal(t, ErrPreconditionFailed, err)
+
+		// key isn't left behind in the index
+		checkKeyNotInIndex(t, "missing")
+		assertFileDoesNotExist(t, "missing")
+	})
+
+	t.Run("if-none-match any only creates", func(t *testing.T) {
+		setup()
+
+		file := &File{FileName: "create_only"}
+		err := I.Put(file, []byte("{}"), IfNoneMatch([]string{"*"}))
+		assertNilErr(t, err)
+
+		err = I.Put(file, []byte("{}"), IfNoneMatch([]string{"*"}))
+		assert.Equal(t, ErrPreconditionFailed, err)
+	})
+
+	t.Run("patch and delete check preconditions", func(t *testing.T) {
+		setup()
+		file := makeNewJSON("cond", map[string]interface{}{"field": "value"})
+		I.Regenerate()
+
+		_, err := I.PatchField(file, "field", "new", IfNoneMatch([]string{etag}))
+		assert.Equal(t, ErrPreconditionFailed, err)
+
+		err = I.Delete(file, IfMatch([]string{`"stale"`}))
+		assert.Equal(t, ErrPreconditionFailed, err)
+		assertFileExists(t, "cond")
+
+		err = I.Delete(file, IfMatch([]string{etag}))
+		assertNilErr(t, err)
+		assertFileDoesNotExist(t, "cond")
+	})
+
+	t.Run("patches and field deletes return the new etag", func(t *testing.T) {
+		setup()
+		file := makeNewJSON("cond", map[string]interface{}{"field": "value"})
+		I.Regenerate()
+
+		writes := map[string]func() (string, error){
+			"patch field":  func() (string, error) { return I.PatchField(file, "field", "new") },
+			"delete field": func() (string, error) { return I.DeleteField(file, "field") },
+			"json patch": func() (string, error) {
+				return I.JSONPatch(file, []byte(`[{"op": "add", "path": "/other", "value": 1}]`))
+			},
+			"merge patch": func() (string, error) { return I.MergePatch(file, []byte(`{"other": 2}`)) },
+		}
+		for name, write := range writes {
+			got, err := write()
+			assertNilErr(t, err)
+
+			bytes, _ := file.GetByteArray()
+			if got != ETag(bytes) {
+				t.Errorf("%s: got etag %s, want %s", name, got, ETag(bytes))
+			}
+		}
+	})
+}
@@ -0,0 +1,451 @@
+package index
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Query describes a filtered, sorted and paginated read over all documents.
+// Filters use mongo style operators, e.g.
+//
+//	{"age": {"$gte": 18}, "$or": [{"role": "admin"}, {"tags": {"$in": ["staff"]}}]}
+type Query struct {
+	Filter map[string]interface{} `json:"filter"`
+
+	// field paths to sort by, prefixed with - for descending order
+	Sort  []string `json:"sort"`
+	Skip  int      `json:"skip"`
+	Limit int      `json:"limit"`
+
+	// depth to resolve references to before matching
+	Depth int `json:"depth"`
+}
+
+// QueryResult is a single document matched by a Query
+type QueryResult struct {
+	Key      string      `json:"key"`
+	Document interface{} `json:"document"`
+}
+
+// Query returns all documents matching q.Filter, with references resolved
+// to q.Depth so filters can match on fields of referenced documents
+func (i *FileIndex) Query(q Query) ([]QueryResult, error) {
+	return i.QueryFor(q, nil)
+}
+
+// QueryFor runs q like Query, leaving out documents canRead rejects and
+// references to them unresolved. A nil canRead reads every document
+func (i *FileIndex) QueryFor(q Query, canRead ReadFilter) ([]QueryResult, error) {
+	// validate the whole filter up front so bad queries always fail
+	filter, err := compileFilter(q.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []QueryResult{}
+	for _, key := range i.queryCandidates(q) {
+		file, ok := i.Lookup(key)
+		if !ok {
+			continue
+		}
+
+		// documents that aren't json objects can never match
+		jsonMap, err := file.ToMap()
+		if err != nil || (canRead != nil && !canRead(key, jsonMap)) {
+			continue
+		}
+
+		doc := ResolveReferencesFor(jsonMap, q.Depth, canRead)
+		matched, err := filter.matches(doc)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			res = append(res, QueryResult{Key: key, Document: doc})
+		}
+	}
+
+	sortResults(res, q.Sort)
+
+	// paginate
+	if q.Skip > 0 {
+		if q.Skip > len(res) {
+			q.Skip = len(res)
+		}
+		res = res[q.Skip:]
+	}
+	if q.Limit > 0 && q.Limit < len(res) {
+		res = res[:q.Limit]
+	}
+
+	return res, nil
+}
+
+// queryCandidates returns the keys that could match q in a stable order,
+// narrowing them down with a field index when the filter allows it
+func (i *FileIndex) queryCandidates(q Query) []string {
+	if q.Depth < 1 {
+		for path, cond := range q.Filter {
+			val, isEq := equalityValue(cond)
+			if strings.HasPrefix(path, "$") || !isEq {
+				continue
+			}
+
+			if keys, ok := i.FindByField(path, IndexValue(val)); ok {
+				return keys
+			}
+		}
+	}
+
+	keys := i.List()
+	sort.Strings(keys)
+	return keys
+}
+
+// equalityValue returns the value cond tests for equality with, if it
+// is either a plain value or a lone $eq operator on a scalar
+func equalityValue(cond interface{}) (interface{}, bool) {
+	if ops, ok := cond.(map[string]interface{}); ok {
+		val, hasEq := ops["$eq"]
+		if !isOperatorMap(ops) || len(ops) != 1 || !hasEq {
+			return nil, false
+		}
+		cond = val
+	}
+
+	switch cond.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil, false
+	}
+	return cond, true
+}
+
+// compiledFilter is a filter along with its regular expressions, compiled once
+type compiledFilter struct {
+	filter  map[string]interface{}
+	regexps map[string]*regexp.Regexp
+}
+
+// compileFilter checks every clause of filter and compiles its regular expressions
+func compileFilter(filter map[string]interface{}) (*compiledFilter, error) {
+	f := &compiledFilter{filter: filter, regexps: map[string]*regexp.Regexp{}}
+
+	// every clause is evaluated even against an empty document, which
+	// compiles each $regex and reports any invalid clause
+	if _, err := f.matches(map[string]interface{}{}); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// matches returns whether doc satisfies the filter
+func (f *compiledFilter) matches(doc interface{}) (bool, error) {
+	return f.match(doc, f.filter)
+}
+
+// Match returns whether doc satisfies filter
+func Match(doc interface{}, filter map[string]interface{}) (bool, error) {
+	f, err := compileFilter(filter)
+	if err != nil {
+		return false, err
+	}
+	return f.matches(doc)
+}
+
+// match returns whether doc satisfies filter, a part of f
+func (f *compiledFilter) match(doc interface{}, filter map[string]interface{}) (bool, error) {
+	// evaluate every clause so invalid filters are always reported
+	matched := true
+	for key, cond := range filter {
+		var ok bool
+		var err error
+
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = f.matchLogical(doc, key, cond)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unknown top level operator '%s'", key)
+			}
+
+			val, exists := GetPath(doc, SplitPath(key))
+			ok, err = f.matchCondition(val, exists, cond)
+		}
+
+		if err != nil {
+			return false, err
+		}
+		matched = matched && ok
+	}
+
+	return matched, nil
+}
+
+// matchLogical evaluates $and, $or and $nor over a list of filters
+func (f *compiledFilter) matchLogical(doc interface{}, op string, cond interface{}) (bool, error) {
+	list, ok := cond.([]interface{})
+	if !ok || len(list) == 0 {
+		return false, fmt.Errorf("'%s' must be a non-empty array of filters", op)
+	}
+
+	some, all := false, true
+	for _, sub := range list {
+		subFilter, ok := sub.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("'%s' must be a non-empty array of filters", op)
+		}
+
+		matched, err := f.match(doc, subFilter)
+		if err != nil {
+			return false, err
+		}
+		some = some || matched
+		all = all && matched
+	}
+
+	switch op {
+	case "$and":
+		return all, nil
+	case "$or":
+		return some, nil
+	default:
+		return !some, nil
+	}
+}
+
+// isOperatorMap returns whether m is made up only of $operators
+func isOperatorMap(m map[string]interface{}) bool {
+	if len(m) == 0 {
+		return false
+	}
+
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchCondition checks a single field value against its condition,
+// which is either a plain value to compare with or a map of operators
+func (f *compiledFilter) matchCondition(val interface{}, exists bool, cond interface{}) (bool, error) {
+	ops, ok := cond.(map[string]interface{})
+	if !ok || !isOperatorMap(ops) {
+		return exists && matchEq(val, cond), nil
+	}
+
+	matched := true
+	for op, arg := range ops {
+		ok, err := f.matchOperator(val, exists, op, arg, ops)
+		if err != nil {
+			return false, err
+		}
+		matched = matched && ok
+	}
+	return matched, nil
+}
+
+// matchOperator evaluates a single operator against val
+func (f *compiledFilter) matchOperator(val interface{}, exists bool, op string, arg interface{}, ops map[string]interface{}) (bool, error) {
+	switch op {
+	case "$eq":
+		return exists && matchEq(val, arg), nil
+	case "$ne":
+		return !exists || !matchEq(val, arg), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return exists && matchAny(val, func(v interface{}) bool {
+			return compareOp(op, v, arg)
+		}), nil
+	case "$in", "$nin":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("'%s' must be an array", op)
+		}
+
+		found := false
+		for _, candidate := range list {
+			found = found || (exists && matchEq(val, candidate))
+		}
+		return found == (op == "$in"), nil
+	case "$exists":
+		want, ok := arg.(bool)
+		if !ok {
+			return false, fmt.Errorf("'$exists' must be true or false")
+		}
+		return exists == want, nil
+	case "$regex":
+		pattern, ok := arg.(string)
+		if !ok {
+			return false, fmt.Errorf("'$regex' must be a string")
+		}
+
+		// optional flags, e.g. "i" for case insensitive
+		if flags, ok := ops["$options"].(string); ok && flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
+
+		re, ok := f.regexps[pattern]
+		if !ok {
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				return false, fmt.Errorf("invalid '$regex': %s", err.Error())
+			}
+			f.regexps[pattern] = re
+		}
+
+		return exists && matchAny(val, func(v interface{}) bool {
+			s, isString := v.(string)
+			return isString && re.MatchString(s)
+		}), nil
+	case "$options":
+		// only modifies $regex
+		return true, nil
+	case "$not":
+		sub, ok := arg.(map[string]interface{})
+		if !ok || !isOperatorMap(sub) {
+			return false, fmt.Errorf("'$not' must be a map of operators")
+		}
+
+		matched, err := f.matchCondition(val, exists, sub)
+		return !matched, err
+	}
+
+	return false, fmt.Errorf("unknown operator '%s'", op)
+}
+
+// matchEq returns whether val equals target, or any element of val does if it is an array
+func matchEq(val interface{}, target interface{}) bool {
+	if reflect.DeepEqual(val, target) {
+		return true
+	}
+
+	if arr, ok := val.([]interface{}); ok {
+		for _, v := range arr {
+			if reflect.DeepEqual(v, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchAny returns whether fn holds for val, or any element of val if it is an array
+func matchAny(val interface{}, fn func(interface{}) bool) bool {
+	if arr, ok := val.([]interface{}); ok {
+		for _, v := range arr {
+			if fn(v) {
+				return true
+			}
+		}
+		return false
+	}
+	return fn(val)
+}
+
+// compareOp applies a comparison operator to two values of the same type
+func compareOp(op string, a interface{}, b interface{}) bool {
+	if typeRank(a) != typeRank(b) {
+		return false
+	}
+
+	c := compareValues(a, b)
+	switch op {
+	case "$gt":
+		return c > 0
+	case "$gte":
+		return c >= 0
+	case "$lt":
+		return c < 0
+	default:
+		return c <= 0
+	}
+}
+
+// typeRank orders json types when sorting values of different types
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case bool:
+		return 4
+	case []interface{}:
+		return 5
+	case map[string]interface{}:
+		return 6
+	}
+	return 7
+}
+
+// compareValues returns -1, 0 or 1 depending on whether a sorts before,
+// the same as or after b
+func compareValues(a interface{}, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch av := a.(type) {
+	case float64:
+		bv := b.(float64)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+	case string:
+		return strings.Compare(av, b.(string))
+	case bool:
+		bv := b.(bool)
+		if av != bv {
+			if !av {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// sortResults sorts res by the given field paths, missing fields first
+func sortResults(res []QueryResult, fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+
+	sort.SliceStable(res, func(a, b int) bool {
+		for _, field := range fields {
+			desc := strings.HasPrefix(field, "-")
+			segments := SplitPath(strings.TrimPrefix(field, "-"))
+
+			va, okA := GetPath(res[a].Document, segments)
+			vb, okB := GetPath(res[b].Document, segments)
+
+			c := 0
+			switch {
+			case !okA && okB:
+				c = -1
+			case okA && !okB:
+				c = 1
+			case okA && okB:
+				c = compareValues(va, vb)
+			}
+
+			if c != 0 {
+				return (c < 0) != desc
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,191 @@
+package index
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseQuery(t *testing.T, s string) Query {
+	t.Helper()
+
+	var q Query
+	err := json.Unmarshal([]byte(s), &q)
+	assertNilErr(t, err)
+	return q
+}
+
+func queryKeys(t *testing.T, q string) []string {
+	t.Helper()
+
+	res, err := I.Query(parseQuery(t, q))
+	assertNilErr(t, err)
+
+	keys := []string{}
+	for _, r := range res {
+		keys = append(keys, r.Key)
+	}
+	return keys
+}
+
+func setupQueryDocs() {
+	setup()
+	makeNewJSON("alice", map[string]interface{}{
+		"name":    "Alice",
+		"age":     31,
+		"role":    "admin",
+		"tags":    []interface{}{"staff", "ops"},
+		"profile": map[string]interface{}{"country": "CA"},
+		"team":    "REF::ops",
+	})
+	makeNewJSON("bob", map[string]interface{}{
+		"name":    "Bob",
+		"age":     25,
+		"role":    "user",
+		"tags":    []interface{}{"staff"},
+		"profile": map[string]interface{}{"country": "US"},
+	})
+	makeNewJSON("carol", map[string]interface{}{
+		"name": "carol",
+		"age":  42,
+		"role": "user",
+	})
+	makeNewJSON("ops", map[string]interface{}{
+		"title": "Operations",
+	})
+	makeNewFile("broken.json", "not json")
+	I.Regenerate()
+}
+
+func TestMatch(t *testing.T) {
+	doc := map[string]interface{}{}
+	_ = json.Unmarshal([]byte(`{"a": 1, "s": "Hello", "arr": [1, 2], "nested": {"b": null}}`), &doc)
+
+	tt := []struct {
+		name   string
+		filter string
+		want   bool
+	}{
+		{"empty filter", `{}`, true},
+		{"implicit eq", `{"a": 1}`, true},
+		{"eq mismatch", `{"a": 2}`, false},
+		{"eq on missing field", `{"missing": null}`, false},
+		{"eq on array element", `{"arr": 2}`, true},
+		{"eq on whole array", `{"arr": [1, 2]}`, true},
+		{"ne", `{"a": {"$ne": 2}}`, true},
+		{"ne on missing field", `{"missing": {"$ne": 2}}`, true},
+		{"gt", `{"a": {"$gt": 0}}`, true},
+		{"gte", `{"a": {"$gte": 1}}`, true},
+		{"lt", `{"a": {"$lt": 1}}`, false},
+		{"lte", `{"a": {"$lte": 1}}`, true},
+		{"range", `{"a": {"$gt": 0, "$lt": 2}}`, true},
+		{"compare different types", `{"a": {"$lt": "z"}}`, false},
+		{"compare strings", `{"s": {"$gt": "Apple"}}`, true},
+		{"compare array elements", `{"arr": {"$gt": 1}}`, true},
+		{"in", `{"a": {"$in": [3, 1]}}`, true},
+		{"nin", `{"a": {"$nin": [3, 1]}}`, false},
+		{"exists", `{"nested.b": {"$exists": true}}`, true},
+		{"not exists", `{"nested.c": {"$exists": false}}`, true},
+		{"nested null", `{"nested.b": null}`, true},
+		{"regex", `{"s": {"$regex": "^hel"}}`, false},
+		{"regex with options", `{"s": {"$regex": "^hel", "$options": "i"}}`, true},
+		{"not", `{"a": {"$not": {"$gt": 5}}}`, true},
+		{"and", `{"$and": [{"a": 1}, {"s": "Hello"}]}`, true},
+		{"or", `{"$or": [{"a": 2}, {"s": "Hello"}]}`, true},
+		{"nor", `{"$nor": [{"a": 2}, {"s": "Hello"}]}`, false},
+		{"eq on object", `{"nested": {"b": null}}`, true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			matched, err := Match(doc, parseQuery(t, `{"filter": `+tc.filter+`}`).Filter)
+			assertNilErr(t, err)
+			assert.Equal(t, tc.want, matched)
+		})
+	}
+
+	invalid := []string{
+		`{"$foo": 1}`,
+		`{"a": {"$foo": 1}}`,
+		`{"a": {"$in": 1}}`,
+		`{"a": {"$exists": "yes"}}`,
+		`{"s": {"$regex": "("}}`,
+		`{"$or": []}`,
+		`{"$and": [1]}`,
+		`{"a": {"$not": 1}}`,
+	}
+
+	for _, filter := range invalid {
+		t.Run("invalid "+filter, func(t *testing.T) {
+			_, err := Match(doc, parseQuery(t, `{"filter": `+filter+`}`).Filter)
+			assertErr(t, err)
+		})
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	f, err := compileFilter(parseQuery(t, `{"filter": {"$or": [
+		{"name": {"$regex": "^A"}},
+		{"role": {"$not": {"$regex": "^a", "$options": "i"}}}
+	]}}`).Filter)
+	assertNilErr(t, err)
+	checkDeepEquals(t, len(f.regexps), 2)
+
+	// matching reuses the compiled expressions
+	for _, name := range []string{"Alice", "Bob", "Ann"} {
+		_, err := f.matches(map[string]interface{}{"name": name, "role": "admin"})
+		assertNilErr(t, err)
+	}
+	checkDeepEquals(t, len(f.regexps), 2)
+
+	_, err = compileFilter(parseQuery(t, `{"filter": {"$and": [{"a": 1}, {"s": {"$regex": "("}}]}}`).Filter)
+	assertErr(t, err)
+}
+
+func TestFileIndex_Query(t *testing.T) {
+	t.Run("filter", func(t *testing.T) {
+		setupQueryDocs()
+
+		checkDeepEquals(t, queryKeys(t, `{"filter": {"role": "user"}}`), []string{"bob", "carol"})
+		checkDeepEquals(t, queryKeys(t, `{"filter": {"profile.country": {"$in": ["CA", "MX"]}}}`), []string{"alice"})
+		checkDeepEquals(t, queryKeys(t, `{"filter": {"$or": [{"age": {"$lt": 30}}, {"tags": "ops"}]}}`), []string{"alice", "bob"})
+		checkDeepEquals(t, queryKeys(t, `{"filter": {"nope": 1}}`), []string{})
+	})
+
+	t.Run("sort, skip and limit", func(t *testing.T) {
+		setupQueryDocs()
+
+		checkDeepEquals(t, queryKeys(t, `{"filter": {"age": {"$exists": true}}, "sort": ["-age"]}`), []string{"carol", "alice", "bob"})
+		checkDeepEquals(t, queryKeys(t, `{"sort": ["role", "name"]}`), []string{"ops", "alice", "bob", "carol"})
+		checkDeepEquals(t, queryKeys(t, `{"sort": ["age"], "skip": 1, "limit": 2}`), []string{"bob", "alice"})
+		checkDeepEquals(t, queryKeys(t, `{"skip": 10}`), []string{})
+	})
+
+	t.Run("filter on resolved references", func(t *testing.T) {
+		setupQueryDocs()
+
+		checkDeepEquals(t, queryKeys(t, `{"filter": {"team.title": "Operations"}}`), []string{})
+		checkDeepEquals(t, queryKeys(t, `{"filter": {"team.title": "Operations"}, "depth": 1}`), []string{"alice"})
+
+		res, err := I.Query(parseQuery(t, `{"filter": {"name": "Alice"}, "depth": 1}`))
+		assertNilErr(t, err)
+		team, _ := GetPath(res[0].Document, SplitPath("team.title"))
+		checkDeepEquals(t, team, "Operations")
+	})
+
+	t.Run("uses field indexes", func(t *testing.T) {
+		setupQueryDocs()
+		I.AddFieldIndex("role")
+
+		checkDeepEquals(t, queryKeys(t, `{"filter": {"role": "user", "age": {"$gt": 30}}}`), []string{"carol"})
+		checkDeepEquals(t, queryKeys(t, `{"filter": {"role": {"$eq": "admin"}}}`), []string{"alice"})
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		setupQueryDocs()
+
+		_, err := I.Query(parseQuery(t, `{"filter": {"age": {"$bad": 1}}}`))
+		assertErr(t, err)
+	})
+}
@@ -0,0 +1,125 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RedactionsKey is the key of the document holding the redaction rules
+// applied to documents inlined by ResolveReferences, of the form
+//
+//	{"rules": [{"prefix": "user.", "strip": ["password_hash"], "mask": ["email"]}]}
+const RedactionsKey = "_redactions"
+
+// MaskedValue replaces the value of masked fields
+const MaskedValue = "***"
+
+// redactionRule removes the fields at strip and masks the ones at mask in
+// documents with keys starting with prefix when they are inlined
+type redactionRule struct {
+	prefix string
+	strip  [][]string
+	mask   [][]string
+}
+
+// parseRedactionsDoc converts a redactions document into its rules, along
+// with a message for each field that doesn't match the format
+func parseRedactionsDoc(doc map[string]interface{}) ([]redactionRule, []string) {
+	if doc == nil {
+		return nil, []string{"/: redactions document must be a json object"}
+	}
+
+	rawRules, ok := doc["rules"].([]interface{})
+	if !ok {
+		return nil, []string{"/rules: must be an array of rules"}
+	}
+
+	var errs []string
+	rules := []redactionRule{}
+	for n, raw := range rawRules {
+		at := fmt.Sprintf("/rules/%d", n)
+		r, ok := raw.(map[string]interface{})
+		if !ok {
+			errs = append(errs, at+": must be a json object")
+			continue
+		}
+
+		var rule redactionRule
+		if prefix, ok := r["prefix"]; ok {
+			if rule.prefix, ok = prefix.(string); !ok {
+				errs = append(errs, at+"/prefix: must be a string")
+			}
+		}
+
+		strip, ok := stringList(r["strip"])
+		if !ok {
+			errs = append(errs, at+"/strip: must be an array of strings")
+		}
+		mask, ok := stringList(r["mask"])
+		if !ok {
+			errs = append(errs, at+"/mask: must be an array of strings")
+		}
+		if len(strip) == 0 && len(mask) == 0 {
+			errs = append(errs, at+": must strip or mask at least one field")
+		}
+
+		for _, field := range strip {
+			rule.strip = append(rule.strip, ParseFieldPath(field))
+		}
+		for _, field := range mask {
+			rule.mask = append(rule.mask, ParseFieldPath(field))
+		}
+		rules = append(rules, rule)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return rules, nil
+}
+
+// updateRedactions replaces the redaction rules if key holds them.
+// Callers must hold i.mu
+func (i *FileIndex) updateRedactions(key string, doc map[string]interface{}) {
+	if key != RedactionsKey {
+		return
+	}
+
+	rules, errs := parseRedactionsDoc(doc)
+	if !usableConfig(key, doc, errs) {
+		rules = nil
+	}
+	i.redactions = rules
+}
+
+// loadRedactions registers the redaction rules in the index, if any
+func (i *FileIndex) loadRedactions() {
+	doc := i.readConfigDoc(RedactionsKey)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.updateRedactions(RedactionsKey, doc)
+}
+
+// redact strips and masks the fields of doc, the contents of key, for
+// every redaction rule matching key
+func (i *FileIndex) redact(key string, doc map[string]interface{}) {
+	i.mu.RLock()
+	rules := i.redactions
+	i.mu.RUnlock()
+
+	for _, rule := range rules {
+		if !strings.HasPrefix(key, rule.prefix) {
+			continue
+		}
+
+		for _, path := range rule.strip {
+			_, _ = DeletePath(doc, path)
+		}
+		for _, path := range rule.mask {
+			if _, ok := GetPath(doc, path); ok {
+				_, _ = SetPath(doc, path, MaskedValue)
+			}
+		}
+	}
+}
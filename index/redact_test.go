@@ -0,0 +1,123 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileIndex_Validate_redactions(t *testing.T) {
+	setup()
+
+	err := I.Put(&File{FileName: RedactionsKey}, []byte(`{"rules": [
+		{"prefix": 1, "strip": ["password_hash"]},
+		{"prefix": "user.", "strip": "email"},
+		{"prefix": "user."},
+		"user."
+	]}`))
+	assert.Equal(t, []string{
+		"/rules/0/prefix: must be a string",
+		"/rules/1/strip: must be an array of strings",
+		"/rules/1: must strip or mask at least one field",
+		"/rules/2: must strip or mask at least one field",
+		"/rules/3: must be a json object",
+	}, validationErrors(t, err))
+
+	err = I.Put(&File{FileName: RedactionsKey}, []byte(`{}`))
+	assert.Equal(t, []string{"/rules: must be an array of rules"}, validationErrors(t, err))
+	checkKeyNotInIndex(t, RedactionsKey)
+}
+
+func TestResolveReferences_redactions(t *testing.T) {
+	setupRedactionDocs := func() {
+		setup()
+		makeNewJSON("user.alice", map[string]interface{}{
+			"name":          "Alice",
+			"email":         "alice@example.com",
+			"password_hash": "abc123",
+			"profile":       map[string]interface{}{"phone": "555-0100", "city": "Toronto"},
+			"team":          "REF::team.ops",
+		})
+		makeNewJSON("team.ops", map[string]interface{}{"name": "ops", "lead": "REF::user.alice"})
+		makeNewJSON("post.1", map[string]interface{}{"title": "hi", "author": "REF::user.alice"})
+		makeNewJSON(RedactionsKey, map[string]interface{}{"rules": []interface{}{
+			map[string]interface{}{"prefix": "user.", "strip": []interface{}{"password_hash", "team"}, "mask": []interface{}{"email", "profile.phone", "missing"}},
+		}})
+		I.Regenerate()
+	}
+
+	t.Run("inlined documents are redacted", func(t *testing.T) {
+		setupRedactionDocs()
+
+		got := ResolveReferences(map[string]interface{}{"title": "hi", "author": "REF::user.alice"}, 1)
+		assert.Equal(t, map[string]interface{}{
+			"title": "hi",
+			"author": map[string]interface{}{
+				"name":    "Alice",
+				"email":   MaskedValue,
+				"profile": map[string]interface{}{"phone": MaskedValue, "city": "Toronto"},
+			},
+		}, got)
+	})
+
+	t.Run("documents inlined deeper are redacted", func(t *testing.T) {
+		setupRedactionDocs()
+
+		got := ResolveReferences("REF::team.ops", 2)
+		lead := got.(map[string]interface{})["lead"].(map[string]interface{})
+		assert.Equal(t, MaskedValue, lead["email"])
+		assert.NotContains(t, lead, "password_hash")
+	})
+
+	t.Run("the root document and the stored one are not redacted", func(t *testing.T) {
+		setupRedactionDocs()
+
+		file, _ := I.Lookup("user.alice")
+		doc, _ := file.ToMap()
+		got := ResolveReferences(doc, 1).(map[string]interface{})
+		assert.Equal(t, "abc123", got["password_hash"])
+
+		doc, _ = file.ToMap()
+		assert.Equal(t, "alice@example.com", doc["email"])
+	})
+
+	t.Run("deleting the rules stops redacting", func(t *testing.T) {
+		setupRedactionDocs()
+
+		file, _ := I.Lookup(RedactionsKey)
+		assertNilErr(t, I.Delete(file))
+		got := ResolveReferences("REF::user.alice", 1).(map[string]interface{})
+		assert.Equal(t, "abc123", got["password_hash"])
+	})
+
+	t.Run("rules edited into an invalid state on disk are ignored", func(t *testing.T) {
+		setupRedactionDocs()
+
+		makeNewFile(RedactionsKey+".json", `{"rules": [{"prefix": "user."}]}`)
+		I.Regenerate()
+		got := ResolveReferences("REF::user.alice", 1).(map[string]interface{})
+		assert.Equal(t, "abc123", got["password_hash"])
+	})
+
+	t.Run("references the filter rejects are left as is", func(t *testing.T) {
+		setupRedactionDocs()
+
+		var asked []string
+		canRead := func(key string, doc map[string]interface{}) bool {
+			asked = append(asked, key)
+			return key != "user.alice"
+		}
+
+		got := ResolveReferencesFor(map[string]interface{}{
+			"author":  "REF::user.alice",
+			"team":    "REF::team.ops",
+			"missing": "REF::user.nobody",
+		}, 2, canRead)
+		assert.Equal(t, map[string]interface{}{
+			"author":  "REF::user.alice",
+			"team":    map[string]interface{}{"name": "ops", "lead": "REF::user.alice"},
+			"missing": "REF::ERR key 'user.nobody' not found",
+		}, got)
+		assert.ElementsMatch(t, []string{"user.alice", "team.ops", "user.alice", "user.nobody"}, asked)
+	})
+}
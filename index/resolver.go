@@ -6,9 +6,19 @@ import (
 	"strings"
 )
 
+// ReadFilter decides whether a reference to key may be resolved, given the
+// contents of key or nil if it doesn't exist
+type ReadFilter func(key string, doc map[string]interface{}) bool
+
 // ResolveReferences tries to find key references and
 // if found, replace the references with their corresponding value
 func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
+	return ResolveReferencesFor(jsonVal, depthLeft, nil)
+}
+
+// ResolveReferencesFor resolves references like ResolveReferences, leaving
+// references to keys canRead rejects as they are. A nil canRead resolves every reference
+func ResolveReferencesFor(jsonVal interface{}, depthLeft int, canRead ReadFilter) interface{} {
 	// if max recursive depth is exceeded, return as is
 	if depthLeft < 1 {
 		return jsonVal
@@ -22,7 +32,7 @@ func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
 
 		// if value is reference to another key
 		if strings.Contains(valString, "REF::") {
-			resolvedString := resolveString(valString, depthLeft)
+			resolvedString := resolveString(valString, depthLeft, canRead)
 			return resolvedString
 		}
 
@@ -36,7 +46,7 @@ func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
 		// for each value in the slice, try to resolve it recursively
 		for i := 0; i < numberOfValues; i++ {
 			pointer := val.Index(i)
-			newSlice[i] = ResolveReferences(pointer.Interface(), depthLeft)
+			newSlice[i] = ResolveReferencesFor(pointer.Interface(), depthLeft, canRead)
 		}
 
 		return newSlice
@@ -47,7 +57,7 @@ func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
 		// for each value in the map, try to resolve it recursively
 		for _, key := range val.MapKeys() {
 			nestedVal := val.MapIndex(key).Interface()
-			newMap[key.String()] = ResolveReferences(nestedVal, depthLeft)
+			newMap[key.String()] = ResolveReferencesFor(nestedVal, depthLeft, canRead)
 		}
 
 		return newMap
@@ -57,22 +67,34 @@ func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
 	}
 }
 
-// resolves a single string that has a reference in it
-func resolveString(valString string, depthLeft int) interface{} {
+// resolves a single string that has a reference in it, with the
+// redaction rules matching the referenced key applied
+func resolveString(valString string, depthLeft int, canRead ReadFilter) interface{} {
 	key := strings.Replace(valString, "REF::", "", 1)
 	file, ok := I.Lookup(key)
 
 	// if key found, get contents
+	var jsonMap map[string]interface{}
+	var err error
 	if ok {
 		// change bytes into map
-		jsonMap, err := file.ToMap()
-		if err != nil {
-			errMessage := fmt.Sprintf("REF::ERR key '%s' cannot be parsed into json: %s", key, err.Error())
-			return errMessage
-		}
-		return ResolveReferences(jsonMap, depthLeft-1)
+		jsonMap, err = file.ToMap()
+	}
+
+	// keys the caller can't read are left unresolved, whether they exist or not
+	if canRead != nil && !canRead(key, jsonMap) {
+		return valString
 	}
 
 	// if key not found
-	return fmt.Sprintf("REF::ERR key '%s' not found", key)
+	if !ok {
+		return fmt.Sprintf("REF::ERR key '%s' not found", key)
+	}
+	if err != nil {
+		errMessage := fmt.Sprintf("REF::ERR key '%s' cannot be parsed into json: %s", key, err.Error())
+		return errMessage
+	}
+
+	I.redact(key, jsonMap)
+	return ResolveReferencesFor(jsonMap, depthLeft-1, canRead)
 }
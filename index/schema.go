@@ -0,0 +1,484 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// SchemaPrefix is the key prefix of documents holding schemas. A schema
+// document binds a json schema to every key matching its glob pattern, e.g.
+//
+//	{"pattern": "user.*", "schema": {"type": "object", "required": ["email"]}}
+const SchemaPrefix = "_schema."
+
+// ValidationError is returned when a document doesn't conform to the
+// schemas bound to its key
+type ValidationError struct {
+	Key    string
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("key '%s' failed validation: %s", e.Key, strings.Join(e.Errors, "; "))
+}
+
+// schemaBinding is a parsed schema document
+type schemaBinding struct {
+	pattern  string
+	schema   map[string]interface{}
+	patterns schemaPatterns
+}
+
+// schemaPatterns holds the compiled pattern keywords of a schema by their source
+type schemaPatterns map[string]*regexp.Regexp
+
+// IsSchemaKey returns whether key holds a schema document
+func IsSchemaKey(key string) bool {
+	return strings.HasPrefix(key, SchemaPrefix)
+}
+
+// parseSchemaDoc returns the binding described by doc and any reasons it is invalid
+func parseSchemaDoc(doc map[string]interface{}) (*schemaBinding, []string) {
+	if doc == nil {
+		return nil, []string{"/: schema document must be a json object"}
+	}
+
+	var errs []string
+	pattern, ok := doc["pattern"].(string)
+	if !ok || pattern == "" {
+		errs = append(errs, "/pattern: must be a glob matching keys, e.g. user.*")
+	} else if _, err := path.Match(pattern, ""); err != nil {
+		errs = append(errs, fmt.Sprintf("/pattern: %s", err.Error()))
+	}
+
+	patterns := schemaPatterns{}
+	schema, ok := doc["schema"].(map[string]interface{})
+	if !ok {
+		errs = append(errs, "/schema: must be a json object")
+	} else {
+		compilePatterns(schema, "/schema", patterns, &errs)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return &schemaBinding{pattern: pattern, schema: schema, patterns: patterns}, nil
+}
+
+// compilePatterns compiles the pattern keyword of schema and every
+// subschema into patterns, appending a message to errs for each invalid one
+func compilePatterns(schema map[string]interface{}, ptr string, patterns schemaPatterns, errs *[]string) {
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			*errs = append(*errs, fmt.Sprintf("%s/pattern: invalid pattern %s: %s", ptr, mustJSON(pattern), err.Error()))
+		} else {
+			patterns[pattern] = re
+		}
+	}
+
+	sub := func(val interface{}, at string) {
+		if subSchema, ok := val.(map[string]interface{}); ok {
+			compilePatterns(subSchema, at, patterns, errs)
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+	for name, prop := range props {
+		sub(prop, ptr+"/properties/"+escapePointer(name))
+	}
+
+	sub(schema["items"], ptr+"/items")
+	if items, ok := schema["items"].([]interface{}); ok {
+		for n, item := range items {
+			sub(item, fmt.Sprintf("%s/items/%d", ptr, n))
+		}
+	}
+
+	sub(schema["additionalProperties"], ptr+"/additionalProperties")
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		list, _ := schema[keyword].([]interface{})
+		for n, item := range list {
+			sub(item, fmt.Sprintf("%s/%s/%d", ptr, keyword, n))
+		}
+	}
+	sub(schema["not"], ptr+"/not")
+}
+
+// updateSchema registers, replaces or removes the schema held by key.
+// Callers must hold i.mu
+func (i *FileIndex) updateSchema(key string, doc map[string]interface{}) {
+	if !IsSchemaKey(key) {
+		return
+	}
+
+	binding, errs := parseSchemaDoc(doc)
+	if !usableConfig(key, doc, errs) {
+		delete(i.schemas, key)
+		return
+	}
+	i.schemas[key] = binding
+}
+
+// loadSchemas registers every schema document in the index
+func (i *FileIndex) loadSchemas() {
+	for _, key := range i.List() {
+		if !IsSchemaKey(key) {
+			continue
+		}
+
+		doc := i.readConfigDoc(key)
+
+		// write lock on index
+		i.mu.Lock()
+		i.updateSchema(key, doc)
+		i.mu.Unlock()
+	}
+}
+
+// Validate checks content against every schema bound to key, and schema
+// webhook and redaction documents against their formats
+func (i *FileIndex) Validate(key string, content []byte) error {
+	var jsonVal interface{}
+	isJSON := json.Unmarshal(content, &jsonVal) == nil
+
+	if key == WebhooksKey {
+		doc, _ := jsonVal.(map[string]interface{})
+		if _, errs := parseWebhooksDoc(doc); len(errs) > 0 {
+			return &ValidationError{Key: key, Errors: errs}
+		}
+		return nil
+	}
+
+	if key == RedactionsKey {
+		doc, _ := jsonVal.(map[string]interface{})
+		if _, errs := parseRedactionsDoc(doc); len(errs) > 0 {
+			return &ValidationError{Key: key, Errors: errs}
+		}
+		return nil
+	}
+
+	if IsSchemaKey(key) {
+		doc, _ := jsonVal.(map[string]interface{})
+		if _, errs := parseSchemaDoc(doc); len(errs) > 0 {
+			return &ValidationError{Key: key, Errors: errs}
+		}
+		return nil
+	}
+
+	schemas := i.schemasFor(key)
+	if len(schemas) == 0 {
+		return nil
+	}
+
+	if !isJSON {
+		return &ValidationError{Key: key, Errors: []string{"/: document is not valid json"}}
+	}
+
+	var errs []string
+	for _, binding := range schemas {
+		validateValue(binding.schema, jsonVal, "", binding.patterns, &errs)
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Key: key, Errors: errs}
+	}
+	return nil
+}
+
+// schemasFor returns the schemas bound to key, ordered by schema key
+func (i *FileIndex) schemasFor(key string) []*schemaBinding {
+	// read lock on index
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	names := []string{}
+	for name, binding := range i.schemas {
+		if matched, _ := path.Match(binding.pattern, key); matched {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	res := []*schemaBinding{}
+	for _, name := range names {
+		res = append(res, i.schemas[name])
+	}
+	return res
+}
+
+// validateValue appends a message to errs for every way val breaks schema.
+// Supports the commonly used keywords of json schema: type, enum, const,
+// number and string bounds, pattern, items, properties, required,
+// additionalProperties, allOf, anyOf, oneOf and not. Patterns are looked up
+// in patterns, see compilePatterns
+func validateValue(schema map[string]interface{}, val interface{}, ptr string, patterns schemaPatterns, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		loc := ptr
+		if loc == "" {
+			loc = "/"
+		}
+		*errs = append(*errs, loc+": "+fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, val) {
+		fail("must be of type %s, got %s", typeList(t), jsonType(val))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, val)
+		}
+		if !found {
+			fail("must be one of %s", mustJSON(enum))
+		}
+	}
+
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, val) {
+		fail("must be %s", mustJSON(c))
+	}
+
+	switch v := val.(type) {
+	case float64:
+		validateNumber(schema, v, fail)
+	case string:
+		validateString(schema, v, patterns, fail)
+	case []interface{}:
+		validateArray(schema, v, ptr, patterns, errs, fail)
+	case map[string]interface{}:
+		validateObject(schema, v, ptr, patterns, errs, fail)
+	}
+
+	validateCombinators(schema, val, ptr, patterns, errs, fail)
+}
+
+func validateNumber(schema map[string]interface{}, v float64, fail func(string, ...interface{})) {
+	if min, ok := schema["minimum"].(float64); ok && v < min {
+		fail("must be >= %v", min)
+	}
+	if max, ok := schema["maximum"].(float64); ok && v > max {
+		fail("must be <= %v", max)
+	}
+	if min, ok := schema["exclusiveMinimum"].(float64); ok && v <= min {
+		fail("must be > %v", min)
+	}
+	if max, ok := schema["exclusiveMaximum"].(float64); ok && v >= max {
+		fail("must be < %v", max)
+	}
+	if m, ok := schema["multipleOf"].(float64); ok && m > 0 {
+		if q := v / m; q != math.Trunc(q) {
+			fail("must be a multiple of %v", m)
+		}
+	}
+}
+
+func validateString(schema map[string]interface{}, v string, patterns schemaPatterns, fail func(string, ...interface{})) {
+	length := float64(utf8.RuneCountInString(v))
+	if min, ok := schema["minLength"].(float64); ok && length < min {
+		fail("must be at least %v characters", min)
+	}
+	if max, ok := schema["maxLength"].(float64); ok && length > max {
+		fail("must be at most %v characters", max)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, ok := patterns[pattern]
+		if !ok {
+			fail("schema has invalid pattern %s", mustJSON(pattern))
+		} else if !re.MatchString(v) {
+			fail("must match pattern %s", mustJSON(pattern))
+		}
+	}
+}
+
+func validateArray(schema map[string]interface{}, v []interface{}, ptr string, patterns schemaPatterns, errs *[]string, fail func(string, ...interface{})) {
+	n := float64(len(v))
+	if min, ok := schema["minItems"].(float64); ok && n < min {
+		fail("must have at least %v items", min)
+	}
+	if max, ok := schema["maxItems"].(float64); ok && n > max {
+		fail("must have at most %v items", max)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for a := range v {
+			for b := a + 1; b < len(v); b++ {
+				if reflect.DeepEqual(v[a], v[b]) {
+					fail("items %d and %d must be unique", a, b)
+				}
+			}
+		}
+	}
+
+	switch items := schema["items"].(type) {
+	case map[string]interface{}:
+		for n, item := range v {
+			validateValue(items, item, fmt.Sprintf("%s/%d", ptr, n), patterns, errs)
+		}
+	case []interface{}:
+		// tuple validation, one schema per position
+		for n, item := range v {
+			if n >= len(items) {
+				break
+			}
+			if itemSchema, ok := items[n].(map[string]interface{}); ok {
+				validateValue(itemSchema, item, fmt.Sprintf("%s/%d", ptr, n), patterns, errs)
+			}
+		}
+	}
+}
+
+func validateObject(schema map[string]interface{}, v map[string]interface{}, ptr string, patterns schemaPatterns, errs *[]string, fail func(string, ...interface{})) {
+	n := float64(len(v))
+	if min, ok := schema["minProperties"].(float64); ok && n < min {
+		fail("must have at least %v properties", min)
+	}
+	if max, ok := schema["maxProperties"].(float64); ok && n > max {
+		fail("must have at most %v properties", max)
+	}
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			if name, isString := r.(string); isString {
+				if _, present := v[name]; !present {
+					fail("missing required property %s", mustJSON(name))
+				}
+			}
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childPtr := ptr + "/" + escapePointer(name)
+		if propSchema, ok := props[name].(map[string]interface{}); ok {
+			validateValue(propSchema, v[name], childPtr, patterns, errs)
+			continue
+		}
+		if _, declared := props[name]; declared {
+			continue
+		}
+
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				*errs = append(*errs, childPtr+": property is not allowed")
+			}
+		case map[string]interface{}:
+			validateValue(extra, v[name], childPtr, patterns, errs)
+		}
+	}
+}
+
+func validateCombinators(schema map[string]interface{}, val interface{}, ptr string, patterns schemaPatterns, errs *[]string, fail func(string, ...interface{})) {
+	// count how many subschemas val conforms to
+	matching := func(list []interface{}) (n int, subErrs []string) {
+		for _, s := range list {
+			sub, ok := s.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			var e []string
+			validateValue(sub, val, ptr, patterns, &e)
+			if len(e) == 0 {
+				n++
+			}
+			subErrs = append(subErrs, e...)
+		}
+		return n, subErrs
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		_, subErrs := matching(all)
+		*errs = append(*errs, subErrs...)
+	}
+	if some, ok := schema["anyOf"].([]interface{}); ok {
+		if n, _ := matching(some); n == 0 {
+			fail("must match at least one schema in anyOf")
+		}
+	}
+	if one, ok := schema["oneOf"].([]interface{}); ok {
+		if n, _ := matching(one); n != 1 {
+			fail("must match exactly one schema in oneOf, matched %d", n)
+		}
+	}
+	if not, ok := schema["not"].(map[string]interface{}); ok {
+		if n, _ := matching([]interface{}{not}); n == 1 {
+			fail("must not match schema in not")
+		}
+	}
+}
+
+// matchesType returns whether val is of the type, or one of the types, in t
+func matchesType(t interface{}, val interface{}) bool {
+	types := []interface{}{t}
+	if list, ok := t.([]interface{}); ok {
+		types = list
+	}
+
+	actual := jsonType(val)
+	for _, want := range types {
+		if want == actual || (want == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the json schema type name of val
+func jsonType(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// typeList formats the type keyword for error messages
+func typeList(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := []string{}
+		for _, name := range list {
+			names = append(names, fmt.Sprint(name))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+// escapePointer escapes a property name for use in a json pointer
+func escapePointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+// mustJSON encodes v as json for error messages
+func mustJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
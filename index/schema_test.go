@@ -0,0 +1,158 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validationErrors(t *testing.T, err error) []string {
+	t.Helper()
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("got %v, want a validation error", err)
+	}
+	return validationErr.Errors
+}
+
+func TestValidateValue(t *testing.T) {
+	schema := map[string]interface{}{}
+	_ = json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 2, "pattern": "^[A-Z]"},
+			"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+			"role": {"enum": ["admin", "user"]},
+			"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true, "maxItems": 3},
+			"contact": {"oneOf": [{"required": ["email"]}, {"required": ["phone"]}]},
+			"score": {"type": ["number", "null"], "multipleOf": 0.5}
+		}
+	}`), &schema)
+
+	patterns := schemaPatterns{}
+	var compileErrs []string
+	compilePatterns(schema, "/schema", patterns, &compileErrs)
+	assert.Empty(t, compileErrs)
+
+	tt := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{"valid", `{"name": "Al", "age": 3, "role": "user", "tags": ["a"], "contact": {"email": "a"}, "score": 1.5}`, nil},
+		{"null allowed by type list", `{"name": "Al", "age": 3, "score": null}`, nil},
+		{"wrong root type", `[]`, []string{"/: must be of type object, got array"}},
+		{"missing required", `{}`, []string{
+			`/: missing required property "name"`,
+			`/: missing required property "age"`,
+		}},
+		{"every error is listed", `{"name": "a", "age": 1.5, "role": "root", "tags": ["a", "a", 1, "b"], "extra": true}`, []string{
+			"/age: must be of type integer, got number",
+			"/extra: property is not allowed",
+			`/name: must be at least 2 characters`,
+			`/name: must match pattern "^[A-Z]"`,
+			`/role: must be one of ["admin","user"]`,
+			"/tags: must have at most 3 items",
+			"/tags: items 0 and 1 must be unique",
+			"/tags/2: must be of type string, got integer",
+		}},
+		{"number bounds", `{"name": "Al", "age": 150, "score": 0.3}`, []string{
+			"/age: must be < 150",
+			"/score: must be a multiple of 0.5",
+		}},
+		{"one of", `{"name": "Al", "age": 1, "contact": {"email": "a", "phone": "b"}}`, []string{
+			"/contact: must match exactly one schema in oneOf, matched 2",
+		}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var doc interface{}
+			assertNilErr(t, json.Unmarshal([]byte(tc.doc), &doc))
+
+			var errs []string
+			validateValue(schema, doc, "", patterns, &errs)
+			assert.Equal(t, tc.want, errs)
+		})
+	}
+}
+
+func TestFileIndex_Validate(t *testing.T) {
+	userSchema := `{"pattern": "user.*", "schema": {
+		"type": "object",
+		"required": ["email"],
+		"properties": {"email": {"type": "string"}}
+	}}`
+
+	t.Run("schema documents must be well formed", func(t *testing.T) {
+		setup()
+
+		err := I.Put(&File{FileName: SchemaPrefix + "user"}, []byte(`{"pattern": "[", "schema": 1}`))
+		assert.Equal(t, []string{
+			"/pattern: syntax error in pattern",
+			"/schema: must be a json object",
+		}, validationErrors(t, err))
+		checkKeyNotInIndex(t, SchemaPrefix+"user")
+	})
+
+	t.Run("invalid patterns are rejected when the schema is written", func(t *testing.T) {
+		setup()
+
+		err := I.Put(&File{FileName: SchemaPrefix + "user"}, []byte(`{"pattern": "user.*", "schema": {
+			"pattern": "^a",
+			"properties": {"name": {"pattern": "("}},
+			"items": [{"anyOf": [{"pattern": "[z-a]"}]}]
+		}}`))
+		assert.Equal(t, []string{
+			"/schema/properties/name/pattern: invalid pattern \"(\": error parsing regexp: missing closing ): `(`",
+			"/schema/items/0/anyOf/0/pattern: invalid pattern \"[z-a]\": error parsing regexp: invalid character class range: `z-a`",
+		}, validationErrors(t, err))
+		checkKeyNotInIndex(t, SchemaPrefix+"user")
+	})
+
+	t.Run("writes to matching keys are validated", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.Put(&File{FileName: SchemaPrefix + "user"}, []byte(userSchema)))
+
+		err := I.Put(&File{FileName: "user.alice"}, []byte(`{"name": "alice"}`))
+		assert.Equal(t, []string{`/: missing required property "email"`}, validationErrors(t, err))
+		checkKeyNotInIndex(t, "user.alice")
+
+		err = I.Put(&File{FileName: "user.alice"}, []byte(`not json`))
+		assert.Equal(t, []string{"/: document is not valid json"}, validationErrors(t, err))
+
+		// other keys are not affected
+		assertNilErr(t, I.Put(&File{FileName: "order.1"}, []byte(`not json`)))
+
+		file := &File{FileName: "user.alice"}
+		assertNilErr(t, I.Put(file, []byte(`{"email": "a@b.c"}`)))
+		_, err = I.PatchField(file, "name", "alice")
+		assertNilErr(t, err)
+
+		_, err = I.PatchField(file, "email", nil)
+		assert.Equal(t, []string{"/email: must be of type string, got null"}, validationErrors(t, err))
+		checkContentEqual(t, "user.alice", map[string]interface{}{"email": "a@b.c", "name": "alice"})
+
+		err = I.Transact([]TxnOp{{Op: TxnPut, Key: "user.bob", Value: json.RawMessage(`{}`)}})
+		assert.Equal(t, []string{`/: missing required property "email"`}, validationErrors(t, err))
+		checkKeyNotInIndex(t, "user.bob")
+	})
+
+	t.Run("schemas are loaded on regenerate and removed on delete", func(t *testing.T) {
+		setup()
+		makeNewFile(SchemaPrefix+"user.json", userSchema)
+		I.Regenerate()
+
+		err := I.Put(&File{FileName: "user.alice"}, []byte(`{}`))
+		validationErrors(t, err)
+
+		file, _ := I.Lookup(SchemaPrefix + "user")
+		assertNilErr(t, I.Delete(file))
+		assertNilErr(t, I.Put(&File{FileName: "user.alice"}, []byte(`{}`)))
+	})
+}
@@ -0,0 +1,257 @@
+package index
+
+import (
+	"encoding/json"
+	"html"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// HighlightStart and HighlightEnd wrap matching terms in search highlights
+const (
+	HighlightStart = "<em>"
+	HighlightEnd   = "</em>"
+)
+
+// textIndex is an inverted index from the terms in string values of
+// documents to where they occur
+type textIndex struct {
+	// term -> key -> field key -> occurrences
+	postings map[string]map[string]map[string]*occurrences
+	// key -> terms currently indexed for it
+	terms map[string][]string
+}
+
+// occurrences counts how often a term is in the field at segments
+type occurrences struct {
+	segments []string
+	count    int
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{
+		postings: map[string]map[string]map[string]*occurrences{},
+		terms:    map[string][]string{},
+	}
+}
+
+// fieldKey identifies the field at segments. Unlike a dotted path it can't
+// be mistaken for another field when field names hold dots
+func fieldKey(segments []string) string {
+	b, _ := json.Marshal(segments)
+	return string(b)
+}
+
+// SearchResult is a single document matched by a search
+type SearchResult struct {
+	Key   string  `json:"key"`
+	Score float64 `json:"score"`
+
+	// field path -> field value with matching terms highlighted
+	Highlights map[string]string `json:"highlights"`
+}
+
+// Tokenize splits text into lowercase terms made up of letters and digits
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// update replaces the entries of key with the terms found in doc,
+// a nil doc removes key entirely
+func (ti *textIndex) update(key string, doc map[string]interface{}) {
+	for _, term := range ti.terms[key] {
+		delete(ti.postings[term], key)
+		if len(ti.postings[term]) == 0 {
+			delete(ti.postings, term)
+		}
+	}
+	delete(ti.terms, key)
+
+	// config documents aren't searched so webhook secrets can't show up in highlights
+	if doc == nil || IsReservedKey(key) {
+		return
+	}
+
+	walkStrings(doc, nil, func(segments []string, s string) {
+		field := fieldKey(segments)
+		for _, term := range Tokenize(s) {
+			if ti.postings[term] == nil {
+				ti.postings[term] = map[string]map[string]*occurrences{}
+			}
+			if ti.postings[term][key] == nil {
+				ti.postings[term][key] = map[string]*occurrences{}
+				ti.terms[key] = append(ti.terms[key], term)
+			}
+			if ti.postings[term][key][field] == nil {
+				ti.postings[term][key][field] = &occurrences{segments: segments}
+			}
+			ti.postings[term][key][field].count++
+		}
+	})
+}
+
+// walkStrings calls fn with the path segments and value of every string inside
+// a json value. References to other keys aren't text and are skipped
+func walkStrings(jsonVal interface{}, segments []string, fn func(segments []string, s string)) {
+	// every child gets its own copy so siblings don't share a backing array
+	join := func(seg string) []string {
+		return append(append([]string{}, segments...), seg)
+	}
+
+	switch v := jsonVal.(type) {
+	case string:
+		if !strings.Contains(v, "REF::") {
+			fn(segments, v)
+		}
+	case map[string]interface{}:
+		for k, child := range v {
+			walkStrings(child, join(k), fn)
+		}
+	case []interface{}:
+		for n, child := range v {
+			walkStrings(child, join(strconv.Itoa(n)), fn)
+		}
+	}
+}
+
+// Search returns up to limit documents containing any of the terms in query,
+// best matches first. Documents are ranked by tf-idf so rare terms count more
+func (i *FileIndex) Search(query string, limit int) []SearchResult {
+	terms := uniqueTerms(Tokenize(query))
+	scores, fields := i.score(terms)
+
+	res := []SearchResult{}
+	for key, score := range scores {
+		res = append(res, SearchResult{Key: key, Score: score})
+	}
+
+	sort.Slice(res, func(a, b int) bool {
+		if res[a].Score != res[b].Score {
+			return res[a].Score > res[b].Score
+		}
+		return res[a].Key < res[b].Key
+	})
+
+	if limit > 0 && limit < len(res) {
+		res = res[:limit]
+	}
+
+	// highlights are built from the current documents outside the index lock
+	for n := range res {
+		res[n].Highlights = i.highlight(res[n].Key, fields[res[n].Key], terms)
+	}
+	return res
+}
+
+// score returns the tf-idf score of every unexpired document matching terms
+// and the segments of the fields they matched in, by field key
+func (i *FileIndex) score(terms []string) (map[string]float64, map[string]map[string][]string) {
+	// read lock on index
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	now := time.Now()
+	scores := map[string]float64{}
+	fields := map[string]map[string][]string{}
+	total := float64(len(i.text.terms))
+
+	for _, term := range terms {
+		docs := i.text.postings[term]
+		idf := math.Log(1 + total/float64(len(docs)))
+
+		for key, matched := range docs {
+			if i.isExpired(key, now) {
+				continue
+			}
+
+			if fields[key] == nil {
+				fields[key] = map[string][]string{}
+			}
+			for field, occ := range matched {
+				scores[key] += float64(occ.count) * idf
+				fields[key][field] = occ.segments
+			}
+		}
+	}
+
+	// keep scores readable
+	for key, score := range scores {
+		scores[key] = math.Round(score*1000) / 1000
+	}
+	return scores, fields
+}
+
+// highlight returns the values of the given fields of key by their dotted
+// path, with every occurrence of terms wrapped in HighlightStart and HighlightEnd
+func (i *FileIndex) highlight(key string, fields map[string][]string, terms []string) map[string]string {
+	res := map[string]string{}
+
+	file, ok := i.Lookup(key)
+	if !ok {
+		return res
+	}
+
+	doc, err := file.ToMap()
+	if err != nil {
+		return res
+	}
+
+	wanted := map[string]bool{}
+	for _, term := range terms {
+		wanted[term] = true
+	}
+
+	for _, segments := range fields {
+		val, ok := GetPath(doc, segments)
+		s, isString := val.(string)
+		if !ok || !isString {
+			continue
+		}
+		res[strings.Join(segments, ".")] = highlightTerms(s, wanted)
+	}
+	return res
+}
+
+// highlightTerms wraps every word of s that is in terms. The rest of s is
+// html escaped so only the highlight tags are markup
+func highlightTerms(s string, terms map[string]bool) string {
+	var b strings.Builder
+	isWord := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+
+	runes := []rune(s)
+	for start := 0; start < len(runes); {
+		end := start + 1
+		for end < len(runes) && isWord(runes[end]) == isWord(runes[start]) {
+			end++
+		}
+
+		word := string(runes[start:end])
+		if isWord(runes[start]) && terms[strings.ToLower(word)] {
+			b.WriteString(HighlightStart + html.EscapeString(word) + HighlightEnd)
+		} else {
+			b.WriteString(html.EscapeString(word))
+		}
+		start = end
+	}
+	return b.String()
+}
+
+// uniqueTerms removes duplicate terms, keeping their order
+func uniqueTerms(terms []string) (res []string) {
+	seen := map[string]bool{}
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			res = append(res, term)
+		}
+	}
+	return res
+}
@@ -0,0 +1,111 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func searchKeys(query string) []string {
+	keys := []string{}
+	for _, r := range I.Search(query, 0) {
+		keys = append(keys, r.Key)
+	}
+	return keys
+}
+
+func TestTokenize(t *testing.T) {
+	checkDeepEquals(t, Tokenize("Hello, World! it's 2020"), []string{"hello", "world", "it", "s", "2020"})
+	checkDeepEquals(t, Tokenize("  ...  "), []string{})
+}
+
+func TestHighlightTerms(t *testing.T) {
+	terms := map[string]bool{"quick": true, "dog": true}
+	checkDeepEquals(t, highlightTerms("The Quick brown fox, lazy dog.", terms),
+		"The <em>Quick</em> brown fox, lazy <em>dog</em>.")
+	checkDeepEquals(t, highlightTerms("dogs", terms), "dogs")
+	checkDeepEquals(t, highlightTerms(`<script>alert("dog")</script> & dog's`, terms),
+		"&lt;script&gt;alert(&#34;<em>dog</em>&#34;)&lt;/script&gt; &amp; <em>dog</em>&#39;s")
+}
+
+func TestFileIndex_Search(t *testing.T) {
+	t.Run("ranks documents by matching terms", func(t *testing.T) {
+		setup()
+		makeNewJSON("pasta", map[string]interface{}{
+			"title": "Tomato pasta",
+			"steps": []interface{}{"boil pasta", "add tomato sauce"},
+		})
+		makeNewJSON("soup", map[string]interface{}{
+			"title": "Tomato soup",
+			"ref":   "REF::pasta",
+		})
+		makeNewJSON("salad", map[string]interface{}{
+			"title": "Green salad",
+		})
+		makeNewFile("broken.json", "not json")
+		I.Regenerate()
+
+		checkDeepEquals(t, searchKeys("pasta"), []string{"pasta"})
+		checkDeepEquals(t, searchKeys("TOMATO"), []string{"pasta", "soup"})
+		checkDeepEquals(t, searchKeys("tomato soup"), []string{"soup", "pasta"})
+		checkDeepEquals(t, searchKeys("nothing"), []string{})
+
+		res := I.Search("pasta", 0)
+		checkDeepEquals(t, res[0].Highlights, map[string]string{
+			"title":   "Tomato <em>pasta</em>",
+			"steps.0": "boil <em>pasta</em>",
+		})
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		setup()
+		makeNewJSON("a", map[string]interface{}{"text": "word word"})
+		makeNewJSON("b", map[string]interface{}{"text": "word"})
+		I.Regenerate()
+
+		checkDeepEquals(t, searchKeys("word"), []string{"a", "b"})
+		assert.Len(t, I.Search("word", 1), 1)
+	})
+
+	t.Run("index follows put, patch and delete", func(t *testing.T) {
+		setup()
+
+		file := &File{FileName: "note"}
+		assertNilErr(t, I.Put(file, []byte(`{"text": "first draft"}`)))
+		checkDeepEquals(t, searchKeys("draft"), []string{"note"})
+
+		_, err := I.PatchField(file, "text", "final version")
+		assertNilErr(t, err)
+		checkDeepEquals(t, searchKeys("draft"), []string{})
+		checkDeepEquals(t, searchKeys("final"), []string{"note"})
+
+		assertNilErr(t, I.Delete(file))
+		checkDeepEquals(t, searchKeys("final"), []string{})
+	})
+
+	t.Run("fields whose names hold dots are highlighted", func(t *testing.T) {
+		setup()
+		makeNewJSON("site", map[string]interface{}{
+			"example.com": "home page",
+			"links":       []interface{}{map[string]interface{}{"a.b": "about page"}},
+		})
+		I.Regenerate()
+
+		res := I.Search("page", 0)
+		checkDeepEquals(t, res[0].Highlights, map[string]string{
+			"example.com": "home <em>page</em>",
+			"links.0.a.b": "about <em>page</em>",
+		})
+	})
+
+	t.Run("config documents aren't searched", func(t *testing.T) {
+		setup()
+		makeNewJSON(WebhooksKey, map[string]interface{}{"targets": []interface{}{
+			map[string]interface{}{"url": "http://localhost", "secret": "hunter2"},
+		}})
+		makeNewJSON("note", map[string]interface{}{"text": "hunter2"})
+		I.Regenerate()
+
+		checkDeepEquals(t, searchKeys("hunter2"), []string{"note"})
+	})
+}
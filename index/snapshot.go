@@ -0,0 +1,269 @@
+package index
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	af "github.com/spf13/afero"
+)
+
+// Snapshot writes a gzipped tar archive of every document along with its
+// history and expiry as they were at a single point in time, and returns
+// the number of documents archived. Writes wait until the snapshot is done
+func (i *FileIndex) Snapshot(w io.Writer) (int, error) {
+	files := i.readLockAll()
+	defer func() {
+		i.mu.RUnlock()
+		for _, f := range files {
+			f.mu.RUnlock()
+		}
+	}()
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	count := 0
+	for _, f := range files {
+		info, err := i.FileSystem.Stat(f.ResolvePath())
+		if os.IsNotExist(err) {
+			// claimed by a write that hasn't happened yet
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		err = archiveFile(tw, f.ResolvePath(), f.FileName+".json", info)
+		if err == nil {
+			err = archiveDir(tw, historyPath(f.FileName), path.Join(HistoryDir, f.FileName))
+		}
+		if err == nil {
+			err = archiveIfExists(tw, expiryPath(f.FileName), path.Join(ExpiryDir, f.FileName))
+		}
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	return count, gz.Close()
+}
+
+// readLockAll read locks every document and then the index, so nothing can
+// change until they are released. Documents are locked in key order before
+// the index like everywhere else, so the keys are checked again once they
+// are all locked and locking starts over if any were added or removed
+func (i *FileIndex) readLockAll() []*File {
+	for {
+		// read lock on index to find all documents
+		i.mu.RLock()
+		files := make([]*File, 0, len(i.index))
+		for _, f := range i.index {
+			files = append(files, f)
+		}
+		i.mu.RUnlock()
+
+		sort.Slice(files, func(a, b int) bool {
+			return files[a].FileName < files[b].FileName
+		})
+		for _, f := range files {
+			f.mu.RLock()
+		}
+
+		i.mu.RLock()
+		unchanged := len(i.index) == len(files)
+		for _, f := range files {
+			unchanged = unchanged && i.index[f.FileName] == f
+		}
+		if unchanged {
+			return files
+		}
+
+		i.mu.RUnlock()
+		for _, f := range files {
+			f.mu.RUnlock()
+		}
+	}
+}
+
+// archiveFile adds the file at src to tw as name
+func archiveFile(tw *tar.Writer, src string, name string, info os.FileInfo) error {
+	content, err := af.ReadFile(I.FileSystem, src)
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(content)
+	return err
+}
+
+// archiveIfExists adds the file at src to tw as name if there is one
+func archiveIfExists(tw *tar.Writer, src string, name string) error {
+	info, err := I.FileSystem.Stat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return archiveFile(tw, src, name, info)
+}
+
+// archiveDir adds every file directly inside dir to tw under prefix
+func archiveDir(tw *tar.Writer, dir string, prefix string) error {
+	infos, err := af.ReadDir(I.FileSystem, dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		err := archiveFile(tw, filepath.Join(dir, info.Name()), path.Join(prefix, info.Name()), info)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasDocuments returns whether the index directory holds any documents
+func (i *FileIndex) HasDocuments() bool {
+	return len(crawlDirectory(i.dir)) > 0
+}
+
+// snapshotFile is a single file read from a snapshot
+type snapshotFile struct {
+	name    string
+	content []byte
+	modTime time.Time
+}
+
+// Restore replaces every document in the index directory, along with its
+// history and expiry, with the contents of a snapshot and rebuilds the
+// index. It must not be used while other writers are running
+func (i *FileIndex) Restore(r io.Reader) (int, error) {
+	// read the whole snapshot first so a bad one doesn't leave a half restored directory
+	files, err := readSnapshot(r)
+	if err != nil {
+		return 0, err
+	}
+
+	err = i.clearDocuments()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, f := range files {
+		err = restoreFile(filepath.Join(i.dir, filepath.FromSlash(f.name)), f)
+		if err != nil {
+			return count, err
+		}
+
+		if !strings.Contains(f.name, "/") && strings.HasSuffix(f.name, ".json") {
+			count++
+		}
+	}
+
+	i.Regenerate()
+	return count, nil
+}
+
+// readSnapshot returns every regular file in a gzipped tar archive
+func readSnapshot(r io.Reader) ([]snapshotFile, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot is not gzipped: %s", err.Error())
+	}
+	defer gz.Close()
+
+	res := []snapshotFile{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("snapshot is corrupt: %s", err.Error())
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// never write outside the database directory
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("snapshot contains invalid path '%s'", hdr.Name)
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot is corrupt: %s", err.Error())
+		}
+		res = append(res, snapshotFile{name: name, content: content, modTime: hdr.ModTime})
+	}
+}
+
+// restoreFile writes a file from a snapshot to dst
+func restoreFile(dst string, f snapshotFile) error {
+	err := I.FileSystem.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = af.WriteFile(I.FileSystem, dst, f.content, 0644)
+	if err != nil {
+		return err
+	}
+
+	// versions are dated by their modification time
+	return I.FileSystem.Chtimes(dst, f.modTime, f.modTime)
+}
+
+// clearDocuments removes every document, version and expiry from the index directory
+func (i *FileIndex) clearDocuments() error {
+	for _, key := range crawlDirectory(i.dir) {
+		err := I.FileSystem.Remove((&File{FileName: key}).ResolvePath())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []string{HistoryDir, ExpiryDir} {
+		err := I.FileSystem.RemoveAll(filepath.Join(i.dir, dir))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package index
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func archiveNames(t *testing.T, b []byte) (names []string) {
+	t.Helper()
+
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	assertNilErr(t, err)
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assertNilErr(t, err)
+		names = append(names, hdr.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func TestFileIndex_Snapshot(t *testing.T) {
+	t.Run("archives documents, history and expiry", func(t *testing.T) {
+		setup()
+		I.SetHistoryLimit(DefaultHistoryLimit)
+		makeNewJSON("a", map[string]interface{}{"n": 1})
+		makeNewJSON("b", map[string]interface{}{"n": 2})
+		I.Regenerate()
+
+		file, _ := I.Lookup("a")
+		_, err := I.PatchField(file, "n", 3)
+		assertNilErr(t, err)
+		assertNilErr(t, I.Expire("b", time.Hour))
+
+		var buf bytes.Buffer
+		count, err := I.Snapshot(&buf)
+		assertNilErr(t, err)
+		assert.Equal(t, 2, count)
+		checkDeepEquals(t, archiveNames(t, buf.Bytes()), []string{
+			".expiry/b",
+			".history/a/1.json",
+			"a.json",
+			"b.json",
+		})
+	})
+
+	t.Run("keys claimed but not written are skipped", func(t *testing.T) {
+		setup()
+		makeNewJSON("a", map[string]interface{}{"n": 1})
+		I.Regenerate()
+		file, _ := I.claim(&File{FileName: "pending"}, true)
+		file.mu.Unlock()
+
+		var buf bytes.Buffer
+		count, err := I.Snapshot(&buf)
+		assertNilErr(t, err)
+		assert.Equal(t, 1, count)
+		checkDeepEquals(t, archiveNames(t, buf.Bytes()), []string{"a.json"})
+	})
+}
+
+func TestFileIndex_Restore(t *testing.T) {
+	t.Run("restores a snapshot over existing documents", func(t *testing.T) {
+		setup()
+		I.SetHistoryLimit(DefaultHistoryLimit)
+		makeNewJSON("a", map[string]interface{}{"n": 1})
+		I.Regenerate()
+
+		file, _ := I.Lookup("a")
+		_, err := I.PatchField(file, "n", 2)
+		assertNilErr(t, err)
+		assertNilErr(t, I.Expire("a", time.Hour))
+
+		var buf bytes.Buffer
+		_, err = I.Snapshot(&buf)
+		assertNilErr(t, err)
+
+		// diverge from the snapshot
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"n":3}`)))
+		_, err = I.PatchField(file, "n", 4)
+		assertNilErr(t, err)
+
+		count, err := I.Restore(&buf)
+		assertNilErr(t, err)
+		assert.Equal(t, 1, count)
+
+		checkDeepEquals(t, I.List(), []string{"a"})
+		checkContentEqual(t, "a", map[string]interface{}{"n": 2})
+		_, hasTTL := I.TTL("a")
+		assert.True(t, hasTTL)
+
+		versions, err := I.History("a")
+		assertNilErr(t, err)
+		assert.Len(t, versions, 1)
+	})
+
+	t.Run("invalid snapshots", func(t *testing.T) {
+		setup()
+
+		_, err := I.Restore(bytes.NewReader([]byte("not a snapshot")))
+		assertErr(t, err)
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		assertNilErr(t, tw.WriteHeader(&tar.Header{Name: "../escape.json", Mode: 0644, Size: 2, Typeflag: tar.TypeReg}))
+		_, _ = tw.Write([]byte("{}"))
+		assertNilErr(t, tw.Close())
+		assertNilErr(t, gz.Close())
+
+		_, err = I.Restore(&buf)
+		assertErr(t, err)
+	})
+}
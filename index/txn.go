@@ -0,0 +1,349 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// types of operations in a transaction
+const (
+	TxnPut    = "put"
+	TxnPatch  = "patch"
+	TxnDelete = "delete"
+
+	// assertions only check the document and never change it
+	TxnExists    = "exists"
+	TxnNotExists = "not_exists"
+	TxnEquals    = "equals"
+)
+
+// ErrInvalidTxn is returned when a transaction contains a malformed operation
+var ErrInvalidTxn = errors.New("invalid transaction")
+
+// TxnOp is a single operation or assertion in a transaction. Value is the
+// whole document for put, and the field value for patch and equals
+type TxnOp struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Field string          `json:"field,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// TxnError is returned when a transaction is rejected because of one of its operations
+type TxnError struct {
+	Index int
+	Op    TxnOp
+	Err   error
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("operation %d (%s of key '%s') failed: %s", e.Index, e.Op.Op, e.Op.Key, e.Err.Error())
+}
+
+// Unwrap returns the reason the operation failed
+func (e *TxnError) Unwrap() error {
+	return e.Err
+}
+
+// validate checks op is well formed before anything is locked
+func (op TxnOp) validate() error {
+	if err := ValidateKey(op.Key); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidTxn, err.Error())
+	}
+
+	switch op.Op {
+	case TxnDelete, TxnExists, TxnNotExists:
+		return nil
+	case TxnPut, TxnPatch, TxnEquals:
+		if (op.Op != TxnPut && op.Field == "") || len(op.Value) == 0 {
+			return fmt.Errorf("%w: %s needs a field and value", ErrInvalidTxn, op.Op)
+		}
+		if !json.Valid(op.Value) {
+			return fmt.Errorf("%w: value is not valid json", ErrInvalidTxn)
+		}
+		if op.Op == TxnPut && bytes.TrimSpace(op.Value)[0] != '{' {
+			return fmt.Errorf("%w: put value must be a json object", ErrInvalidTxn)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: unknown operation '%s'", ErrInvalidTxn, op.Op)
+}
+
+// txnDoc tracks a document locked by a transaction as operations are applied
+type txnDoc struct {
+	file     *File
+	original []byte
+	existed  bool
+	content  []byte
+	exists   bool
+}
+
+// apply runs op against the pending contents of the document
+func (d *txnDoc) apply(op TxnOp) error {
+	switch op.Op {
+	case TxnExists:
+		if !d.exists {
+			return ErrPreconditionFailed
+		}
+	case TxnNotExists:
+		if d.exists {
+			return ErrPreconditionFailed
+		}
+	case TxnEquals:
+		var want, jsonVal interface{}
+		_ = json.Unmarshal(op.Value, &want)
+		if !d.exists || json.Unmarshal(d.content, &jsonVal) != nil {
+			return ErrPreconditionFailed
+		}
+
+		got, ok := GetPath(jsonVal, ParseFieldPath(op.Field))
+		if !ok || !reflect.DeepEqual(got, want) {
+			return ErrPreconditionFailed
+		}
+	case TxnPut:
+		// drop the formatting of the surrounding transaction
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, op.Value); err != nil {
+			return err
+		}
+		d.content = compact.Bytes()
+		d.exists = true
+	case TxnPatch:
+		if !d.exists {
+			return os.ErrNotExist
+		}
+
+		var jsonMap map[string]interface{}
+		if err := json.Unmarshal(d.content, &jsonMap); err != nil {
+			return fmt.Errorf("%w: key '%s' is not a json object", ErrInvalidTxn, op.Key)
+		}
+
+		var value interface{}
+		_ = json.Unmarshal(op.Value, &value)
+		if _, err := SetPath(jsonMap, ParseFieldPath(op.Field), value); err != nil {
+			return err
+		}
+
+		jsonData, err := json.Marshal(jsonMap)
+		if err != nil {
+			return err
+		}
+		d.content = jsonData
+	case TxnDelete:
+		if !d.exists {
+			return os.ErrNotExist
+		}
+		d.content = nil
+		d.exists = false
+	}
+
+	return nil
+}
+
+// changed returns whether the transaction modified the document
+func (d *txnDoc) changed() bool {
+	if d.exists != d.existed {
+		return true
+	}
+	return d.exists && !bytes.Equal(d.content, d.original)
+}
+
+// changeType returns how the transaction changed the document
+func (d *txnDoc) changeType() string {
+	switch {
+	case !d.exists:
+		return ChangeDelete
+	case !d.existed:
+		return ChangeCreate
+	}
+	return ChangeUpdate
+}
+
+// write puts the pending contents of the document on disk
+func (d *txnDoc) write() error {
+	err := d.file.saveVersion()
+	if err != nil {
+		return err
+	}
+
+	if d.exists {
+		return d.file.writeAtomic(d.content)
+	}
+
+	err = d.file.remove()
+	if err == nil {
+		err = d.file.persistRemove()
+	}
+	return err
+}
+
+// rollback puts the original contents of the document back on disk
+func (d *txnDoc) rollback() error {
+	if d.existed {
+		return d.file.writeAtomic(d.original)
+	}
+
+	err := d.file.remove()
+	if err == nil {
+		err = d.file.persistRemove()
+	}
+	return err
+}
+
+// Transact applies ops in order as a single all-or-nothing change. Every
+// document involved stays write locked until the transaction is done, and
+// if any operation or assertion fails nothing is written
+func (i *FileIndex) Transact(ops []TxnOp) error {
+	for n, op := range ops {
+		if err := op.validate(); err != nil {
+			return &TxnError{Index: n, Op: op, Err: err}
+		}
+	}
+
+	keys, docs, err := i.lockTxnDocs(ops)
+	defer i.unlockTxnDocs(docs)
+	if err != nil {
+		return err
+	}
+
+	for n, op := range ops {
+		if err := docs[op.Key].apply(op); err != nil {
+			return &TxnError{Index: n, Op: op, Err: err}
+		}
+	}
+
+	return i.commitTxn(keys, docs)
+}
+
+// lockTxnDocs write locks the documents of every key in ops in sorted order,
+// so concurrent transactions can never deadlock, and reads their contents
+func (i *FileIndex) lockTxnDocs(ops []TxnOp) ([]string, map[string]*txnDoc, error) {
+	docs := map[string]*txnDoc{}
+	keys := []string{}
+	for _, op := range ops {
+		if docs[op.Key] == nil {
+			docs[op.Key] = &txnDoc{}
+			keys = append(keys, op.Key)
+		}
+	}
+	sort.Strings(keys)
+
+	for n, key := range keys {
+		file, err := i.claim(&File{FileName: key}, true)
+		if err != nil {
+			for _, rest := range keys[n:] {
+				delete(docs, rest)
+			}
+			return nil, docs, err
+		}
+		docs[key].file = file
+
+		content, err := file.readBytes()
+		if err != nil && !os.IsNotExist(err) {
+			// unclaimed documents can't be unlocked
+			for _, rest := range keys[n+1:] {
+				delete(docs, rest)
+			}
+			return nil, docs, err
+		}
+
+		// read lock on index to hide expired documents
+		i.mu.RLock()
+		exists := err == nil && !i.isExpired(key, time.Now())
+		i.mu.RUnlock()
+
+		docs[key].original, docs[key].content = content, content
+		docs[key].existed, docs[key].exists = exists, exists
+	}
+
+	return keys, docs, nil
+}
+
+// unlockTxnDocs releases every document locked by lockTxnDocs
+func (i *FileIndex) unlockTxnDocs(docs map[string]*txnDoc) {
+	for _, d := range docs {
+		i.unclaimIfMissing(d.file)
+		d.file.mu.Unlock()
+	}
+}
+
+// commitTxn writes every changed document, restoring the ones already
+// written if any write fails
+func (i *FileIndex) commitTxn(keys []string, docs map[string]*txnDoc) error {
+	changed := []*txnDoc{}
+	entries := []JournalEntry{}
+	for _, key := range keys {
+		d := docs[key]
+		if !d.changed() {
+			continue
+		}
+
+		if d.exists {
+			if err := i.Validate(key, d.content); err != nil {
+				return err
+			}
+		}
+
+		changed = append(changed, d)
+		if d.exists {
+			entries = append(entries, JournalEntry{Op: OpPut, Key: key, Data: string(d.content)})
+		} else {
+			entries = append(entries, JournalEntry{Op: OpDelete, Key: key})
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	// record every write as one entry so they are replayed together
+	journal := i.activeJournal()
+	seq, err := journal.record(JournalEntry{Op: OpTxn, Ops: entries})
+	if err != nil {
+		return err
+	}
+
+	written := []*txnDoc{}
+	for _, d := range changed {
+		if err = d.write(); err != nil {
+			break
+		}
+		written = append(written, d)
+	}
+
+	if err != nil {
+		for _, d := range written {
+			if rollbackErr := d.rollback(); rollbackErr != nil {
+				log.Warn("err rolling back key '%s': %s", d.file.FileName, rollbackErr.Error())
+			}
+		}
+	}
+	journal.finish(seq, err)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range changed {
+		if !d.exists {
+			// write lock on index
+			i.mu.Lock()
+			delete(i.index, d.file.FileName)
+			i.mu.Unlock()
+		}
+
+		doc := parseDocMap(d.content)
+		i.clearExpiry(d.file)
+		i.updateIndexes(d.file.FileName, doc)
+		i.publish(d.changeType(), d.file.FileName, doc)
+	}
+	return nil
+}
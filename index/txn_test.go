@@ -0,0 +1,163 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseTxn(t *testing.T, s string) []TxnOp {
+	t.Helper()
+
+	var ops []TxnOp
+	assertNilErr(t, json.Unmarshal([]byte(s), &ops))
+	return ops
+}
+
+func assertTxnErr(t *testing.T, err error, index int, reason error) {
+	t.Helper()
+
+	var txnErr *TxnError
+	if !errors.As(err, &txnErr) {
+		t.Fatalf("got %v, want a transaction error", err)
+	}
+	assert.Equal(t, index, txnErr.Index)
+	assert.True(t, errors.Is(err, reason), "got %v, want %v", err, reason)
+}
+
+func TestFileIndex_Transact(t *testing.T) {
+	t.Run("applies all operations", func(t *testing.T) {
+		setup()
+		makeNewJSON("inventory", map[string]interface{}{"stock": 5})
+		makeNewJSON("cart", map[string]interface{}{"items": 1})
+		I.Regenerate()
+
+		err := I.Transact(parseTxn(t, `[
+			{"op": "exists", "key": "inventory"},
+			{"op": "equals", "key": "inventory", "field": "stock", "value": 5},
+			{"op": "not_exists", "key": "order"},
+			{"op": "put", "key": "order", "value": {"qty": 1}},
+			{"op": "patch", "key": "inventory", "field": "stock", "value": 4},
+			{"op": "delete", "key": "cart"}
+		]`))
+		assertNilErr(t, err)
+
+		checkContentEqual(t, "order", map[string]interface{}{"qty": 1})
+		checkContentEqual(t, "inventory", map[string]interface{}{"stock": 4})
+		assertFileDoesNotExist(t, "cart")
+		checkKeyNotInIndex(t, "cart")
+	})
+
+	t.Run("failed assertion changes nothing", func(t *testing.T) {
+		setup()
+		makeNewJSON("inventory", map[string]interface{}{"stock": 0})
+		I.Regenerate()
+
+		err := I.Transact(parseTxn(t, `[
+			{"op": "put", "key": "order", "value": {"qty": 1}},
+			{"op": "patch", "key": "inventory", "field": "stock", "value": -1},
+			{"op": "equals", "key": "inventory", "field": "stock", "value": 0}
+		]`))
+		assertTxnErr(t, err, 2, ErrPreconditionFailed)
+
+		checkContentEqual(t, "inventory", map[string]interface{}{"stock": 0})
+		assertFileDoesNotExist(t, "order")
+		checkKeyNotInIndex(t, "order")
+	})
+
+	t.Run("operations on missing keys fail", func(t *testing.T) {
+		setup()
+
+		err := I.Transact(parseTxn(t, `[{"op": "delete", "key": "nope"}]`))
+		assertTxnErr(t, err, 0, os.ErrNotExist)
+
+		err = I.Transact(parseTxn(t, `[{"op": "patch", "key": "nope", "field": "a", "value": 1}]`))
+		assertTxnErr(t, err, 0, os.ErrNotExist)
+		checkKeyNotInIndex(t, "nope")
+	})
+
+	t.Run("later operations see earlier ones", func(t *testing.T) {
+		setup()
+
+		err := I.Transact(parseTxn(t, `[
+			{"op": "put", "key": "a", "value": {"n": 1}},
+			{"op": "patch", "key": "a", "field": "n", "value": 2},
+			{"op": "equals", "key": "a", "field": "n", "value": 2},
+			{"op": "put", "key": "b", "value": {}},
+			{"op": "delete", "key": "b"}
+		]`))
+		assertNilErr(t, err)
+
+		checkContentEqual(t, "a", map[string]interface{}{"n": 2})
+		assertFileDoesNotExist(t, "b")
+		checkKeyNotInIndex(t, "b")
+	})
+
+	t.Run("malformed operations", func(t *testing.T) {
+		setup()
+
+		invalid := []string{
+			`[{"op": "put", "key": "a"}]`,
+			`[{"op": "put", "value": {}}]`,
+			`[{"op": "put", "key": "a", "value": [1, 2]}]`,
+			`[{"op": "patch", "key": "a", "value": 1}]`,
+			`[{"op": "rename", "key": "a"}]`,
+			`[{"op": "put", "key": "../escaped", "value": {}}, {"op": "delete", "key": "a"}]`,
+			`[{"op": "delete", "key": ".history"}]`,
+		}
+		for _, ops := range invalid {
+			assertTxnErr(t, I.Transact(parseTxn(t, ops)), 0, ErrInvalidTxn)
+		}
+		assertFileDoesNotExist(t, "../escaped")
+		checkKeyNotInIndex(t, "../escaped")
+	})
+
+	t.Run("transaction is journaled as one entry", func(t *testing.T) {
+		setup()
+		makeNewJSON("a", map[string]interface{}{"n": 1})
+		I.Regenerate()
+		assertNilErr(t, I.OpenJournal())
+
+		err := I.Transact(parseTxn(t, `[
+			{"op": "put", "key": "b", "value": {"n": 2}},
+			{"op": "delete", "key": "a"}
+		]`))
+		assertNilErr(t, err)
+
+		entries, err := I.Entries()
+		assertNilErr(t, err)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, OpTxn, entries[0].Op)
+		assert.Len(t, entries[0].Ops, 2)
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("incomplete transaction is rolled forward", func(t *testing.T) {
+		setup()
+		makeNewJSON("a", map[string]interface{}{"n": 1})
+		writeJournal(t, JournalEntry{Seq: 1, Op: OpTxn, Ops: []JournalEntry{
+			{Op: OpPut, Key: "b", Data: `{"n":2}`},
+			{Op: OpDelete, Key: "a"},
+		}})
+
+		assertNilErr(t, I.OpenJournal())
+		I.Regenerate()
+
+		checkContentEqual(t, "b", map[string]interface{}{"n": 2})
+		assertFileDoesNotExist(t, "a")
+		assertNilErr(t, I.CloseJournal())
+	})
+
+	t.Run("indexes follow transaction", func(t *testing.T) {
+		setup()
+		I.AddFieldIndex("status")
+
+		err := I.Transact(parseTxn(t, `[{"op": "put", "key": "order", "value": {"status": "paid"}}]`))
+		assertNilErr(t, err)
+		checkDeepEquals(t, findByField(t, "status", "paid"), []string{"order"})
+		checkDeepEquals(t, searchKeys("paid"), []string{"order"})
+	})
+}
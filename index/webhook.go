@@ -0,0 +1,389 @@
+package index
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// WebhooksKey is the key of the document listing webhook targets, e.g.
+//
+//	{"targets": [{"url": "http://localhost:8080/hook", "secret": "s3cret",
+//	              "prefixes": ["user."], "events": ["create", "delete"]}]}
+//
+// Targets without prefixes or events are sent changes to every key or of
+// every type
+const WebhooksKey = "_webhooks"
+
+// headers sent along with every webhook delivery
+const (
+	WebhookEventHeader     = "X-NanoDB-Event"
+	WebhookDeliveryHeader  = "X-NanoDB-Delivery"
+	WebhookSignatureHeader = "X-NanoDB-Signature"
+)
+
+const (
+	// DefaultWebhookWorkers is how many deliveries are made at once
+	DefaultWebhookWorkers = 4
+
+	// DefaultWebhookBackoff is how long to wait before the first retry of
+	// a failed delivery, doubling with every retry after
+	DefaultWebhookBackoff = time.Second
+
+	// webhookAttempts is how many times a delivery is tried before it is
+	// moved to the failures
+	webhookAttempts = 5
+
+	// webhookQueueSize is how many deliveries can wait for a worker
+	webhookQueueSize = 1024
+
+	// webhookFailureLimit is how many failed deliveries are kept
+	webhookFailureLimit = 100
+
+	// webhookTimeout is how long a target has to respond
+	webhookTimeout = 10 * time.Second
+)
+
+// errWebhookQueueFull is recorded for deliveries dropped because every worker is busy
+var errWebhookQueueFull = errors.New("too many deliveries waiting")
+
+// webhookTarget is a url sent changes matching its prefixes and events
+type webhookTarget struct {
+	URL      string
+	Secret   string
+	Prefixes []string
+	Events   []string
+}
+
+// matches returns whether c should be sent to t
+func (t webhookTarget) matches(c Change) bool {
+	return (len(t.Prefixes) == 0 || hasAnyPrefix(c.Key, t.Prefixes)) &&
+		(len(t.Events) == 0 || hasEvent(t.Events, c.Type))
+}
+
+// hasAnyPrefix returns whether s starts with any of prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasEvent returns whether events contains event
+func hasEvent(events []string, event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookFailure is a delivery that failed every attempt
+type WebhookFailure struct {
+	URL      string    `json:"url"`
+	Change   Change    `json:"change"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// webhookDelivery is a change waiting to be sent to a target
+type webhookDelivery struct {
+	target webhookTarget
+	change Change
+	body   []byte
+}
+
+// webhookDispatcher queues changes for the targets they match and keeps
+// the deliveries that failed
+type webhookDispatcher struct {
+	mu       sync.Mutex
+	targets  []webhookTarget
+	failures []WebhookFailure
+
+	// nil until workers are started, changes are not queued before then
+	queue   chan webhookDelivery
+	backoff time.Duration
+	client  *http.Client
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of body using secret,
+// sent as "sha256=<signature>" in the X-NanoDB-Signature header
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseWebhooksDoc returns the targets described by doc and any reasons it is invalid
+func parseWebhooksDoc(doc map[string]interface{}) ([]webhookTarget, []string) {
+	if doc == nil {
+		return nil, []string{"/: webhooks document must be a json object"}
+	}
+
+	rawTargets, ok := doc["targets"].([]interface{})
+	if !ok {
+		return nil, []string{"/targets: must be an array of targets"}
+	}
+
+	var errs []string
+	targets := []webhookTarget{}
+	for n, raw := range rawTargets {
+		at := fmt.Sprintf("/targets/%d", n)
+		t, ok := raw.(map[string]interface{})
+		if !ok {
+			errs = append(errs, at+": must be a json object")
+			continue
+		}
+
+		var target webhookTarget
+		target.URL, _ = t["url"].(string)
+		if u, err := url.Parse(target.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, at+"/url: must be an http or https url")
+		}
+
+		if secret, ok := t["secret"]; ok {
+			if target.Secret, ok = secret.(string); !ok {
+				errs = append(errs, at+"/secret: must be a string")
+			}
+		}
+
+		if target.Prefixes, ok = stringList(t["prefixes"]); !ok {
+			errs = append(errs, at+"/prefixes: must be an array of strings")
+		}
+
+		if target.Events, ok = stringList(t["events"]); !ok {
+			errs = append(errs, at+"/events: must be an array of strings")
+		}
+		for _, event := range target.Events {
+			if event != ChangeCreate && event != ChangeUpdate && event != ChangeDelete {
+				errs = append(errs, fmt.Sprintf("%s/events: unknown event '%s', must be create, update or delete", at, event))
+			}
+		}
+
+		targets = append(targets, target)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return targets, nil
+}
+
+// stringList converts a json array of strings, nil if missing
+func stringList(val interface{}) ([]string, bool) {
+	if val == nil {
+		return nil, true
+	}
+
+	arr, ok := val.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	res := make([]string, len(arr))
+	for n, v := range arr {
+		if res[n], ok = v.(string); !ok {
+			return nil, false
+		}
+	}
+	return res, true
+}
+
+// updateWebhooks replaces the webhook targets if key holds them
+func (i *FileIndex) updateWebhooks(key string, doc map[string]interface{}) {
+	if key != WebhooksKey {
+		return
+	}
+
+	targets, errs := parseWebhooksDoc(doc)
+	if !usableConfig(key, doc, errs) {
+		targets = nil
+	}
+
+	d := i.webhooks
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.targets = targets
+}
+
+// loadWebhooks registers the webhook targets in the index, if any
+func (i *FileIndex) loadWebhooks() {
+	i.updateWebhooks(WebhooksKey, i.readConfigDoc(WebhooksKey))
+}
+
+// StartWebhooks delivers changes to the webhook targets using workers
+// goroutines in the background until the returned stop function is called.
+// Failed deliveries are retried after backoff, doubling after each attempt
+func (i *FileIndex) StartWebhooks(workers int, backoff time.Duration) (stop func()) {
+	d := i.webhooks
+	queue := make(chan webhookDelivery, webhookQueueSize)
+	d.mu.Lock()
+	d.queue = queue
+	d.backoff = backoff
+	d.mu.Unlock()
+
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case delivery := <-queue:
+					d.deliver(delivery, quit)
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+
+	return func() {
+		d.mu.Lock()
+		d.queue = nil
+		d.mu.Unlock()
+
+		close(quit)
+		wg.Wait()
+	}
+}
+
+// WebhookFailures returns the most recent deliveries that failed every attempt, oldest first
+func (i *FileIndex) WebhookFailures() []WebhookFailure {
+	d := i.webhooks
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]WebhookFailure{}, d.failures...)
+}
+
+// enqueue queues c for every target it matches. Never blocks, deliveries
+// that don't fit in the queue fail right away
+func (d *webhookDispatcher) enqueue(c Change) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.queue == nil {
+		return
+	}
+
+	var body []byte
+	for _, target := range d.targets {
+		if !target.matches(c) {
+			continue
+		}
+
+		if body == nil {
+			jsonData, err := json.Marshal(c)
+			if err != nil {
+				log.Warn("err encoding change to key '%s' for webhooks: %s", c.Key, err.Error())
+				return
+			}
+			body = jsonData
+		}
+
+		delivery := webhookDelivery{target: target, change: c, body: body}
+		select {
+		case d.queue <- delivery:
+		default:
+			d.fail(delivery, 0, errWebhookQueueFull)
+		}
+	}
+}
+
+// deliver sends delivery until it succeeds or runs out of attempts, giving
+// up early if quit is closed
+func (d *webhookDispatcher) deliver(delivery webhookDelivery, quit <-chan struct{}) {
+	d.mu.Lock()
+	wait := d.backoff
+	d.mu.Unlock()
+
+	attempts := 0
+	for {
+		attempts++
+		err := d.send(delivery)
+		if err == nil {
+			return
+		}
+		if attempts == webhookAttempts {
+			d.mu.Lock()
+			d.fail(delivery, attempts, err)
+			d.mu.Unlock()
+			return
+		}
+
+		select {
+		case <-time.After(wait):
+			wait *= 2
+		case <-quit:
+			d.mu.Lock()
+			d.fail(delivery, attempts, err)
+			d.mu.Unlock()
+			return
+		}
+	}
+}
+
+// send posts delivery to its target once
+func (d *webhookDispatcher) send(delivery webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.target.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.change.Type)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatUint(delivery.change.Seq, 10))
+	if delivery.target.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(delivery.target.Secret, delivery.body))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("target responded with %s", res.Status)
+	}
+	return nil
+}
+
+// fail records a delivery that won't be retried. Callers must hold d.mu
+func (d *webhookDispatcher) fail(delivery webhookDelivery, attempts int, err error) {
+	log.Warn("webhook to %s for key '%s' failed after %d attempts: %s", delivery.target.URL, delivery.change.Key, attempts, err.Error())
+
+	d.failures = append(d.failures, WebhookFailure{
+		URL:      delivery.target.URL,
+		Change:   delivery.change,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Time:     time.Now().UTC(),
+	})
+	if len(d.failures) > webhookFailureLimit {
+		d.failures = d.failures[len(d.failures)-webhookFailureLimit:]
+	}
+}
@@ -0,0 +1,206 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hookServer records every webhook delivery it receives, failing the first
+// failFirst of them
+type hookServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	received  []*http.Request
+	bodies    [][]byte
+	failFirst int
+}
+
+func newHookServer(failFirst int) *hookServer {
+	s := &hookServer{failFirst: failFirst}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.received = append(s.received, r)
+		s.bodies = append(s.bodies, body)
+		if len(s.received) <= s.failFirst {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	return s
+}
+
+// waitFor returns the first n deliveries, failing if they don't arrive in time
+func (s *hookServer) waitFor(t *testing.T, n int) ([]*http.Request, [][]byte) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		if len(s.received) >= n {
+			defer s.mu.Unlock()
+			return s.received[:n], s.bodies[:n]
+		}
+		s.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("got %d deliveries, want %d", len(s.received), n)
+	return nil, nil
+}
+
+// count returns the number of deliveries received so far
+func (s *hookServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.received)
+}
+
+func putWebhooks(t *testing.T, targets string) {
+	t.Helper()
+	assertNilErr(t, I.Put(&File{FileName: WebhooksKey}, []byte(fmt.Sprintf(`{"targets": %s}`, targets))))
+}
+
+func TestFileIndex_Validate_webhooks(t *testing.T) {
+	setup()
+
+	err := I.Put(&File{FileName: WebhooksKey}, []byte(`{"targets": [
+		{"url": "localhost:8080"},
+		{"url": "http://localhost:8080", "secret": 1, "prefixes": "user.", "events": ["create", "rename"]},
+		2
+	]}`))
+	assert.Equal(t, []string{
+		"/targets/0/url: must be an http or https url",
+		"/targets/1/secret: must be a string",
+		"/targets/1/prefixes: must be an array of strings",
+		"/targets/1/events: unknown event 'rename', must be create, update or delete",
+		"/targets/2: must be a json object",
+	}, validationErrors(t, err))
+
+	err = I.Put(&File{FileName: WebhooksKey}, []byte(`[]`))
+	assert.Equal(t, []string{"/: webhooks document must be a json object"}, validationErrors(t, err))
+	checkKeyNotInIndex(t, WebhooksKey)
+}
+
+func TestFileIndex_StartWebhooks(t *testing.T) {
+	t.Run("matching changes are delivered and signed", func(t *testing.T) {
+		setup()
+		stop := I.StartWebhooks(1, time.Millisecond)
+		defer stop()
+
+		server := newHookServer(0)
+		defer server.Close()
+		putWebhooks(t, fmt.Sprintf(`[{"url": "%s", "secret": "s3cret", "prefixes": ["user."], "events": ["create", "delete"]}]`, server.URL))
+
+		file := &File{FileName: "user.alice"}
+		assertNilErr(t, I.Put(&File{FileName: "order.1"}, []byte(`{}`)))
+		assertNilErr(t, I.Put(file, []byte(`{"n":1}`)))
+		assertNilErr(t, I.Put(file, []byte(`{"n":2}`)))
+		assertNilErr(t, I.Delete(file))
+
+		reqs, bodies := server.waitFor(t, 2)
+		for n, want := range []string{ChangeCreate, ChangeDelete} {
+			var c Change
+			assertNilErr(t, json.Unmarshal(bodies[n], &c))
+			assert.Equal(t, want, c.Type)
+			assert.Equal(t, "user.alice", c.Key)
+
+			assert.Equal(t, want, reqs[n].Header.Get(WebhookEventHeader))
+			assert.Equal(t, fmt.Sprint(c.Seq), reqs[n].Header.Get(WebhookDeliveryHeader))
+			assert.Equal(t, "sha256="+SignWebhook("s3cret", bodies[n]), reqs[n].Header.Get(WebhookSignatureHeader))
+		}
+
+		// the update to user.alice and the write to order.1 are skipped
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 2, server.count())
+		assert.Len(t, I.WebhookFailures(), 0)
+	})
+
+	t.Run("failed deliveries are retried", func(t *testing.T) {
+		setup()
+		stop := I.StartWebhooks(1, time.Millisecond)
+		defer stop()
+
+		server := newHookServer(webhookAttempts - 1)
+		defer server.Close()
+		putWebhooks(t, fmt.Sprintf(`[{"url": "%s", "prefixes": ["doc"]}]`, server.URL))
+
+		assertNilErr(t, I.Put(&File{FileName: "doc"}, []byte(`{}`)))
+		_, bodies := server.waitFor(t, webhookAttempts)
+		assert.Equal(t, bodies[0], bodies[webhookAttempts-1])
+		assert.Len(t, I.WebhookFailures(), 0)
+	})
+
+	t.Run("deliveries failing every attempt are kept", func(t *testing.T) {
+		setup()
+		stop := I.StartWebhooks(1, time.Millisecond)
+
+		server := newHookServer(webhookAttempts)
+		defer server.Close()
+		putWebhooks(t, fmt.Sprintf(`[{"url": "%s", "prefixes": ["doc"]}]`, server.URL))
+
+		assertNilErr(t, I.Put(&File{FileName: "doc"}, []byte(`{}`)))
+		server.waitFor(t, webhookAttempts)
+		stop()
+
+		failures := I.WebhookFailures()
+		if assert.Len(t, failures, 1) {
+			assert.Equal(t, server.URL, failures[0].URL)
+			assert.Equal(t, "doc", failures[0].Change.Key)
+			assert.Equal(t, webhookAttempts, failures[0].Attempts)
+			assert.Equal(t, "target responded with 503 Service Unavailable", failures[0].Error)
+		}
+	})
+
+	t.Run("targets are reloaded with the index", func(t *testing.T) {
+		setup()
+		stop := I.StartWebhooks(1, time.Millisecond)
+		defer stop()
+
+		server := newHookServer(0)
+		defer server.Close()
+		makeNewFile(WebhooksKey+".json", fmt.Sprintf(`{"targets": [{"url": "%s"}]}`, server.URL))
+		I.Regenerate()
+
+		assertNilErr(t, I.Put(&File{FileName: "doc"}, []byte(`{}`)))
+		server.waitFor(t, 1)
+
+		// deleting the document removes every target
+		assertNilErr(t, I.Delete(&File{FileName: WebhooksKey}))
+		assertNilErr(t, I.Put(&File{FileName: "doc"}, []byte(`{}`)))
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 1, server.count())
+	})
+
+	t.Run("changes to config documents are never delivered", func(t *testing.T) {
+		setup()
+		stop := I.StartWebhooks(1, time.Millisecond)
+		defer stop()
+
+		server := newHookServer(0)
+		defer server.Close()
+		putWebhooks(t, fmt.Sprintf(`[{"url": "%s"}, {"url": "%s", "secret": "target-b-secret"}]`, server.URL, server.URL))
+		assertNilErr(t, I.Put(&File{FileName: RedactionsKey}, []byte(`{"rules": [{"strip": ["password"]}]}`)))
+		assertNilErr(t, I.Put(&File{FileName: SchemaPrefix + "doc"}, []byte(`{"pattern": "doc", "schema": {}}`)))
+		assertNilErr(t, I.Put(&File{FileName: "doc"}, []byte(`{}`)))
+
+		// only the write to doc reaches both targets
+		_, bodies := server.waitFor(t, 2)
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 2, server.count())
+		for _, body := range bodies {
+			var c Change
+			assertNilErr(t, json.Unmarshal(body, &c))
+			assert.Equal(t, "doc", c.Key)
+			assert.NotContains(t, string(body), "target-b-secret")
+		}
+	})
+}
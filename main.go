@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/jackyzha0/nanoDB/api"
 	"github.com/jackyzha0/nanoDB/index"
@@ -43,9 +44,84 @@ func main() {
 						Usage:       "port to run nanodb on",
 						DefaultText: "3000",
 					},
+					&cli.StringFlag{
+						Name:        "durability",
+						Value:       "per-write",
+						Usage:       "when to sync writes to disk: none, per-write or batched",
+						DefaultText: "per-write",
+					},
+					&cli.DurationFlag{
+						Name:        "batch-interval",
+						Value:       index.DefaultBatchInterval,
+						Usage:       "how often to sync writes to disk in batched durability mode",
+						DefaultText: "10ms",
+					},
+					&cli.StringSliceFlag{
+						Name:  "index",
+						Usage: "field path to maintain a secondary index on, can be repeated",
+					},
+					&cli.IntFlag{
+						Name:        "history",
+						Value:       index.DefaultHistoryLimit,
+						Usage:       "number of previous versions to keep per key, 0 to disable",
+						DefaultText: "10",
+					},
+					&cli.IntFlag{
+						Name:        "webhook-workers",
+						Value:       index.DefaultWebhookWorkers,
+						Usage:       "number of webhook deliveries to make at once, 0 to disable",
+						DefaultText: "4",
+					},
+					&cli.StringFlag{
+						Name:  "keys",
+						Usage: "file of api keys that requests must authenticate with",
+					},
+					&cli.StringFlag{
+						Name:  "jwt-secret",
+						Usage: "file holding the secret to verify HS256 tokens with",
+					},
+					&cli.StringFlag{
+						Name:  "jwt-public-key",
+						Usage: "PEM file holding the rsa public key to verify RS256 tokens with",
+					},
+					&cli.StringFlag{
+						Name:  "rules",
+						Usage: "file of owner rules deciding which documents token holders can use",
+					},
+					&cli.StringFlag{
+						Name:  "tls-cert",
+						Usage: "PEM certificate file to serve https with, reloaded on SIGHUP",
+					},
+					&cli.StringFlag{
+						Name:  "tls-key",
+						Usage: "PEM private key file of the tls certificate",
+					},
+					&cli.StringFlag{
+						Name:  "client-ca",
+						Usage: "PEM file of the ca that client certificates must be signed by",
+					},
 				},
 				Action: func(c *cli.Context) error {
-					return serve(c.Int("port"), c.String("dir"))
+					durability, err := index.ParseDurability(c.String("durability"))
+					if err != nil {
+						return err
+					}
+
+					return serve(c.Int("port"), options{
+						dir:            c.String("dir"),
+						durability:     durability,
+						batchInterval:  c.Duration("batch-interval"),
+						historyLimit:   c.Int("history"),
+						fieldIndexes:   c.StringSlice("index"),
+						webhookWorkers: c.Int("webhook-workers"),
+						keysFile:       c.String("keys"),
+						jwtSecretFile:  c.String("jwt-secret"),
+						jwtPublicKey:   c.String("jwt-public-key"),
+						rulesFile:      c.String("rules"),
+						tlsCert:        c.String("tls-cert"),
+						tlsKey:         c.String("tls-key"),
+						clientCA:       c.String("client-ca"),
+					})
 				},
 			}, {
 				Name:    "shell",
@@ -54,6 +130,92 @@ func main() {
 				Action: func(c *cli.Context) error {
 					return shell(c.String("dir"))
 				},
+			}, {
+				Name:  "backup",
+				Usage: "save a snapshot of every document to a tar.gz archive",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "out",
+						Aliases:  []string{"o"},
+						Usage:    "file to write the snapshot to",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return backup(c.String("dir"), c.String("out"))
+				},
+			}, {
+				Name:  "restore",
+				Usage: "replace every document with the contents of a snapshot",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "from",
+						Aliases:  []string{"f"},
+						Usage:    "snapshot to restore",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "replace existing documents",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return restore(c.String("dir"), c.String("from"), c.Bool("force"))
+				},
+			}, {
+				Name:  "export",
+				Usage: "write every document out as ndjson or csv",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "format",
+						Value:       index.FormatNDJSON,
+						Usage:       "format to export to: ndjson or csv",
+						DefaultText: "ndjson",
+					},
+					&cli.StringFlag{
+						Name:        "out",
+						Aliases:     []string{"o"},
+						Value:       "-",
+						Usage:       "file to export to, - for stdout",
+						DefaultText: "-",
+					},
+					&cli.IntFlag{
+						Name:        "depth",
+						Value:       0,
+						Usage:       "depth to resolve references to",
+						DefaultText: "0",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return exportDocs(c.String("dir"), c.String("format"), c.String("out"), c.Int("depth"))
+				},
+			}, {
+				Name:  "import",
+				Usage: "read documents from an ndjson or csv export",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "format",
+						Value:       index.FormatNDJSON,
+						Usage:       "format to import from: ndjson or csv",
+						DefaultText: "ndjson",
+					},
+					&cli.StringFlag{
+						Name:        "from",
+						Aliases:     []string{"f"},
+						Value:       "-",
+						Usage:       "file to import from, - for stdin",
+						DefaultText: "-",
+					},
+					&cli.StringFlag{
+						Name:        "on-conflict",
+						Value:       index.ConflictFail,
+						Usage:       "what to do with keys that already exist: skip, overwrite or fail",
+						DefaultText: "fail",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return importDocs(c.String("dir"), c.String("format"), c.String("from"), c.String("on-conflict"))
+				},
 			},
 		},
 	}
@@ -64,26 +226,81 @@ func main() {
 	}
 }
 
-// serve defines all the endpoints and starts a new http server on :3000
-func serve(port int, dir string) error {
+// options holds the settings used to set up the database
+type options struct {
+	dir            string
+	durability     index.Durability
+	batchInterval  time.Duration
+	historyLimit   int
+	fieldIndexes   []string
+	webhookWorkers int
+	keysFile       string
+	jwtSecretFile  string
+	jwtPublicKey   string
+	rulesFile      string
+	tlsCert        string
+	tlsKey         string
+	clientCA       string
+}
+
+// serve defines all the endpoints and starts a new http server on :3000,
+// using https if a tls certificate is given
+func serve(port int, opts options) error {
 	log.SetLoggingLevel(log.INFO)
 	log.Info("initializing nanoDB")
-	setup(dir)
+
+	var certs *tlsReloader
+	if opts.tlsCert != "" || opts.tlsKey != "" || opts.clientCA != "" {
+		var err error
+		if certs, err = newTLSReloader(opts.tlsCert, opts.tlsKey, opts.clientCA); err != nil {
+			return err
+		}
+	}
+	setup(opts)
 
 	router := httprouter.New()
 
-	// define endpoints
-	router.GET("/", api.GetIndex)
-	router.POST("/", api.RegenerateIndex)
-	router.GET("/:key", api.GetKey)
-	router.GET("/:key/:field", api.GetKeyField)
-	router.PUT("/:key", api.UpdateKey)
-	router.DELETE("/:key", api.DeleteKey)
-	router.PATCH("/:key/:field", api.PatchKeyField)
+	// define endpoints, each needing a permission on the key they are
+	// about, or on every key if they aren't about a single document. Callers
+	// with a token can only use the ones checking owner rules
+	router.GET("/", api.Require(api.PermRead, api.GetIndex))
+	router.POST("/", api.Require(api.PermAdmin, api.RegenerateIndex))
+	router.GET("/:key", api.RequireOwner(api.PermRead, api.GetKey))
+	router.GET("/:key/:field", api.Require(api.PermRead, api.GetKeyField))
+	router.PUT("/:key", api.RequireOwner(api.PermWrite, api.UpdateKey))
+	router.DELETE("/:key", api.RequireOwner(api.PermDelete, api.DeleteKey))
+	router.PATCH("/:key", api.Require(api.PermWrite, api.PatchKey))
+	router.PATCH("/:key/:field", api.RequireOwner(api.PermWrite, api.PatchKeyField))
+	router.DELETE("/:key/:field", api.Require(api.PermWrite, api.DeleteKeyField))
+
+	// system endpoints all start with _ and can't share a router with /:key,
+	// anything they don't match falls through to the document endpoints.
+	// websockets, transactions and bulk requests check every key they touch
+	system := httprouter.New()
+	system.NotFound = router
+	system.GET("/_by/:field/:value", api.Require(api.PermRead, api.GetByField))
+	system.POST("/_query", api.Require(api.PermRead, api.Query))
+	system.GET("/_search", api.Require(api.PermRead, api.Search))
+	system.GET("/_changes", api.Require(api.PermRead, api.Changes))
+	system.GET("/_ws", api.WebSocket)
+	system.POST("/_txn", api.Transact)
+	system.POST("/_bulk/get", api.BulkGet)
+	system.POST("/_bulk/put", api.BulkPut)
+	system.POST("/_bulk/delete", api.BulkDelete)
+	system.POST("/_admin/snapshot", api.Require(api.PermAdmin, api.Snapshot))
+	system.GET("/_webhooks/failures", api.Require(api.PermAdmin, api.WebhookFailures))
 
 	// start server
-	log.Info("starting api server on port %d", port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), router)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: api.Authenticate(system)}
+	if certs == nil {
+		log.Info("starting api server on port %d", port)
+		return server.ListenAndServe()
+	}
+
+	certs.reloadOnHangup()
+	server.TLSConfig = certs.serverConfig()
+	log.Info("starting api server with https on port %d", port)
+	return server.ListenAndServeTLS("", "")
 }
 
 func getLockLocation(dir string) string {
@@ -110,8 +327,42 @@ func releaseLock(dir string) error {
 	return index.I.FileSystem.Remove(lockdir)
 }
 
-func setup(dir string) {
+func setup(opts options) {
+	dir := opts.dir
+	// require api keys if a keys file is given
+	if opts.keysFile != "" {
+		keys, err := api.LoadKeys(opts.keysFile)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		api.Keys = keys
+		log.Info("loaded %d api keys", len(keys.Keys))
+	}
+
+	// accept tokens if a key to verify them with is given
+	if opts.jwtSecretFile != "" || opts.jwtPublicKey != "" {
+		verifier, err := api.LoadJWTVerifier(opts.jwtSecretFile, opts.jwtPublicKey)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		api.JWT = verifier
+	}
+
+	if opts.rulesFile != "" {
+		rules, err := api.LoadRules(opts.rulesFile)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		api.Rules = rules
+		log.Info("loaded %d owner rules", len(rules))
+	}
+
 	index.I = index.NewFileIndex(dir)
+	index.I.SetDurability(opts.durability, opts.batchInterval)
+	index.I.SetHistoryLimit(opts.historyLimit)
 
 	// create nanodb lock
 	err := acquireLock(dir)
@@ -120,10 +371,29 @@ func setup(dir string) {
 		return
 	}
 
+	// roll forward any operations interrupted by a crash
+	err = index.I.OpenJournal()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
 	index.I.Regenerate()
+	for _, path := range opts.fieldIndexes {
+		index.I.AddFieldIndex(path)
+	}
+
+	// delete expired keys in the background
+	index.I.StartReaper(index.DefaultReapInterval)
+
+	// deliver changes to the targets in _webhooks. Without workers nothing
+	// is queued, since the queue would only fill up
+	if opts.webhookWorkers > 0 {
+		index.I.StartWebhooks(opts.webhookWorkers, index.DefaultWebhookBackoff)
+	}
 
 	// trap sigint
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -135,7 +405,15 @@ func setup(dir string) {
 func cleanup(dir string) {
 	log.Info("\ncaught term signal! cleaning up...")
 
-	err := releaseLock(dir)
+	// flush any batched writes
+	index.I.Flush()
+
+	err := index.I.CloseJournal()
+	if err != nil {
+		log.Warn("couldn't close journal: %s", err.Error())
+	}
+
+	err = releaseLock(dir)
 	if err != nil {
 		log.Warn("couldn't remove lock")
 		log.Fatal(err)
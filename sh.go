@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jackyzha0/nanoDB/index"
 	"github.com/jackyzha0/nanoDB/log"
@@ -19,7 +20,12 @@ const DefaultDepth = 0
 func shell(dir string) error {
 	log.IsShellMode = true
 	log.Info("starting nanodb shell...")
-	setup(dir)
+	setup(options{
+		dir:            dir,
+		durability:     index.DurabilityPerWrite,
+		historyLimit:   index.DefaultHistoryLimit,
+		webhookWorkers: index.DefaultWebhookWorkers,
+	})
 
 	reader := bufio.NewReader(os.Stdin)
 	for {
@@ -53,11 +59,19 @@ func execInput(input string, dir string) (err error) {
 		return lookupWrapper(args)
 	case "delete":
 		return deleteWrapper(args)
+	case "expire":
+		return expireWrapper(args)
+	case "history":
+		return historyWrapper(args)
+	case "restore":
+		return restoreWrapper(args)
+	case "search":
+		return searchWrapper(args)
 	case "regenerate":
 		index.I.Regenerate()
 	default:
 		log.Warn("'%s' is not a valid command.", args[0])
-		log.Info("valid commands: index, lookup <key> <depth>, delete <key>, regenerate, exit")
+		log.Info("valid commands: index, lookup <key> <depth>, delete <key>, expire <key> <seconds>, history <key>, restore <key> <version>, search <terms>, regenerate, exit")
 	}
 	return err
 }
@@ -154,3 +168,99 @@ func deleteWrapper(args []string) error {
 	log.Success("deleted key %s", key)
 	return nil
 }
+
+func historyWrapper(args []string) error {
+	// assert theres a key
+	if len(args) < 2 {
+		err := fmt.Errorf("no key provided")
+		return err
+	}
+	key := args[1]
+
+	versions, err := index.I.History(key)
+	if err != nil {
+		return err
+	}
+
+	log.Success("found %d versions of key %s:", len(versions), key)
+	for _, v := range versions {
+		log.Info("%d\t%s", v.Version, v.Time.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func restoreWrapper(args []string) error {
+	// assert theres a key and version
+	if len(args) < 3 {
+		err := fmt.Errorf("no key or version provided")
+		return err
+	}
+	key := args[1]
+
+	version, err := strconv.Atoi(args[2])
+	if err != nil {
+		return fmt.Errorf("version '%s' is not a number", args[2])
+	}
+
+	// get old contents
+	b, err := index.I.GetVersion(key, version)
+	if err != nil {
+		return fmt.Errorf("version %d of key %s doesn't exist", version, key)
+	}
+
+	// write back as the current version
+	f, _ := index.I.Lookup(key)
+	err = index.I.Put(f, b)
+	if err != nil {
+		return err
+	}
+
+	log.Success("restored key %s to version %d", key, version)
+	return nil
+}
+
+func expireWrapper(args []string) error {
+	// assert theres a key and ttl
+	if len(args) < 3 {
+		err := fmt.Errorf("no key or ttl provided")
+		return err
+	}
+	key := args[1]
+
+	seconds, err := strconv.Atoi(args[2])
+	if err != nil || seconds < 1 {
+		return fmt.Errorf("ttl '%s' is not a positive number of seconds", args[2])
+	}
+
+	// lookup key, return err if not found
+	err = index.I.Expire(key, time.Duration(seconds)*time.Second)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("key doesn't exist")
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Success("key %s expires in %d seconds", key, seconds)
+	return nil
+}
+
+func searchWrapper(args []string) error {
+	// assert theres something to search for
+	query := strings.Join(args[1:], " ")
+	if len(index.Tokenize(query)) == 0 {
+		err := fmt.Errorf("no search terms provided")
+		return err
+	}
+
+	results := index.I.Search(query, 0)
+	log.Success("found %d keys matching '%s':", len(results), query)
+
+	for _, r := range results {
+		log.Info("%s\t(score %.3f)", r.Key, r.Score)
+		for path, text := range r.Highlights {
+			log.Info("\t%s: %s", path, text)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// tlsReloader holds the tls settings loaded from the certificate, key and
+// client ca files, so they can be replaced while the server is running
+type tlsReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+// newTLSReloader loads the certificate and key, and the client ca if
+// caFile isn't empty, which then makes every client present a certificate
+// signed by it
+func newTLSReloader(certFile string, keyFile string, caFile string) (*tlsReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("https needs both --tls-cert and --tls-key")
+	}
+
+	r := &tlsReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the files again, keeping the current settings if any of them is invalid
+func (r *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load tls certificate: %s", err.Error())
+	}
+
+	// this config replaces the one net/http sets up, so it has to offer http/2 itself
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("couldn't load client ca: %s", err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("client ca file %s holds no PEM certificates", r.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config = config
+	return nil
+}
+
+// getCertificate returns the current certificate
+func (r *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &r.config.Certificates[0], nil
+}
+
+// getConfigForClient returns the current settings for a new connection
+func (r *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config, nil
+}
+
+// serverConfig returns the settings for a server always using the current certificate and client ca
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     r.getCertificate,
+		GetConfigForClient: r.getConfigForClient,
+	}
+}
+
+// reloadOnHangup reloads the files in the background every time the process gets a SIGHUP
+func (r *tlsReloader) reloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := r.reload(); err != nil {
+				log.Warn("kept the previous tls certificate: %s", err.Error())
+				continue
+			}
+			log.Info("reloaded tls certificate")
+		}
+	}()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate along with its key, in PEM form and parsed
+type testCert struct {
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate with serial, signed by parent or by
+// itself if parent is nil
+func newTestCert(t *testing.T, serial int64, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("err generating key: %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("err creating certificate: %s", err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+}
+
+// tlsPair returns c as a certificate a client can present
+func (c *testCert) tlsPair(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	pair, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatalf("err loading key pair: %s", err.Error())
+	}
+	return pair
+}
+
+func writeTestFile(t *testing.T, path string, contents []byte) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatalf("err writing %s: %s", path, err.Error())
+	}
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nanodb-tls")
+	if err != nil {
+		t.Fatalf("err creating temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, 1, nil, true)
+	server := newTestCert(t, 2, ca, false)
+	client := newTestCert(t, 3, ca, false)
+	stranger := newTestCert(t, 4, newTestCert(t, 5, nil, true), false)
+
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, certFile, server.certPEM)
+	writeTestFile(t, keyFile, server.keyPEM)
+	writeTestFile(t, caFile, ca.certPEM)
+
+	if _, err := newTLSReloader(certFile, "", caFile); err == nil {
+		t.Errorf("https without a key should fail")
+	}
+	if _, err := newTLSReloader(certFile, keyFile, certFile+".missing"); err == nil {
+		t.Errorf("https with a missing client ca should fail")
+	}
+
+	certs, err := newTLSReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("err loading tls settings: %s", err.Error())
+	}
+	certs.reloadOnHangup()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err listening: %s", err.Error())
+	}
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: certs.serverConfig(),
+	}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	defer srv.Close()
+
+	// get makes a request on a new connection, presenting clientCert if it isn't nil
+	get := func(clientCert *testCert) (*http.Response, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		config := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			config.Certificates = []tls.Certificate{clientCert.tlsPair(t)}
+		}
+
+		transport := &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: true}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport, Timeout: 5 * time.Second}).Get("https://" + ln.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// serial returns the serial number of the certificate the server presents
+	serial := func(t *testing.T) int64 {
+		t.Helper()
+
+		resp, err := get(client)
+		if err != nil {
+			t.Fatalf("err making request: %s", err.Error())
+		}
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	t.Run("clients with a certificate signed by the ca get http/2", func(t *testing.T) {
+		resp, err := get(client)
+		if err != nil {
+			t.Fatalf("err making request: %s", err.Error())
+		}
+		if resp.ProtoMajor != 2 {
+			t.Errorf("got protocol %s, wanted HTTP/2", resp.Proto)
+		}
+	})
+
+	t.Run("clients without a certificate are rejected", func(t *testing.T) {
+		if _, err := get(nil); err == nil {
+			t.Errorf("request without a client certificate should fail")
+		}
+	})
+
+	t.Run("clients with a certificate from another ca are rejected", func(t *testing.T) {
+		if _, err := get(stranger); err == nil {
+			t.Errorf("request with an unknown client certificate should fail")
+		}
+	})
+
+	t.Run("certificate is reloaded on SIGHUP", func(t *testing.T) {
+		renewed := newTestCert(t, 6, ca, false)
+		writeTestFile(t, certFile, renewed.certPEM)
+		writeTestFile(t, keyFile, renewed.keyPEM)
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("err sending SIGHUP: %s", err.Error())
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for serial(t) != 6 {
+			if time.Now().After(deadline) {
+				t.Fatalf("server still presents the old certificate")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("invalid files keep the previous certificate", func(t *testing.T) {
+		writeTestFile(t, certFile, []byte("not a certificate"))
+		if err := certs.reload(); err == nil {
+			t.Errorf("reloading an invalid certificate should fail")
+		}
+		if got := serial(t); got != 6 {
+			t.Errorf("got certificate %d, wanted the previous one", got)
+		}
+	})
+}
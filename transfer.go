@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/jackyzha0/nanoDB/index"
+	"github.com/jackyzha0/nanoDB/log"
+)
+
+// exportDocs writes every document in dir to out, or stdout if out is -
+func exportDocs(dir string, format string, out string, depth int) error {
+	closeDB, err := openOffline(dir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	var w io.Writer = os.Stdout
+	if out != "-" {
+		f, err := index.I.FileSystem.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	count, err := index.I.Export(w, format, depth)
+	if err != nil {
+		return err
+	}
+
+	log.Success("exported %d documents", count)
+	return nil
+}
+
+// importDocs puts every document in from, or stdin if from is -, into dir
+func importDocs(dir string, format string, from string, policy string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	closeDB, err := openOffline(dir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	var r io.Reader = os.Stdin
+	if from != "-" {
+		f, err := index.I.FileSystem.Open(from)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	stats, err := index.I.Import(r, format, policy)
+	if err != nil {
+		return err
+	}
+
+	log.Success("imported %d documents, skipped %d existing", stats.Imported, stats.Skipped)
+	return nil
+}